@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Raw uploads that did not tell the ID of a claimed coordinator.
+const keyUnidentifiedUploads = "osp:uploads:unidentified"
+
+// Raw uploads of a coordinator, scored by the time they were received.
+func keyOfCoordinatorUploads(coordinatorID string) string {
+	return "osp:controller:" + coordinatorID + ":uploads"
+}
+
+func keyOfUploads(coordinatorID string) string {
+	if len(coordinatorID) == 0 {
+		return keyUnidentifiedUploads
+	}
+	return keyOfCoordinatorUploads(coordinatorID)
+}
+
+// An archivedUpload is an upload as it was received, before parsing.
+type archivedUpload struct {
+	ID            string    `json:"id"`
+	CoordinatorID string    `json:"coordinator_id,omitempty"`
+	ReceivedAt    time.Time `json:"received_at"`
+	Body          string    `json:"body"`
+}
+
+// An uploadQuery selects archived uploads received between start and end,
+// in unix seconds, whose body contains text. Zero end means now.
+type uploadQuery struct {
+	Start  int64
+	End    int64
+	Text   string
+	Offset int
+	Limit  int
+}
+
+// Uploads matching a query, latest first. Total is the number of matching
+// uploads, of which the page has at most limit from offset.
+type uploadPage struct {
+	Total   int               `json:"total"`
+	Uploads []*archivedUpload `json:"uploads"`
+}
+
+func scoreOfTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// uploadIDOf returns ID of the upload received at the time, under which it
+// is archived and its readings are saved.
+func uploadIDOf(receivedAt time.Time) string {
+	return fmt.Sprintf("%d", receivedAt.UnixNano())
+}
+
+// archiveUpload stores the raw upload under the claimed coordinator it
+// tells, or with the unidentified uploads, and drops uploads there older
+// than the retention period. Uploads of a coordinator that goes quiet
+// expire with the retention period.
+func archiveUpload(body []byte, receivedAt time.Time) (*archivedUpload, error) {
+	u := &archivedUpload{
+		ID:            uploadIDOf(receivedAt),
+		CoordinatorID: coordinatorIDOfUpload(body),
+		ReceivedAt:    receivedAt,
+		Body:          string(body),
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// any ID can be sent, only claimed coordinators get a key of their own
+	key := keyUnidentifiedUploads
+	if len(u.CoordinatorID) > 0 {
+		exists, err := coordinatorExists(u.CoordinatorID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			key = keyOfCoordinatorUploads(u.CoordinatorID)
+		}
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	expired := scoreOfTime(time.Now().Add(-*uploadRetention))
+	tx := multi(redisClient)
+	tx.send("ZADD", key, scoreOfTime(receivedAt), b)
+	tx.send("ZREMRANGEBYSCORE", key, "-inf", fmt.Sprintf("(%f", expired))
+	tx.send("EXPIRE", key, int(uploadRetention.Seconds()))
+	if _, err := tx.exec(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (q *uploadQuery) bounds() (min, max interface{}) {
+	min, max = "-inf", "+inf"
+	if q.Start > 0 {
+		min = q.Start
+	}
+	if q.End > 0 {
+		// scores have fractions of a second
+		max = fmt.Sprintf("(%d", q.End+1)
+	}
+	return min, max
+}
+
+func parseArchivedUploads(bb []interface{}) ([]*archivedUpload, error) {
+	result := make([]*archivedUpload, 0)
+	for _, value := range bb {
+		var u archivedUpload
+		if err := json.Unmarshal(value.([]byte), &u); err != nil {
+			return nil, err
+		}
+		result = append(result, &u)
+	}
+	return result, nil
+}
+
+// searchUploads returns archived uploads of the coordinator, or the
+// unidentified uploads when coordinator ID is empty. Text is matched case
+// insensitively.
+func searchUploads(coordinatorID string, q *uploadQuery) (*uploadPage, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	key := keyOfUploads(coordinatorID)
+	min, max := q.bounds()
+	page := &uploadPage{}
+
+	if len(q.Text) == 0 {
+		total, err := redis.Int(redisClient.Do("ZCOUNT", key, min, max))
+		if err != nil {
+			return nil, err
+		}
+		bb, err := redis.Values(redisClient.Do("ZREVRANGEBYSCORE", key, max, min, "LIMIT", q.Offset, q.Limit))
+		if err != nil {
+			return nil, err
+		}
+		page.Total = total
+		page.Uploads, err = parseArchivedUploads(bb)
+		if err != nil {
+			return nil, err
+		}
+		return page, nil
+	}
+
+	bb, err := redis.Values(redisClient.Do("ZREVRANGEBYSCORE", key, max, min))
+	if err != nil {
+		return nil, err
+	}
+	all, err := parseArchivedUploads(bb)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ToLower(q.Text)
+	page.Uploads = make([]*archivedUpload, 0)
+	for _, u := range all {
+		if !strings.Contains(strings.ToLower(u.Body), text) {
+			continue
+		}
+		if page.Total >= q.Offset && len(page.Uploads) < q.Limit {
+			page.Uploads = append(page.Uploads, u)
+		}
+		page.Total++
+	}
+	return page, nil
+}
+
+// recentUploads returns the latest uploads of all coordinators, including
+// unidentified ones.
+func recentUploads(limit int) ([]*archivedUpload, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	ids, err := redis.Strings(redisClient.Do("SMEMBERS", keyCoordinators))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*archivedUpload, 0)
+	for _, coordinatorID := range append(ids, "") {
+		bb, err := redis.Values(redisClient.Do("ZREVRANGE", keyOfUploads(coordinatorID), 0, limit-1))
+		if err != nil {
+			return nil, err
+		}
+		list, err := parseArchivedUploads(bb)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, list...)
+	}
+	sort.Sort(byReceivedAtDesc(result))
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+type byReceivedAtDesc []*archivedUpload
+
+func (a byReceivedAtDesc) Len() int           { return len(a) }
+func (a byReceivedAtDesc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byReceivedAtDesc) Less(i, j int) bool { return a[i].ReceivedAt.After(a[j].ReceivedAt) }
+
+// archivedUploadsBetween returns archived uploads of the coordinator
+// received between start and end, in unix seconds, oldest first.
+func archivedUploadsBetween(coordinatorID string, start, end int64) ([]*archivedUpload, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	q := &uploadQuery{Start: start, End: end}
+	min, max := q.bounds()
+	bb, err := redis.Values(redisClient.Do("ZRANGEBYSCORE", keyOfUploads(coordinatorID), min, max))
+	if err != nil {
+		return nil, err
+	}
+	return parseArchivedUploads(bb)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestArchiveUploads(c *C) {
+	_, err := claimCoordinator("47", "")
+	c.Assert(err, IsNil)
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		body := fmt.Sprintf(`{"coordinator": {"coordinator_id": 47, "gsm_coverage": %d}}`, i)
+		_, err = archiveUpload([]byte(body), base.Add(time.Duration(i)*time.Minute))
+		c.Assert(err, IsNil)
+	}
+	expired, err := archiveUpload([]byte(`{"coordinator": {"coordinator_id": 47}}`), time.Now().Add(-*uploadRetention-time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(expired.CoordinatorID, Equals, "47")
+
+	page, err := searchUploads("47", &uploadQuery{Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 5)
+	c.Assert(page.Uploads[0].ReceivedAt.Equal(base.Add(4*time.Minute)), Equals, true)
+
+	page, err = searchUploads("47", &uploadQuery{Start: base.Add(time.Minute).Unix(), End: base.Add(3 * time.Minute).Unix(), Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 3)
+
+	page, err = searchUploads("47", &uploadQuery{Offset: 1, Limit: 2})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 5)
+	c.Assert(len(page.Uploads), Equals, 2)
+	c.Assert(page.Uploads[0].Body, Matches, `.*"gsm_coverage": 3.*`)
+
+	page, err = searchUploads("47", &uploadQuery{Text: `GSM_COVERAGE": 2`, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 1)
+	c.Assert(page.Uploads[0].Body, Matches, `.*"gsm_coverage": 2.*`)
+
+	page, err = searchUploads("47", &uploadQuery{Text: "gsm", Offset: 3, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 5)
+	c.Assert(len(page.Uploads), Equals, 2)
+
+	_, err = archiveUpload([]byte("garbage"), time.Now())
+	c.Assert(err, IsNil)
+	page, err = searchUploads("", &uploadQuery{Text: "garbage", Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total >= 1, Equals, true)
+
+	// the last second of a range is included
+	late := base.Add(10*time.Minute + 500*time.Millisecond)
+	_, err = archiveUpload([]byte(`{"coordinator": {"coordinator_id": 47, "gsm_coverage": 9}}`), late)
+	c.Assert(err, IsNil)
+	page, err = searchUploads("47", &uploadQuery{Start: late.Unix(), End: late.Unix(), Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 1)
+
+	// any coordinator ID can be sent, unclaimed ones get no key of their own
+	_, err = archiveUpload([]byte(`{"coordinator": {"coordinator_id": 470}}`), time.Now())
+	c.Assert(err, IsNil)
+	page, err = searchUploads("470", &uploadQuery{Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 0)
+	page, err = searchUploads("", &uploadQuery{Text: `"coordinator_id": 470`, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(page.Total, Equals, 1)
+	c.Assert(page.Uploads[0].CoordinatorID, Equals, "470")
+
+	recent, err := recentUploads(3)
+	c.Assert(err, IsNil)
+	c.Assert(len(recent), Equals, 3)
+	c.Assert(recent[0].ReceivedAt.After(recent[2].ReceivedAt), Equals, true)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func keyOfSensorAssignments(sensorID string) string {
+	return fmt.Sprintf("osp:sensor:%s:assignments", sensorID)
+}
+
+// Sensors that have ever belonged to the coordinator. The sensors set of a
+// coordinator holds only its current sensors.
+func keyOfCoordinatorSensorHistory(coordinatorID string) string {
+	return "osp:controller:" + coordinatorID + ":sensor_history"
+}
+
+// An assignment is a period when a sensor belonged to a coordinator. The
+// current assignment has no end. Start is zero when the sensor belonged to
+// the coordinator before assignments were tracked.
+type assignment struct {
+	CoordinatorID string     `json:"coordinator_id"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end,omitempty"`
+}
+
+// A time range in unix seconds, both ends included.
+type timeRange struct {
+	start int
+	end   int
+}
+
+// Number of times a transaction on watched keys is tried again when the
+// keys were changed concurrently.
+const maxTransactionRetries = 5
+
+// addSensorToCoordinator assigns the sensor to the coordinator. When the
+// sensor moves from another coordinator, the previous assignment is closed
+// and the sensor is removed from the sensors of the previous coordinator.
+// Sensors are only moved when claimed, uploads use addSensorOfUpload.
+func addSensorToCoordinator(sensorID, coordinatorID string, at time.Time) error {
+	return assignSensor(sensorID, coordinatorID, at, true)
+}
+
+// addSensorOfUpload assigns a sensor heard by the coordinator to it, unless
+// the sensor belongs to another coordinator, which takes a claim.
+func addSensorOfUpload(sensorID, coordinatorID string, at time.Time) error {
+	return assignSensor(sensorID, coordinatorID, at, false)
+}
+
+func assignSensor(sensorID, coordinatorID string, at time.Time, move bool) error {
+	for i := 0; i < maxTransactionRetries; i++ {
+		done, err := tryAssignSensor(sensorID, coordinatorID, at, move)
+		if err != nil || done {
+			return err
+		}
+	}
+	return fmt.Errorf("Sensor %s was changed concurrently, try again", sensorID)
+}
+
+// tryAssignSensor tells false when the sensor was changed concurrently and
+// nothing was done.
+func tryAssignSensor(sensorID, coordinatorID string, at time.Time, move bool) (bool, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	if _, err := redisClient.Do("WATCH", keySensorToController, keyOfSensorAssignments(sensorID)); err != nil {
+		return false, err
+	}
+	unwatch := func(err error) (bool, error) {
+		redisClient.Do("UNWATCH")
+		return err == nil, err
+	}
+
+	previous, err := redis.String(redisClient.Do("HGET", keySensorToController, sensorID))
+	if err != nil && err != redis.ErrNil {
+		return unwatch(err)
+	}
+	if previous == coordinatorID {
+		if _, err := redisClient.Do("SADD", keyOfCoordinatorSensors(coordinatorID), sensorID); err != nil {
+			return unwatch(err)
+		}
+		return unwatch(nil)
+	}
+	if len(previous) > 0 && !move {
+		log.Println("Sensor", sensorID, "of coordinator", previous, "heard by", coordinatorID, "is not moved until claimed")
+		return unwatch(nil)
+	}
+
+	assignments, err := sensorAssignments(sensorID)
+	if err != nil {
+		return unwatch(err)
+	}
+
+	tx := multi(redisClient)
+	if len(previous) > 0 {
+		last := &assignment{CoordinatorID: previous}
+		if len(assignments) > 0 {
+			last = assignments[len(assignments)-1]
+		}
+		last.End = &at
+		b, err := json.Marshal(last)
+		if err != nil {
+			tx.fail(err)
+		}
+		if len(assignments) > 0 {
+			tx.send("LSET", keyOfSensorAssignments(sensorID), -1, b)
+		} else {
+			tx.send("RPUSH", keyOfSensorAssignments(sensorID), b)
+		}
+		tx.send("SREM", keyOfCoordinatorSensors(previous), sensorID)
+		tx.send("SADD", keyOfCoordinatorSensorHistory(previous), sensorID)
+	}
+	b, err := json.Marshal(&assignment{CoordinatorID: coordinatorID, Start: at})
+	if err != nil {
+		tx.fail(err)
+	}
+	tx.send("RPUSH", keyOfSensorAssignments(sensorID), b)
+	tx.send("HSET", keySensorToController, sensorID, coordinatorID)
+	tx.send("SADD", keyOfCoordinatorSensors(coordinatorID), sensorID)
+	tx.send("SADD", keyOfCoordinatorSensorHistory(coordinatorID), sensorID)
+	reply, err := tx.exec()
+	if err != nil || reply == nil {
+		return false, err
+	}
+	if len(previous) > 0 {
+		log.Println("Sensor", sensorID, "moved from coordinator", previous, "to", coordinatorID)
+	}
+	return true, nil
+}
+
+// sensorAssignments returns assignments of the sensor in chronological
+// order. A sensor that has never moved has a single open assignment to its
+// current coordinator.
+func sensorAssignments(sensorID string) ([]*assignment, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("LRANGE", keyOfSensorAssignments(sensorID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*assignment, 0)
+	for _, value := range bb {
+		var a assignment
+		if err := json.Unmarshal(value.([]byte), &a); err != nil {
+			return nil, err
+		}
+		result = append(result, &a)
+	}
+	if len(result) > 0 {
+		return result, nil
+	}
+
+	coordinatorID, err := findCoordinatorIDBySensorID(sensorID)
+	if err != nil {
+		return nil, err
+	}
+	if len(coordinatorID) > 0 {
+		result = append(result, &assignment{CoordinatorID: coordinatorID})
+	}
+	return result, nil
+}
+
+// assignedRanges returns the parts of the time range when the sensor
+// belonged to the coordinator.
+func assignedRanges(assignments []*assignment, coordinatorID string, start, end int) []timeRange {
+	var result []timeRange
+	for _, a := range assignments {
+		if a.CoordinatorID != coordinatorID {
+			continue
+		}
+		tr := timeRange{start: start, end: end}
+		if !a.Start.IsZero() && int(a.Start.Unix()) > tr.start {
+			tr.start = int(a.Start.Unix())
+		}
+		// readings at the moment of a move belong to the next coordinator
+		if a.End != nil && int(a.End.Unix())-1 < tr.end {
+			tr.end = int(a.End.Unix()) - 1
+		}
+		if tr.start <= tr.end {
+			result = append(result, tr)
+		}
+	}
+	return result
+}
+
+// coordinatorRanges returns the time ranges when the sensors belonged to
+// the coordinator, within given range.
+func coordinatorRanges(sensorIDs []string, coordinatorID string, start, end int) (map[string][]timeRange, error) {
+	result := make(map[string][]timeRange)
+	for _, sensorID := range sensorIDs {
+		assignments, err := sensorAssignments(sensorID)
+		if err != nil {
+			return nil, err
+		}
+		result[sensorID] = assignedRanges(assignments, coordinatorID, start, end)
+	}
+	return result, nil
+}
+
+// sensorIDsOfCoordinatorHistory returns all sensors that have ever belonged
+// to the coordinator, sorted.
+func sensorIDsOfCoordinatorHistory(coordinatorID string) ([]string, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	ids, err := redis.Strings(redisClient.Do("SUNION", keyOfCoordinatorSensors(coordinatorID), keyOfCoordinatorSensorHistory(coordinatorID)))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// cleanupMemberships removes sensors from coordinators they no longer
+// belong to. Before assignments were tracked, a moved sensor was left in
+// the sensors of its previous coordinator.
+func cleanupMemberships() (int, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	coordinatorIDs, err := redis.Strings(redisClient.Do("SMEMBERS", keyCoordinators))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, coordinatorID := range coordinatorIDs {
+		sensorIDs, err := sensorIDsOfCoordinator(coordinatorID)
+		if err != nil {
+			return removed, err
+		}
+		for _, sensorID := range sensorIDs {
+			if _, err := redisClient.Do("WATCH", keySensorToController); err != nil {
+				return removed, err
+			}
+			current, err := findCoordinatorIDBySensorID(sensorID)
+			if err != nil || current == coordinatorID {
+				redisClient.Do("UNWATCH")
+				if err != nil {
+					return removed, err
+				}
+				continue
+			}
+			tx := multi(redisClient)
+			tx.send("SREM", keyOfCoordinatorSensors(coordinatorID), sensorID)
+			tx.send("SADD", keyOfCoordinatorSensorHistory(coordinatorID), sensorID)
+			reply, err := tx.exec()
+			if err != nil {
+				return removed, err
+			}
+			// left for the next run when the sensor was moved meanwhile
+			if reply != nil {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
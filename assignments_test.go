@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestAssignedRanges(c *C) {
+	moved := time.Unix(1000, 0)
+	assignments := []*assignment{
+		{CoordinatorID: "1", End: &moved},
+		{CoordinatorID: "2", Start: moved},
+	}
+	c.Assert(assignedRanges(assignments, "1", 0, 5000), DeepEquals, []timeRange{{start: 0, end: 999}})
+	c.Assert(assignedRanges(assignments, "2", 0, 5000), DeepEquals, []timeRange{{start: 1000, end: 5000}})
+	c.Assert(assignedRanges(assignments, "2", 0, 500), IsNil)
+	c.Assert(assignedRanges(assignments, "3", 0, 5000), IsNil)
+}
+
+func (s *TestSuite) TestAddSensorToCoordinator(c *C) {
+	first := time.Unix(1000, 0)
+	moved := time.Unix(2000, 0)
+	c.Assert(addSensorToCoordinator("5E001", "51", first), IsNil)
+	c.Assert(addSensorToCoordinator("5E001", "51", first.Add(time.Minute)), IsNil)
+	c.Assert(addSensorToCoordinator("5E001", "52", moved), IsNil)
+
+	ids, err := sensorIDsOfCoordinator("51")
+	c.Assert(err, IsNil)
+	c.Assert(len(ids), Equals, 0)
+	ids, err = sensorIDsOfCoordinatorHistory("51")
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []string{"5E001"})
+
+	assignments, err := sensorAssignments("5E001")
+	c.Assert(err, IsNil)
+	c.Assert(len(assignments), Equals, 2)
+	c.Assert(assignments[0].CoordinatorID, Equals, "51")
+	c.Assert(assignments[0].End.Equal(moved), Equals, true)
+	c.Assert(assignments[1].CoordinatorID, Equals, "52")
+	c.Assert(assignments[1].End, IsNil)
+
+	ranges, err := coordinatorRanges([]string{"5E001"}, "51", 0, 3000)
+	c.Assert(err, IsNil)
+	c.Assert(ranges["5E001"], DeepEquals, []timeRange{{start: 1000, end: 1999}})
+}
+
+func (s *TestSuite) TestUploadDoesNotMoveSensor(c *C) {
+	at := time.Unix(1000, 0)
+	c.Assert(addSensorOfUpload("5E002", "53", at), IsNil)
+	c.Assert(addSensorOfUpload("5E002", "54", at.Add(time.Minute)), IsNil)
+
+	coordinatorID, err := findCoordinatorIDBySensorID("5E002")
+	c.Assert(err, IsNil)
+	c.Assert(coordinatorID, Equals, "53")
+	assignments, err := sensorAssignments("5E002")
+	c.Assert(err, IsNil)
+	c.Assert(len(assignments), Equals, 1)
+	ids, err := sensorIDsOfCoordinator("54")
+	c.Assert(err, IsNil)
+	c.Assert(len(ids), Equals, 0)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var errNoTickForCalibration = errors.New("Sensor has no ticks to calibrate against")
+
+// A calibration reference point pairs a temperature measured with a
+// reference thermometer with the reading of the sensor at that time.
+type calibrationPoint struct {
+	ReferenceTemperature    float64   `json:"reference_temperature"`
+	RawTemperature          float64   `json:"raw_temperature"`
+	UncalibratedTemperature float64   `json:"uncalibrated_temperature"`
+	TickDatetime            time.Time `json:"tick_datetime"`
+	CreatedAt               time.Time `json:"created_at"`
+	Residual                *float64  `json:"residual,omitempty"`
+}
+
+type staleTickError struct {
+	age time.Duration
+}
+
+func (e staleTickError) Error() string {
+	return fmt.Sprintf("Last tick of sensor is %v old, calibration needs a tick newer than %v", e.age, *calibrationMaxTickAge)
+}
+
+// fitCalibration fits calibrated = gain * uncalibrated + offset over the
+// given points using least squares. A single point, or points that all
+// have the same uncalibrated value, yield an offset-only calibration.
+func fitCalibration(points []*calibrationPoint) (gain float64, offset float64, err error) {
+	if len(points) == 0 {
+		return 0, 0, errors.New("No calibration points")
+	}
+
+	n := float64(len(points))
+	var sumX, sumY, sumXX, sumXY float64
+	for _, p := range points {
+		x := p.UncalibratedTemperature
+		y := p.ReferenceTemperature
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if len(points) == 1 || math.Abs(denominator) < 1e-9 {
+		return 1, (sumY - sumX) / n, nil
+	}
+
+	gain = (n*sumXY - sumX*sumY) / denominator
+	offset = (sumY - gain*sumX) / n
+	return gain, offset, nil
+}
+
+// setResiduals stores the difference between the reference temperature and
+// the calibrated temperature on each point.
+func setResiduals(points []*calibrationPoint, gain, offset float64) {
+	for _, p := range points {
+		residual := p.ReferenceTemperature - (gain*p.UncalibratedTemperature + offset)
+		p.Residual = &residual
+	}
+}
+
+// calibrate adds the current temperature of the sensor as a new reference
+// point, paired with the last tick of the sensor, and refits the calibration
+// from all stored reference points.
+func (s *sensor) calibrate() error {
+	if s.ResetCalibration {
+		log.Println("[CALIBRATION] Resetting calibration of", s.ID)
+		if err := resetCalibration(s.ID); err != nil {
+			return err
+		}
+		s.ResetCalibration = false
+	}
+
+	if s.CurrentTemperature == nil {
+		return nil
+	}
+
+	log.Println("[CALIBRATION] Calculating")
+	lastTick, err := lastTickOfSensor(s.ID)
+	if err != nil {
+		return err
+	}
+	log.Println("[CALIBRATION] Last tick is", lastTick)
+	if lastTick == nil {
+		return errNoTickForCalibration
+	}
+	if age := time.Since(lastTick.Datetime); age > *calibrationMaxTickAge {
+		return staleTickError{age: age}
+	}
+
+	stored, err := loadSensor("", s.ID)
+	if err != nil {
+		return err
+	}
+	uncalibrated, err := stored.profile.convert(channelTemperature, lastTick.RawTemperature)
+	if err != nil {
+		return err
+	}
+
+	log.Println("[CALIBRATION] current temperature is", *s.CurrentTemperature)
+	log.Println("[CALIBRATION] uncalibrated temperature of last tick is", uncalibrated)
+	p := &calibrationPoint{
+		ReferenceTemperature:    *s.CurrentTemperature,
+		RawTemperature:          lastTick.RawTemperature,
+		UncalibratedTemperature: uncalibrated,
+		TickDatetime:            lastTick.Datetime,
+		CreatedAt:               time.Now(),
+	}
+	if err := addCalibrationPoint(s.ID, p); err != nil {
+		return err
+	}
+
+	points, err := calibrationPoints(s.ID)
+	if err != nil {
+		return err
+	}
+
+	gain, offset, err := fitCalibration(points)
+	if err != nil {
+		return err
+	}
+	setResiduals(points, gain, offset)
+	log.Println("[CALIBRATION] new gain is", gain, "new offset is", offset, "from", len(points), "points")
+
+	if err := saveCalibration(s.ID, gain, offset); err != nil {
+		return err
+	}
+
+	s.CalibrationGain = &gain
+	s.CalibrationConstant = &offset
+	s.CalibrationPoints = points
+
+	log.Println("[CALIBRATION] setting current temp to nil again")
+	s.CurrentTemperature = nil
+	return nil
+}
+
+func addCalibrationPoint(sensorID string, p *calibrationPoint) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("RPUSH", keyOfSensorCalibrationPoints(sensorID), b)
+	return err
+}
+
+func calibrationPoints(sensorID string) ([]*calibrationPoint, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("LRANGE", keyOfSensorCalibrationPoints(sensorID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*calibrationPoint
+	for _, value := range bb {
+		var p calibrationPoint
+		if err := json.Unmarshal(value.([]byte), &p); err != nil {
+			return nil, err
+		}
+		result = append(result, &p)
+	}
+	return result, nil
+}
+
+func saveCalibration(sensorID string, gain, offset float64) error {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err := redisClient.Do("HMSET", keyOfSensor(sensorID),
+		"calibration_gain", gain,
+		"calibration_constant", offset)
+	return err
+}
+
+func resetCalibration(sensorID string) error {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	if _, err := redisClient.Do("DEL", keyOfSensorCalibrationPoints(sensorID)); err != nil {
+		return err
+	}
+	if _, err := redisClient.Do("HDEL", keyOfSensor(sensorID), "calibration_gain", "calibration_constant"); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestFitCalibrationSinglePoint(c *C) {
+	points := []*calibrationPoint{
+		{ReferenceTemperature: 21.5, UncalibratedTemperature: 20},
+	}
+	gain, offset, err := fitCalibration(points)
+	c.Assert(err, IsNil)
+	c.Assert(gain, Equals, float64(1))
+	c.Assert(math.Abs(offset-1.5) < 1e-9, Equals, true)
+}
+
+func (s *TestSuite) TestFitCalibrationTwoPoints(c *C) {
+	// ice bath and ambient, sensor reads 2 degrees too high at 0 and
+	// 1 degree too high at 20
+	points := []*calibrationPoint{
+		{ReferenceTemperature: 0, UncalibratedTemperature: 2},
+		{ReferenceTemperature: 20, UncalibratedTemperature: 21},
+	}
+	gain, offset, err := fitCalibration(points)
+	c.Assert(err, IsNil)
+	c.Assert(math.Abs(gain-20.0/19.0) < 1e-9, Equals, true)
+	c.Assert(math.Abs(offset+40.0/19.0) < 1e-9, Equals, true)
+
+	setResiduals(points, gain, offset)
+	for _, p := range points {
+		c.Assert(p.Residual, Not(IsNil))
+		c.Assert(math.Abs(*p.Residual) < 1e-9, Equals, true)
+	}
+}
+
+func (s *TestSuite) TestFitCalibrationNoPoints(c *C) {
+	_, _, err := fitCalibration(nil)
+	c.Assert(err, Not(IsNil))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Channels that are stored in the fixed fields of a tick.
+const (
+	channelMoisture     = "moisture"
+	channelMoistureRaw  = "moisture_raw"
+	channelRadioQuality = "radio_quality"
+)
+
+type channelInfo struct {
+	Name string `json:"name"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// setChannelsFromSensorReading converts raw channel values of the payload
+// using the profile of the sensor. Channels unknown to the profile are
+// stored as they were sent. Channels that clash with the fixed fields of
+// tick are ignored.
+func (t *tick) setChannelsFromSensorReading(channels map[string]float64, s *sensor) {
+	for name, raw := range channels {
+		if isFixedChannel(name) {
+			log.Println("[CHANNELS]", t.SensorID, "ignoring channel", name, "that clashes with a fixed field")
+			continue
+		}
+		value := raw
+		if _, ok := s.profile.Channels[name]; ok {
+			converted, err := s.profile.convert(name, raw)
+			if err != nil {
+				log.Println("[CHANNELS]", t.SensorID, "discarding", name, err)
+				t.addAlert(name, err)
+				continue
+			}
+			value = converted
+		}
+		if t.Channels == nil {
+			t.Channels = make(map[string]float64)
+		}
+		t.Channels[name] = value
+	}
+}
+
+func isFixedChannel(name string) bool {
+	switch name {
+	case channelTemperature, channelBatteryVoltage, channelCPUTemperature,
+		channelMoisture, channelMoistureRaw, channelRadioQuality:
+		return true
+	}
+	return false
+}
+
+// channelValues returns all channels of the tick, both fixed fields and
+// the generic channels, by channel name. Like in JSON of the tick, fixed
+// fields with zero value are left out.
+func (t *tick) channelValues() map[string]float64 {
+	values := make(map[string]float64)
+	fixed := map[string]float64{
+		channelTemperature:    t.Temperature,
+		channelBatteryVoltage: t.BatteryVoltage,
+		channelMoistureRaw:    float64(t.Humidity),
+		channelRadioQuality:   float64(t.RadioQuality),
+	}
+	for name, value := range fixed {
+		if value != 0 {
+			values[name] = value
+		}
+	}
+	if t.CPUTemperature != nil {
+		values[channelCPUTemperature] = *t.CPUTemperature
+	}
+	if t.Moisture != nil {
+		values[channelMoisture] = *t.Moisture
+	}
+	for name, value := range t.Channels {
+		values[name] = value
+	}
+	return values
+}
+
+// averageChannels averages the generic channels of ticks. Each channel is
+// averaged over the ticks that have it.
+func averageChannels(ticks []*tick) map[string]float64 {
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, t := range ticks {
+		for name, value := range t.Channels {
+			sums[name] += value
+			counts[name]++
+		}
+	}
+	if len(sums) == 0 {
+		return nil
+	}
+	for name := range sums {
+		sums[name] /= float64(counts[name])
+	}
+	return sums
+}
+
+func addSensorChannels(sensorID string, channels map[string]float64) error {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	args := []interface{}{keyOfSensorChannels(sensorID)}
+	for name := range channels {
+		args = append(args, name)
+	}
+	_, err := redisClient.Do("SADD", args...)
+	return err
+}
+
+// sensorChannels lists the channels a sensor has reported, with units
+// from the profile of the sensor.
+func sensorChannels(sensorID string) ([]*channelInfo, error) {
+	s, err := loadSensor("", sensorID)
+	if err != nil {
+		return nil, err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	names, err := redis.Strings(redisClient.Do("SMEMBERS", keyOfSensorChannels(sensorID)))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	names = append(names, channelTemperature, channelBatteryVoltage, channelCPUTemperature, channelMoistureRaw, channelRadioQuality)
+	if len(s.Material) > 0 {
+		names = append(names, channelMoisture)
+	}
+	sort.Strings(names)
+
+	var result []*channelInfo
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		info := &channelInfo{Name: name}
+		if cp, ok := s.profile.Channels[name]; ok {
+			info.Unit = cp.Unit
+		} else if name == channelMoisture {
+			info.Unit = "%"
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestSetChannelsFromSensorReading(c *C) {
+	profile := &sensorProfile{
+		Name: "co2_probe",
+		Channels: map[string]*channelProfile{
+			"co2": {Unit: "ppm", Conversion: conversion{Scale: 2}, Max: floatPtr(5000)},
+		},
+	}
+	sr := sensorReading{
+		SensorID: "13A20040B421AC",
+		Channels: map[string]float64{
+			"co2":         400,
+			"light":       123,
+			"temperature": 1,
+		},
+	}
+
+	t := &tick{SensorID: sr.SensorID}
+	t.setChannelsFromSensorReading(sr.Channels, &sensor{profile: profile})
+	c.Assert(t.Channels, DeepEquals, map[string]float64{"co2": 800, "light": 123})
+
+	sr.Channels["co2"] = 4000
+	t = &tick{SensorID: sr.SensorID}
+	t.setChannelsFromSensorReading(sr.Channels, &sensor{profile: profile})
+	_, hasCO2 := t.Channels["co2"]
+	c.Assert(hasCO2, Equals, false)
+}
+
+func (s *TestSuite) TestParsePayloadChannels(c *C) {
+	var pl payload
+	err := json.Unmarshal([]byte(`{"coordinator":{"coordinator_id":1,"sensor_readings":[{"sensor_id":"1A001","channels":{"co2":412.5}}]}}`), &pl)
+	c.Assert(err, IsNil)
+	c.Assert(pl.Coordinator.SensorReadings[0].Channels["co2"], Equals, 412.5)
+}
+
+func (s *TestSuite) TestAverageChannels(c *C) {
+	ticks := []*tick{
+		{Channels: map[string]float64{"co2": 400, "light": 10}},
+		{Channels: map[string]float64{"co2": 600}},
+		{},
+	}
+	c.Assert(averageChannels(ticks), DeepEquals, map[string]float64{"co2": 500, "light": 10})
+	c.Assert(averageChannels(nil), IsNil)
+}
+
+func (s *TestSuite) TestChannelValues(c *C) {
+	moisture := 14.5
+	t := &tick{
+		Temperature: 20,
+		Humidity:    92,
+		Moisture:    &moisture,
+		Channels:    map[string]float64{"co2": 400},
+	}
+	values := t.channelValues()
+	c.Assert(values[channelTemperature], Equals, float64(20))
+	c.Assert(values[channelMoistureRaw], Equals, float64(92))
+	c.Assert(values[channelMoisture], Equals, 14.5)
+	c.Assert(values["co2"], Equals, float64(400))
+}
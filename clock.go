@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Number of clock skew samples kept of each coordinator.
+const clockSkewHistoryLength = 10000
+
+// Drift of coordinator clocks is estimated from samples of this period.
+const clockDriftPeriod = 7 * 24 * time.Hour
+
+func keyOfCoordinatorClockSkew(coordinatorID string) string {
+	return "osp:controller:" + coordinatorID + ":clock_skew"
+}
+
+// A clock skew sample compares the time a coordinator gave to its upload
+// with the server time when the upload arrived. Offset is what the
+// coordinator has to add to its clock.
+type clockSkew struct {
+	ServerTime      time.Time `json:"server_time"`
+	CoordinatorTime time.Time `json:"coordinator_time"`
+	Offset          float64   `json:"offset"` // sec
+}
+
+// Clock skew samples of a coordinator. Drift tells how fast its clock
+// falls behind (positive) or runs ahead (negative) of the server.
+type clockSkewHistory struct {
+	CoordinatorID string       `json:"coordinator_id"`
+	Latest        *clockSkew   `json:"latest,omitempty"`
+	Drift         *float64     `json:"drift,omitempty"` // sec per day
+	Samples       []*clockSkew `json:"samples,omitempty"`
+}
+
+func recordClockSkew(coordinatorID string, coordinatorTime, serverTime time.Time) (*clockSkew, error) {
+	skew := &clockSkew{
+		ServerTime:      serverTime,
+		CoordinatorTime: coordinatorTime,
+		Offset:          serverTime.Sub(coordinatorTime).Seconds(),
+	}
+	b, err := json.Marshal(skew)
+	if err != nil {
+		return nil, err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	key := keyOfCoordinatorClockSkew(coordinatorID)
+	if _, err := redisClient.Do("ZADD", key, serverTime.Unix(), b); err != nil {
+		return nil, err
+	}
+	if _, err := redisClient.Do("ZREMRANGEBYRANK", key, 0, -clockSkewHistoryLength-1); err != nil {
+		return nil, err
+	}
+	return skew, nil
+}
+
+func clockSkewsUsingCommand(command, coordinatorID string, start, end interface{}) ([]*clockSkew, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do(command, keyOfCoordinatorClockSkew(coordinatorID), start, end))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*clockSkew, 0)
+	for _, value := range bb {
+		var skew clockSkew
+		if err := json.Unmarshal(value.([]byte), &skew); err != nil {
+			return nil, err
+		}
+		result = append(result, &skew)
+	}
+	return result, nil
+}
+
+// clockDrift estimates the rate of change of the offset by least squares,
+// nil when there are not enough samples.
+func clockDrift(samples []*clockSkew) *float64 {
+	if len(samples) < 2 {
+		return nil
+	}
+	origin := samples[0].ServerTime
+	var sumX, sumY, sumXX, sumXY float64
+	for _, skew := range samples {
+		x := skew.ServerTime.Sub(origin).Hours() / 24
+		sumX += x
+		sumY += skew.Offset
+		sumXX += x * x
+		sumXY += x * skew.Offset
+	}
+	n := float64(len(samples))
+	d := n*sumXX - sumX*sumX
+	if math.Abs(d) < 1e-12 {
+		return nil
+	}
+	drift := (n*sumXY - sumX*sumY) / d
+	return &drift
+}
+
+// clockSkewHistoryOf returns clock skew samples of the coordinator in the
+// time range, in unix seconds. Drift is estimated from the samples.
+func clockSkewHistoryOf(coordinatorID string, start, end int) (*clockSkewHistory, error) {
+	samples, err := clockSkewsUsingCommand("ZRANGEBYSCORE", coordinatorID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	h := &clockSkewHistory{CoordinatorID: coordinatorID, Samples: samples, Drift: clockDrift(samples)}
+	if len(samples) > 0 {
+		h.Latest = samples[len(samples)-1]
+	}
+	return h, nil
+}
+
+// coordinatorClockSkews returns the latest clock skew and recent drift of
+// all coordinators that have sent timestamps, the worst first.
+func coordinatorClockSkews() ([]*clockSkewHistory, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	ids, err := redis.Strings(redisClient.Do("SMEMBERS", keyCoordinators))
+	if err != nil {
+		return nil, err
+	}
+
+	since := time.Now().Add(-clockDriftPeriod).Unix()
+	result := make([]*clockSkewHistory, 0)
+	for _, coordinatorID := range ids {
+		latest, err := clockSkewsUsingCommand("ZREVRANGE", coordinatorID, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(latest) == 0 {
+			continue
+		}
+		recent, err := clockSkewsUsingCommand("ZRANGEBYSCORE", coordinatorID, since, "+inf")
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &clockSkewHistory{
+			CoordinatorID: coordinatorID,
+			Latest:        latest[0],
+			Drift:         clockDrift(recent),
+		})
+	}
+	sort.Sort(byClockOffset(result))
+	return result, nil
+}
+
+type byClockOffset []*clockSkewHistory
+
+func (a byClockOffset) Len() int      { return len(a) }
+func (a byClockOffset) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byClockOffset) Less(i, j int) bool {
+	return math.Abs(a[i].Latest.Offset) > math.Abs(a[j].Latest.Offset)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestClockDrift(c *C) {
+	start := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+	var samples []*clockSkew
+	c.Assert(clockDrift(samples), IsNil)
+	for day := 0; day < 5; day++ {
+		samples = append(samples, &clockSkew{ServerTime: start.AddDate(0, 0, day), Offset: 10 + 2.5*float64(day)})
+	}
+	c.Assert(*clockDrift(samples), Equals, 2.5)
+	c.Assert(clockDrift(samples[:1]), IsNil)
+}
+
+func (s *TestSuite) TestClockSkewInUploadResponse(c *C) {
+	_, err := claimCoordinator("45", "")
+	c.Assert(err, IsNil)
+
+	createdAt := time.Now().Add(-90 * time.Second)
+	b, err := json.Marshal(&payload{Coordinator: coordinatorReading{CoordinatorID: 45, CreatedAt: &createdAt}})
+	c.Assert(err, IsNil)
+	u, err := handleJSONUpload(bytes.NewBuffer(b), nil)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(u.response.ServerTime) < time.Minute, Equals, true)
+	c.Assert(*u.response.ClockOffset > 89 && *u.response.ClockOffset < 91, Equals, true)
+
+	b, err = json.Marshal(&payload{Coordinator: coordinatorReading{CoordinatorID: 45}})
+	c.Assert(err, IsNil)
+	u, err = handleJSONUpload(bytes.NewBuffer(b), nil)
+	c.Assert(err, IsNil)
+	c.Assert(u.response.ClockOffset, IsNil)
+
+	h, err := clockSkewHistoryOf("45", 0, int(time.Now().Unix()))
+	c.Assert(err, IsNil)
+	c.Assert(len(h.Samples), Equals, 1)
+	c.Assert(h.Latest.CoordinatorTime.Equal(createdAt), Equals, true)
+
+	all, err := coordinatorClockSkews()
+	c.Assert(err, IsNil)
+	found := false
+	for _, h := range all {
+		found = found || h.CoordinatorID == "45"
+	}
+	c.Assert(found, Equals, true)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// runCommand runs a command given on command line instead of starting
+// the server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "import":
+		return importCommand(args[1:])
+	case "index_locations":
+		return indexLocationsCommand(args[1:])
+	case "cleanup_memberships":
+		return cleanupMembershipsCommand(args[1:])
+	case "labels":
+		return labelsCommand(args[1:])
+	case "replay":
+		return replayCommand(args[1:])
+	case "dead_letters":
+		return deadLettersCommand(args[1:])
+	}
+	return fmt.Errorf("Unknown command %s", args[0])
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file := fs.String("file", "", "CSV or NDJSON file to import, stdin if empty")
+	opts := &importOptions{}
+	fs.StringVar(&opts.format, "format", exportFormatCSV, "csv or ndjson")
+	fs.StringVar(&opts.sensorID, "sensor_id", "", "Sensor ID of rows that have no sensor_id column")
+	fs.StringVar(&opts.timeColumn, "time_column", "time", "Name of the time column, values in RFC3339 or unix seconds")
+	columns := fs.String("columns", "", "Column mappings, column=sensor:channel or column=channel, separated by commas")
+	fs.BoolVar(&opts.raw, "raw", false, "Values are raw readings to be converted using sensor profiles")
+	fs.BoolVar(&opts.dryRun, "dry_run", false, "Validate only, don't save anything")
+	fs.BoolVar(&opts.skipInvalid, "skip_invalid", false, "Import valid rows even if some rows are invalid")
+	fs.Parse(args)
+
+	var err error
+	opts.columns, err = parseColumnMappings(*columns)
+	if err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if len(*file) > 0 {
+		in, err = os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	report, err := importTicks(in, opts)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	if report.Invalid > 0 && !opts.skipInvalid && !opts.dryRun {
+		return fmt.Errorf("Nothing imported, %d invalid rows", report.Invalid)
+	}
+	return nil
+}
+
+func indexLocationsCommand(args []string) error {
+	fs := flag.NewFlagSet("index_locations", flag.ExitOnError)
+	fs.Parse(args)
+
+	n, err := reindexSensorLocations()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Indexed locations of %d sensors\n", n)
+	return nil
+}
+
+func cleanupMembershipsCommand(args []string) error {
+	fs := flag.NewFlagSet("cleanup_memberships", flag.ExitOnError)
+	fs.Parse(args)
+
+	n, err := cleanupMemberships()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d stale sensor memberships\n", n)
+	return nil
+}
+
+// labelsCommand prints QR code labels of a series of sensors and registers
+// the sensor IDs, so that the sensors can be installed by scanning a label.
+func labelsCommand(args []string) error {
+	fs := flag.NewFlagSet("labels", flag.ExitOnError)
+	opts := &labelOptions{}
+	fs.StringVar(&opts.series, "series", "1A", "Series of sensor IDs")
+	fs.IntVar(&opts.start, "start", 1, "First number of the series")
+	fs.IntVar(&opts.end, "end", 100, "Last number of the series")
+	fs.StringVar(&opts.payload, "payload", defaultLabelPayload, "Format of QR code content, %s is the sensor ID")
+	fs.StringVar(&opts.format, "format", labelFormatPNG, "png or svg")
+	fs.StringVar(&opts.output, "output", "qrcodes", "Directory of label sheets")
+	fs.IntVar(&opts.labelSize, "label_size", 200, "Width and height of a label in pixels")
+	fs.IntVar(&opts.columns, "columns", 4, "Labels per row of a sheet")
+	fs.IntVar(&opts.rows, "rows", 6, "Rows of labels per sheet")
+	level := fs.String("level", "H", "QR error correction level, L, M, Q or H")
+	register := fs.Bool("register", true, "Register the sensor IDs for provisioning")
+	fs.Parse(args)
+
+	var err error
+	opts.level, err = parseQRLevel(*level)
+	if err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	labels, err := makeLabels(opts)
+	if err != nil {
+		return err
+	}
+	filenames, err := writeLabelSheets(labels, opts)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		fmt.Println(filename)
+	}
+
+	if !*register {
+		return nil
+	}
+	provisioned, err := provisionSeries(opts.series, opts.start, opts.end, opts.payload)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Registered %d new sensor IDs for provisioning\n", len(provisioned))
+	return nil
+}
+
+// replayCommand reprocesses archived uploads of a coordinator and prints
+// how the readings differ from the stored ones.
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	opts := &replayOptions{}
+	fs.StringVar(&opts.coordinatorID, "coordinator_id", "", "Coordinator whose uploads are replayed")
+	start := fs.String("start", "", "Replay uploads received since, RFC3339 or unix seconds")
+	end := fs.String("end", "", "Replay uploads received until, RFC3339 or unix seconds")
+	fs.BoolVar(&opts.write, "write", false, "Replace stored readings, otherwise only show differences")
+	fs.Parse(args)
+
+	if len(opts.coordinatorID) == 0 {
+		return errors.New("Missing -coordinator_id")
+	}
+	if len(*start) > 0 {
+		t, err := parseImportTime(*start)
+		if err != nil {
+			return err
+		}
+		opts.start = t.Unix()
+	}
+	if len(*end) > 0 {
+		t, err := parseImportTime(*end)
+		if err != nil {
+			return err
+		}
+		opts.end = t.Unix()
+	}
+
+	report, err := replayUploads(opts)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// deadLettersCommand lists, shows, edits, requeues or deletes failed
+// uploads.
+func deadLettersCommand(args []string) error {
+	fs := flag.NewFlagSet("dead_letters", flag.ExitOnError)
+	coordinatorID := fs.String("coordinator_id", "", "List dead letters of the coordinator")
+	stage := fs.String("stage", "", "List dead letters that failed at the stage")
+	file := fs.String("file", "", "File with the fixed upload to edit, stdin if empty")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dead_letters list|show ID|edit ID|requeue ID|delete ID [flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("Missing dead letter action")
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	var result interface{}
+	var err error
+	if action == "list" {
+		result, err = deadLetters(*coordinatorID, *stage)
+	} else {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return fmt.Errorf("%s needs dead letter ID", action)
+		}
+		id := fs.Arg(0)
+		switch action {
+		case "show":
+			result, err = loadDeadLetter(id)
+		case "edit":
+			in := os.Stdin
+			if len(*file) > 0 {
+				in, err = os.Open(*file)
+				if err != nil {
+					return err
+				}
+				defer in.Close()
+			}
+			var body []byte
+			body, err = ioutil.ReadAll(in)
+			if err != nil {
+				return err
+			}
+			result, err = editDeadLetter(id, body)
+		case "requeue":
+			result, err = requeueDeadLetter(id)
+		case "delete":
+			if err := deleteDeadLetter(id); err != nil {
+				return err
+			}
+			fmt.Println("Deleted dead letter", id)
+			return nil
+		default:
+			fs.Usage()
+			return fmt.Errorf("Unknown dead letter action %s", action)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
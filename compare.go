@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const maxComparedSensors = 200
+const maxComparisonBuckets = 5000
+
+// A comparisonError tells that sensors cannot be compared as requested.
+type comparisonError string
+
+func (e comparisonError) Error() string {
+	return string(e)
+}
+
+// A comparison holds series of several sensors aligned to the same
+// buckets. Dots of buckets without ticks are null.
+type comparison struct {
+	Start  time.Time           `json:"start"`
+	End    time.Time           `json:"end"`
+	Bucket int64               `json:"bucket"` // seconds
+	Times  []time.Time         `json:"times"`
+	Series []*comparisonSeries `json:"series"`
+}
+
+type comparisonSeries struct {
+	SensorID string  `json:"sensor_id"`
+	Label    string  `json:"label"`
+	Dots     []*tick `json:"dots"`
+}
+
+func bucketTimes(start, end time.Time, bucket time.Duration) []time.Time {
+	var result []time.Time
+	for t := start; t.Before(end); t = t.Add(bucket) {
+		result = append(result, t)
+	}
+	return result
+}
+
+// alignTicks averages ticks into the buckets starting at given times.
+// Ticks must be in chronological order.
+func alignTicks(ticks []*tick, times []time.Time, bucket time.Duration) []*tick {
+	result := make([]*tick, len(times))
+	i := 0
+	for n, start := range times {
+		end := start.Add(bucket)
+		for i < len(ticks) && ticks[i].Datetime.Before(start) {
+			i++
+		}
+		first := i
+		for i < len(ticks) && ticks[i].Datetime.Before(end) {
+			i++
+		}
+		if i > first {
+			avg := averageMatching(ticks[first:i], start, end)
+			result[n] = &avg
+		}
+	}
+	return result
+}
+
+// compareSensors compares the sensors in given time range. When coordinator
+// ID is given, only ticks from the periods the sensors belonged to the
+// coordinator are compared.
+func compareSensors(sensorIDs []string, coordinatorID string, start, end int, bucket time.Duration) (*comparison, error) {
+	if len(sensorIDs) > maxComparedSensors {
+		return nil, comparisonError(fmt.Sprintf("Cannot compare more than %d sensors", maxComparedSensors))
+	}
+	startTime := time.Unix(int64(start), 0)
+	endTime := time.Unix(int64(end), 0)
+	if endTime.Sub(startTime)/bucket > maxComparisonBuckets {
+		return nil, comparisonError("Too many buckets, use a longer bucket or a shorter time range")
+	}
+
+	c := &comparison{
+		Start:  startTime,
+		End:    endTime,
+		Bucket: int64(bucket / time.Second),
+		Times:  bucketTimes(startTime, endTime, bucket),
+	}
+	var ranges map[string][]timeRange
+	if len(coordinatorID) > 0 {
+		var err error
+		ranges, err = coordinatorRanges(sensorIDs, coordinatorID, start, end)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, sensorID := range sensorIDs {
+		s, err := loadSensor("", sensorID)
+		if err != nil {
+			return nil, err
+		}
+		ticks, err := findTicksByScore(sensorID, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if ranges != nil {
+			ticks = ticksInRanges(ticks, ranges[sensorID])
+		}
+		if err := setMoisture(sensorID, ticks); err != nil {
+			return nil, err
+		}
+		c.Series = append(c.Series, &comparisonSeries{
+			SensorID: sensorID,
+			Label:    s.Label,
+			Dots:     alignTicks(ticks, c.Times, bucket),
+		})
+	}
+	return c, nil
+}
+
+func ticksInRanges(ticks []*tick, ranges []timeRange) []*tick {
+	var result []*tick
+	for _, t := range ticks {
+		for _, tr := range ranges {
+			if seconds := int(t.Datetime.Unix()); seconds >= tr.start && seconds <= tr.end {
+				result = append(result, t)
+				break
+			}
+		}
+	}
+	return result
+}
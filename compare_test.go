@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestBucketTimes(c *C) {
+	start := time.Date(2014, 11, 1, 0, 0, 0, 0, time.UTC)
+	times := bucketTimes(start, start.Add(150*time.Minute), time.Hour)
+	c.Assert(len(times), Equals, 3)
+	c.Assert(times[2], Equals, start.Add(2*time.Hour))
+}
+
+func (s *TestSuite) TestAlignTicks(c *C) {
+	start := time.Date(2014, 11, 1, 0, 0, 0, 0, time.UTC)
+	times := bucketTimes(start, start.Add(3*time.Hour), time.Hour)
+	ticks := []*tick{
+		{Datetime: start.Add(10 * time.Minute), Temperature: 10},
+		{Datetime: start.Add(20 * time.Minute), Temperature: 20},
+		{Datetime: start.Add(2*time.Hour + time.Minute), Temperature: 5},
+	}
+	dots := alignTicks(ticks, times, time.Hour)
+	c.Assert(len(dots), Equals, 3)
+	c.Assert(dots[0].Temperature, Equals, float64(15))
+	c.Assert(dots[0].Datetime, Equals, start)
+	c.Assert(dots[1], IsNil)
+	c.Assert(dots[2].Temperature, Equals, float64(5))
+}
+
+func (s *TestSuite) TestCompareTooManyBuckets(c *C) {
+	_, err := compareSensors([]string{"13A20040B421AC"}, "", 0, 86400*365, time.Second)
+	c.Assert(isValidationError(err), Equals, true)
+}
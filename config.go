@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Limits of the report interval of a coordinator, in seconds.
+const (
+	minReportInterval = 60
+	maxReportInterval = 24 * 60 * 60
+)
+
+// Max number of sensors a coordinator can be told to listen to.
+const maxSensorWhitelist = 255
+
+// Desired and reported configuration of a coordinator, as JSON in fields
+// "desired" and "reported".
+func keyOfCoordinatorConfig(coordinatorID string) string {
+	return "osp:controller:" + coordinatorID + ":config"
+}
+
+// Configuration of a coordinator that can be changed remotely. Settings
+// that are left empty are not managed by the server.
+type coordinatorConfig struct {
+	ReportInterval  int64    `json:"report_interval,omitempty"` // sec
+	SensorWhitelist []string `json:"sensor_whitelist,omitempty"`
+	ServerAddress   string   `json:"server_address,omitempty"` // host:port
+}
+
+type coordinatorConfigState struct {
+	Config    coordinatorConfig `json:"config"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// The configuration the server wants a coordinator to have, and the one
+// the coordinator last reported it has. Pending holds the settings that
+// have not been applied yet, and is sent to the coordinator when it
+// uploads.
+type coordinatorConfigStatus struct {
+	Desired  *coordinatorConfigState `json:"desired"`
+	Reported *coordinatorConfigState `json:"reported"`
+	Pending  *coordinatorConfig      `json:"pending,omitempty"`
+	Applied  bool                    `json:"applied"`
+}
+
+type configError string
+
+func (e configError) Error() string {
+	return string(e)
+}
+
+func (cfg *coordinatorConfig) validate() error {
+	if cfg.ReportInterval != 0 && (cfg.ReportInterval < minReportInterval || cfg.ReportInterval > maxReportInterval) {
+		return configError(fmt.Sprintf("Report interval must be between %d and %d seconds", minReportInterval, maxReportInterval))
+	}
+	cfg.SensorWhitelist = uniqueSorted(cfg.SensorWhitelist)
+	if len(cfg.SensorWhitelist) > maxSensorWhitelist {
+		return configError(fmt.Sprintf("Sensor whitelist cannot have more than %d sensors", maxSensorWhitelist))
+	}
+	if len(cfg.ServerAddress) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.ServerAddress); err != nil {
+			return configError("Invalid server address: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// pendingChanges returns the desired settings that differ from the
+// reported configuration, or nil when all have been applied.
+func (cfg *coordinatorConfig) pendingChanges(reported *coordinatorConfig) *coordinatorConfig {
+	if reported == nil {
+		reported = &coordinatorConfig{}
+	}
+	pending := &coordinatorConfig{}
+	changed := false
+	if cfg.ReportInterval != 0 && cfg.ReportInterval != reported.ReportInterval {
+		pending.ReportInterval = cfg.ReportInterval
+		changed = true
+	}
+	if len(cfg.SensorWhitelist) > 0 && !reflect.DeepEqual(cfg.SensorWhitelist, uniqueSorted(reported.SensorWhitelist)) {
+		pending.SensorWhitelist = cfg.SensorWhitelist
+		changed = true
+	}
+	if len(cfg.ServerAddress) > 0 && cfg.ServerAddress != reported.ServerAddress {
+		pending.ServerAddress = cfg.ServerAddress
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return pending
+}
+
+func saveCoordinatorConfigState(coordinatorID, field string, cfg *coordinatorConfig) error {
+	b, err := json.Marshal(&coordinatorConfigState{Config: *cfg, UpdatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keyOfCoordinatorConfig(coordinatorID), field, b)
+	return err
+}
+
+// setDesiredConfig replaces the desired configuration of a coordinator.
+func setDesiredConfig(coordinatorID string, cfg *coordinatorConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	exists, err := coordinatorExists(coordinatorID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return unknownCoordinatorError(coordinatorID)
+	}
+	return saveCoordinatorConfigState(coordinatorID, "desired", cfg)
+}
+
+// recordReportedConfig stores the configuration a coordinator reported in
+// its upload.
+func recordReportedConfig(coordinatorID string, cfg *coordinatorConfig) error {
+	return saveCoordinatorConfigState(coordinatorID, "reported", cfg)
+}
+
+func coordinatorConfigStatusOf(coordinatorID string) (*coordinatorConfigStatus, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HMGET", keyOfCoordinatorConfig(coordinatorID), "desired", "reported"))
+	if err != nil {
+		return nil, err
+	}
+	status := &coordinatorConfigStatus{}
+	for i, state := range []**coordinatorConfigState{&status.Desired, &status.Reported} {
+		if bb[i] == nil {
+			continue
+		}
+		*state = &coordinatorConfigState{}
+		if err := json.Unmarshal(bb[i].([]byte), *state); err != nil {
+			return nil, err
+		}
+	}
+
+	if status.Desired != nil {
+		var reported *coordinatorConfig
+		if status.Reported != nil {
+			reported = &status.Reported.Config
+		}
+		status.Pending = status.Desired.Config.pendingChanges(reported)
+	}
+	status.Applied = status.Pending == nil
+	return status, nil
+}
+
+// pendingConfigOfUpload records the configuration reported in an upload,
+// if any, and returns the settings the coordinator should still change.
+func pendingConfigOfUpload(cr *coordinatorReading) (*coordinatorConfig, error) {
+	coordinatorID := fmt.Sprintf("%d", cr.CoordinatorID)
+	if cr.Config != nil {
+		if err := recordReportedConfig(coordinatorID, cr.Config); err != nil {
+			return nil, err
+		}
+	}
+	status, err := coordinatorConfigStatusOf(coordinatorID)
+	if err != nil {
+		return nil, err
+	}
+	return status.Pending, nil
+}
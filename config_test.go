@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestCoordinatorConfigValidate(c *C) {
+	c.Assert((&coordinatorConfig{ReportInterval: 10}).validate(), FitsTypeOf, configError(""))
+	c.Assert((&coordinatorConfig{ServerAddress: "example.com"}).validate(), FitsTypeOf, configError(""))
+	cfg := &coordinatorConfig{ReportInterval: 600, SensorWhitelist: []string{"b", "a", "b"}, ServerAddress: "example.com:18150"}
+	c.Assert(cfg.validate(), IsNil)
+	c.Assert(cfg.SensorWhitelist, DeepEquals, []string{"a", "b"})
+}
+
+func (s *TestSuite) TestPendingChanges(c *C) {
+	desired := &coordinatorConfig{ReportInterval: 600, SensorWhitelist: []string{"a", "b"}}
+	c.Assert(*desired.pendingChanges(nil), DeepEquals, *desired)
+
+	reported := &coordinatorConfig{ReportInterval: 300, SensorWhitelist: []string{"b", "a"}, ServerAddress: "x:1"}
+	c.Assert(*desired.pendingChanges(reported), DeepEquals, coordinatorConfig{ReportInterval: 600})
+
+	reported.ReportInterval = 600
+	c.Assert(desired.pendingChanges(reported), IsNil)
+}
+
+func (s *TestSuite) TestConfigInUploadResponse(c *C) {
+	err := setDesiredConfig("43", &coordinatorConfig{ReportInterval: 600})
+	c.Assert(err, FitsTypeOf, unknownCoordinatorError(""))
+
+	_, err = claimCoordinator("43", "")
+	c.Assert(err, IsNil)
+	c.Assert(setDesiredConfig("43", &coordinatorConfig{ReportInterval: 600, ServerAddress: "example.com:18150"}), IsNil)
+
+	status, err := coordinatorConfigStatusOf("43")
+	c.Assert(err, IsNil)
+	c.Assert(status.Applied, Equals, false)
+	c.Assert(status.Reported, IsNil)
+
+	upload := func(cfg *coordinatorConfig) *uploadResponse {
+		b, err := json.Marshal(&payload{Coordinator: coordinatorReading{CoordinatorID: 43, Config: cfg}})
+		c.Assert(err, IsNil)
+		u, err := handleJSONUpload(bytes.NewBuffer(b), nil)
+		c.Assert(err, IsNil)
+		return u.response
+	}
+
+	response := upload(&coordinatorConfig{ReportInterval: 300, ServerAddress: "example.com:18150"})
+	c.Assert(response.Config, NotNil)
+	c.Assert(*response.Config, DeepEquals, coordinatorConfig{ReportInterval: 600})
+
+	// changes are sent until the coordinator reports them applied
+	response = upload(nil)
+	c.Assert(response.Config, NotNil)
+
+	response = upload(&coordinatorConfig{ReportInterval: 600, ServerAddress: "example.com:18150"})
+	c.Assert(response.Config, IsNil)
+
+	status, err = coordinatorConfigStatusOf("43")
+	c.Assert(err, IsNil)
+	c.Assert(status.Applied, Equals, true)
+	c.Assert(status.Reported.Config.ReportInterval, Equals, int64(600))
+}
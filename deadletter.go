@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Uploads that could not be processed, by ID, until they are requeued or
+// deleted.
+const keyDeadLetters = "osp:dead_letters"
+
+// Max number of dead letters kept, failed uploads are dropped when full.
+const maxDeadLetters = 10000
+
+// A dead letter being requeued is locked this long at most, in case the
+// server stops while processing it.
+const requeueLockSeconds = 300
+
+func keyOfDeadLetterRequeue(id string) string {
+	return "osp:dead_letter:" + id + ":requeue"
+}
+
+// Stages of processing an upload, to tell where a failed upload failed.
+const (
+	uploadStageParse              = "parse"
+	uploadStagePending            = "pending"
+	uploadStageClockSkew          = "clock_skew"
+	uploadStageCoordinatorReading = "coordinator_reading"
+	uploadStageConversion         = "conversion"
+	uploadStageTicks              = "ticks"
+)
+
+// Where an upload came from. Port is the TCP port of the upload listener,
+// zero for uploads over HTTP.
+type uploadSource struct {
+	RemoteAddr  string    `json:"remote_addr"`
+	Port        int       `json:"port,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Requeues    int       `json:"requeues,omitempty"` // times the upload has been requeued
+}
+
+// A deadLetter is an upload that failed to be processed, with the error,
+// the stage it failed at and where it came from. The body can be edited
+// before the upload is requeued.
+type deadLetter struct {
+	ID            string        `json:"id"`
+	CoordinatorID string        `json:"coordinator_id,omitempty"`
+	Stage         string        `json:"stage"`
+	Error         string        `json:"error"`
+	Body          string        `json:"body"`
+	ReceivedAt    time.Time     `json:"received_at"`
+	Source        *uploadSource `json:"source,omitempty"`
+	EditedAt      *time.Time    `json:"edited_at,omitempty"`
+}
+
+// The result of requeueing a dead letter. When the upload fails again, the
+// dead letter is kept with the new error.
+type requeueResult struct {
+	Response   *uploadResponse `json:"response,omitempty"`
+	DeadLetter *deadLetter     `json:"dead_letter,omitempty"`
+}
+
+type requeueError string
+
+func (e requeueError) Error() string {
+	return string(e)
+}
+
+type unknownDeadLetterError string
+
+func (e unknownDeadLetterError) Error() string {
+	return fmt.Sprintf("Unknown dead letter %s", string(e))
+}
+
+func (dl *deadLetter) save() error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keyDeadLetters, dl.ID, b)
+	return err
+}
+
+// saveDeadLetter stores an upload that failed at the stage.
+func saveDeadLetter(body []byte, receivedAt time.Time, src *uploadSource, stage string, cause error) (*deadLetter, error) {
+	redisClient := redisPool.Get()
+	n, err := redis.Int(redisClient.Do("HLEN", keyDeadLetters))
+	redisClient.Close()
+	if err != nil {
+		return nil, err
+	}
+	if n >= maxDeadLetters {
+		return nil, fmt.Errorf("Dead letters are full, dropping upload that failed at %s: %v", stage, cause)
+	}
+
+	dl := &deadLetter{
+		ID:            fmt.Sprintf("%d", receivedAt.UnixNano()),
+		CoordinatorID: coordinatorIDOfUpload(body),
+		Stage:         stage,
+		Error:         cause.Error(),
+		Body:          string(body),
+		ReceivedAt:    receivedAt,
+		Source:        src,
+	}
+	if err := dl.save(); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+func loadDeadLetter(id string) (*deadLetter, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyDeadLetters, id))
+	if err == redis.ErrNil {
+		return nil, unknownDeadLetterError(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dl deadLetter
+	if err := json.Unmarshal(b, &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// deadLetters lists dead letters, latest first. Coordinator ID and stage
+// filter the list when given.
+func deadLetters(coordinatorID, stage string) ([]*deadLetter, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyDeadLetters))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*deadLetter, 0)
+	for _, value := range bb {
+		var dl deadLetter
+		if err := json.Unmarshal(value.([]byte), &dl); err != nil {
+			return nil, err
+		}
+		if len(coordinatorID) > 0 && dl.CoordinatorID != coordinatorID {
+			continue
+		}
+		if len(stage) > 0 && dl.Stage != stage {
+			continue
+		}
+		result = append(result, &dl)
+	}
+	sort.Sort(byDeadLetterReceivedAt(result))
+	return result, nil
+}
+
+type byDeadLetterReceivedAt []*deadLetter
+
+func (a byDeadLetterReceivedAt) Len() int      { return len(a) }
+func (a byDeadLetterReceivedAt) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDeadLetterReceivedAt) Less(i, j int) bool {
+	return a[i].ReceivedAt.After(a[j].ReceivedAt)
+}
+
+// editDeadLetter replaces the body of a dead letter, to fix it before it's
+// requeued.
+func editDeadLetter(id string, body []byte) (*deadLetter, error) {
+	dl, err := loadDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	dl.Body = string(body)
+	dl.CoordinatorID = coordinatorIDOfUpload(body)
+	dl.EditedAt = &now
+	if err := dl.save(); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+func deleteDeadLetter(id string) error {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	n, err := redis.Int(redisClient.Do("HDEL", keyDeadLetters, id))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return unknownDeadLetterError(id)
+	}
+	return nil
+}
+
+// requeueDeadLetter processes the upload of a dead letter again, as it was
+// received then. The dead letter is deleted when the upload is processed,
+// and kept with the new error when it fails again.
+func requeueDeadLetter(id string) (*requeueResult, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	locked, err := redisClient.Do("SET", keyOfDeadLetterRequeue(id), time.Now().Unix(), "NX", "EX", requeueLockSeconds)
+	if err != nil {
+		return nil, err
+	}
+	if locked == nil {
+		return nil, requeueError(fmt.Sprintf("Dead letter %s is being requeued", id))
+	}
+	defer redisClient.Do("DEL", keyOfDeadLetterRequeue(id))
+
+	dl, err := loadDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	u, stage, err := processJSONUpload([]byte(dl.Body), dl.ReceivedAt, true)
+	if err == nil || len(stage) == 0 {
+		// the data was saved, even if the response could not be made
+		if err := deleteDeadLetter(id); err != nil {
+			return nil, err
+		}
+	}
+	if err == nil {
+		return &requeueResult{Response: u.response}, nil
+	}
+	if len(stage) == 0 {
+		if isValidationError(err) {
+			response := newUploadResponse()
+			response.Error = err.Error()
+			return &requeueResult{Response: response}, nil
+		}
+		return nil, err
+	}
+
+	if dl.Source == nil {
+		dl.Source = &uploadSource{}
+	}
+	dl.Source.Requeues++
+	dl.Stage = stage
+	dl.Error = err.Error()
+	if err := dl.save(); err != nil {
+		return nil, err
+	}
+	result := &requeueResult{DeadLetter: dl}
+	if isValidationError(err) {
+		result.Response = newUploadResponse()
+		result.Response.Error = err.Error()
+	}
+	return result, nil
+}
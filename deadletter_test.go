@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestDeadLetters(c *C) {
+	_, err := claimCoordinator("49", "")
+	c.Assert(err, IsNil)
+
+	src := &uploadSource{RemoteAddr: "192.0.2.1:40000", Port: 18150}
+	_, err = handleJSONUpload(bytes.NewBufferString(`{"coordinator": {"coordinator_id": 49, "gsm_cov`), src)
+	c.Assert(err, NotNil)
+
+	list, err := deadLetters("49", uploadStageParse)
+	c.Assert(err, IsNil)
+	c.Assert(len(list), Equals, 1)
+	dl := list[0]
+	c.Assert(dl.Error, Not(Equals), "")
+	c.Assert(dl.Source.RemoteAddr, Equals, "192.0.2.1:40000")
+
+	// requeued as is, it fails again and is kept
+	result, err := requeueDeadLetter(dl.ID)
+	c.Assert(err, IsNil)
+	c.Assert(result.DeadLetter, NotNil)
+	c.Assert(result.DeadLetter.ID, Equals, dl.ID)
+	c.Assert(result.DeadLetter.Source.Requeues, Equals, 1)
+	dl, err = loadDeadLetter(dl.ID)
+	c.Assert(err, IsNil)
+	c.Assert(dl.Source.Requeues, Equals, 1)
+
+	dl, err = editDeadLetter(dl.ID, []byte(`{"coordinator": {"coordinator_id": 49, "gsm_coverage": 5, "created_at": "2001-02-03T04:05:06Z"}}`))
+	c.Assert(err, IsNil)
+	c.Assert(dl.EditedAt, NotNil)
+
+	// processed as received then, clock skew of an old upload isn't recorded
+	result, err = requeueDeadLetter(dl.ID)
+	c.Assert(err, IsNil)
+	c.Assert(result.DeadLetter, IsNil)
+	c.Assert(result.Response, NotNil)
+	c.Assert(result.Response.ClockOffset, IsNil)
+	readings, err := coordinatorReadings(49, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(readings[0].GSMCoverage, Equals, int64(5))
+	c.Assert(readings[0].UploadID, Equals, uploadIDOf(dl.ReceivedAt))
+	_, err = loadDeadLetter(dl.ID)
+	c.Assert(err, FitsTypeOf, unknownDeadLetterError(""))
+
+	list, err = deadLetters("49", "")
+	c.Assert(err, IsNil)
+	c.Assert(len(list), Equals, 0)
+
+	_, err = handleJSONUpload(bytes.NewBufferString(`{"coordinator": {"coordinator_id": 49,`), nil)
+	c.Assert(err, NotNil)
+	list, err = deadLetters("49", "")
+	c.Assert(err, IsNil)
+	c.Assert(len(list), Equals, 1)
+	c.Assert(deleteDeadLetter(list[0].ID), IsNil)
+	c.Assert(deleteDeadLetter(list[0].ID), FitsTypeOf, unknownDeadLetterError(""))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const exportPageSize = 1000
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+type exportOptions struct {
+	sensorIDs []string
+	start     int
+	end       int
+	format    string
+	channels  []string // all channels of the sensors when empty
+	location  *time.Location
+	bucket    time.Duration // no aggregation when zero
+	// when set, ticks are exported only from the periods the sensors
+	// belonged to the coordinator
+	coordinatorID string
+}
+
+type exportRow struct {
+	SensorID   string             `json:"sensor_id"`
+	HardwareID string             `json:"hardware_id,omitempty"`
+	Time       string             `json:"time"`
+	Values     map[string]float64 `json:"values"`
+}
+
+type exportEncoder interface {
+	writeRow(row *exportRow) error
+	flush() error
+}
+
+type csvExportEncoder struct {
+	w        *csv.Writer
+	channels []string
+}
+
+func (enc *csvExportEncoder) writeRow(row *exportRow) error {
+	record := []string{row.SensorID, row.Time}
+	for _, name := range enc.channels {
+		value, ok := row.Values[name]
+		if !ok {
+			record = append(record, "")
+			continue
+		}
+		record = append(record, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return enc.w.Write(record)
+}
+
+func (enc *csvExportEncoder) flush() error {
+	enc.w.Flush()
+	return enc.w.Error()
+}
+
+type ndjsonExportEncoder struct {
+	enc *json.Encoder
+}
+
+func (enc *ndjsonExportEncoder) writeRow(row *exportRow) error {
+	return enc.enc.Encode(row)
+}
+
+func (enc *ndjsonExportEncoder) flush() error {
+	return nil
+}
+
+// exportTicks writes ticks of the sensors to w, page by page, so that
+// the whole history is never held in memory.
+func exportTicks(w io.Writer, opts *exportOptions) error {
+	channels := opts.channels
+	if len(channels) == 0 {
+		var err error
+		channels, err = exportChannels(opts.sensorIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	var enc exportEncoder
+	switch opts.format {
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(append([]string{"sensor_id", "time"}, channels...)); err != nil {
+			return err
+		}
+		enc = &csvExportEncoder{w: cw, channels: channels}
+	case exportFormatNDJSON:
+		enc = &ndjsonExportEncoder{enc: json.NewEncoder(w)}
+	default:
+		return fmt.Errorf("Unsupported export format %s", opts.format)
+	}
+
+	flush := func() error {
+		if err := enc.flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+
+	ranges := map[string][]timeRange{}
+	for _, sensorID := range opts.sensorIDs {
+		ranges[sensorID] = []timeRange{{start: opts.start, end: opts.end}}
+	}
+	if len(opts.coordinatorID) > 0 {
+		var err error
+		ranges, err = coordinatorRanges(opts.sensorIDs, opts.coordinatorID, opts.start, opts.end)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sensorID := range opts.sensorIDs {
+		b := &exportBucket{opts: opts, sensorID: sensorID, channels: channels, enc: enc}
+		for _, tr := range ranges[sensorID] {
+			for offset := 0; ; offset += exportPageSize {
+				page, err := findTicksByScorePage(sensorID, tr.start, tr.end, offset, exportPageSize)
+				if err != nil {
+					return err
+				}
+				if err := setMoisture(sensorID, page); err != nil {
+					return err
+				}
+				for _, t := range page {
+					if err := b.add(t); err != nil {
+						return err
+					}
+				}
+				if err := flush(); err != nil {
+					return err
+				}
+				if len(page) < exportPageSize {
+					break
+				}
+			}
+		}
+		if err := b.close(); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// exportBucket collects ticks of one aggregation bucket and writes their
+// average when a tick of the next bucket arrives. Without aggregation, the
+// ticks are written as they come.
+type exportBucket struct {
+	opts     *exportOptions
+	sensorID string
+	channels []string
+	enc      exportEncoder
+	start    time.Time
+	ticks    []*tick
+}
+
+func (b *exportBucket) add(t *tick) error {
+	if b.opts.bucket == 0 {
+		return b.write(t)
+	}
+	offset := t.Datetime.Sub(time.Unix(int64(b.opts.start), 0))
+	start := time.Unix(int64(b.opts.start), 0).Add(offset - offset%b.opts.bucket)
+	if len(b.ticks) > 0 && !start.Equal(b.start) {
+		if err := b.close(); err != nil {
+			return err
+		}
+	}
+	b.start = start
+	b.ticks = append(b.ticks, t)
+	return nil
+}
+
+func (b *exportBucket) close() error {
+	if len(b.ticks) == 0 {
+		return nil
+	}
+	avg := averageMatching(b.ticks, b.start, b.start.Add(b.opts.bucket))
+	b.ticks = nil
+	return b.write(&avg)
+}
+
+func (b *exportBucket) write(t *tick) error {
+	values := t.channelValues()
+	row := &exportRow{
+		SensorID:   b.sensorID,
+		HardwareID: t.HardwareID,
+		Time:       t.Datetime.In(b.opts.location).Format(time.RFC3339),
+		Values:     make(map[string]float64),
+	}
+	for _, name := range b.channels {
+		if value, ok := values[name]; ok {
+			row.Values[name] = value
+		}
+	}
+	return b.enc.writeRow(row)
+}
+
+// exportChannels returns names of all channels of the sensors.
+func exportChannels(sensorIDs []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var result []string
+	for _, sensorID := range sensorIDs {
+		channels, err := sensorChannels(sensorID)
+		if err != nil {
+			return nil, err
+		}
+		for _, ch := range channels {
+			if !seen[ch.Name] {
+				seen[ch.Name] = true
+				result = append(result, ch.Name)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestExportBucket(c *C) {
+	start := time.Date(2014, 11, 1, 0, 0, 0, 0, time.UTC)
+	buf := bytes.NewBuffer(nil)
+	cw := csv.NewWriter(buf)
+	channels := []string{channelTemperature, "co2"}
+	b := &exportBucket{
+		opts: &exportOptions{
+			start:    int(start.Unix()),
+			location: time.FixedZone("EET", 2*60*60),
+			bucket:   time.Hour,
+		},
+		sensorID: "1A001",
+		channels: channels,
+		enc:      &csvExportEncoder{w: cw, channels: channels},
+	}
+
+	ticks := []*tick{
+		{Datetime: start.Add(10 * time.Minute), Temperature: 10, Channels: map[string]float64{"co2": 400}},
+		{Datetime: start.Add(20 * time.Minute), Temperature: 20},
+		{Datetime: start.Add(3*time.Hour + time.Minute), Temperature: 5},
+	}
+	for _, t := range ticks {
+		c.Assert(b.add(t), IsNil)
+	}
+	c.Assert(b.close(), IsNil)
+	cw.Flush()
+
+	c.Assert(buf.String(), Equals, "1A001,2014-11-01T02:00:00+02:00,15,400\n"+
+		"1A001,2014-11-01T05:00:00+02:00,5,\n")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Firmware metadata by hardware revision and version, the firmware images
+// are stored separately.
+const keyFirmware = "osp:firmware"
+
+// Coordinators download firmware in chunks of this size, one chunk per
+// request over the upload connection.
+const firmwareChunkSize = 1024
+
+const maxFirmwareSize = 4 << 20
+
+func firmwareID(hardwareRevision, version string) string {
+	return hardwareRevision + "/" + version
+}
+
+func keyOfFirmwareImage(hardwareRevision, version string) string {
+	return "osp:firmware:" + firmwareID(hardwareRevision, version) + ":image"
+}
+
+// A firmware is an image built for a hardware revision of coordinators.
+// Checksum is SHA-256 of the image, hex encoded.
+type firmware struct {
+	HardwareRevision string    `json:"hardware_revision"`
+	Version          string    `json:"version"`
+	Checksum         string    `json:"checksum"`
+	Size             int       `json:"size"`
+	ChunkSize        int       `json:"chunk_size"`
+	Chunks           int       `json:"chunks"`
+	UploadedAt       time.Time `json:"uploaded_at"`
+}
+
+// A coordinator asks for a chunk of firmware by sending this instead of a
+// payload over the upload connection.
+type firmwareChunkRequest struct {
+	CoordinatorID    int64  `json:"coordinator_id"`
+	HardwareRevision string `json:"hardware_revision"`
+	Version          string `json:"version"`
+	Chunk            int    `json:"chunk"` // starts from 0
+}
+
+type firmwareChunk struct {
+	HardwareRevision string `json:"hardware_revision"`
+	Version          string `json:"version"`
+	Chunk            int    `json:"chunk"`
+	Chunks           int    `json:"chunks"`
+	Data             []byte `json:"data"` // base64
+	CRC32            uint32 `json:"crc32"`
+}
+
+type firmwareError string
+
+func (e firmwareError) Error() string {
+	return string(e)
+}
+
+type unknownFirmwareError string
+
+func (e unknownFirmwareError) Error() string {
+	return fmt.Sprintf("Unknown firmware %s", string(e))
+}
+
+func validFirmwareName(name string) bool {
+	return len(name) > 0 && !strings.ContainsAny(name, "/: ")
+}
+
+// saveFirmware stores a firmware image. Images cannot be replaced, a fixed
+// image needs a new version.
+func saveFirmware(hardwareRevision, version, checksum string, image []byte) (*firmware, error) {
+	if !validFirmwareName(hardwareRevision) || !validFirmwareName(version) {
+		return nil, firmwareError("Firmware needs hardware revision and version, without slashes, colons or spaces")
+	}
+	if len(image) == 0 {
+		return nil, firmwareError("Missing firmware image")
+	}
+	if len(image) > maxFirmwareSize {
+		return nil, firmwareError(fmt.Sprintf("Firmware image cannot be larger than %d bytes", maxFirmwareSize))
+	}
+	sum := sha256.Sum256(image)
+	f := &firmware{
+		HardwareRevision: hardwareRevision,
+		Version:          version,
+		Checksum:         hex.EncodeToString(sum[:]),
+		Size:             len(image),
+		ChunkSize:        firmwareChunkSize,
+		Chunks:           (len(image) + firmwareChunkSize - 1) / firmwareChunkSize,
+		UploadedAt:       time.Now(),
+	}
+	if len(checksum) > 0 && !strings.EqualFold(checksum, f.Checksum) {
+		return nil, firmwareError("Firmware checksum does not match, got " + f.Checksum)
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	added, err := redis.Bool(redisClient.Do("HSETNX", keyFirmware, firmwareID(hardwareRevision, version), b))
+	if err != nil {
+		return nil, err
+	}
+	if !added {
+		return nil, firmwareError(fmt.Sprintf("Firmware %s already exists", firmwareID(hardwareRevision, version)))
+	}
+	if _, err := redisClient.Do("SET", keyOfFirmwareImage(hardwareRevision, version), image); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func loadFirmware(hardwareRevision, version string) (*firmware, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyFirmware, firmwareID(hardwareRevision, version)))
+	if err == redis.ErrNil {
+		return nil, unknownFirmwareError(firmwareID(hardwareRevision, version))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f firmware
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func firmwares() ([]*firmware, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyFirmware))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*firmware, 0)
+	for _, value := range bb {
+		var f firmware
+		if err := json.Unmarshal(value.([]byte), &f); err != nil {
+			return nil, err
+		}
+		result = append(result, &f)
+	}
+	sort.Sort(byFirmwareID(result))
+	return result, nil
+}
+
+type byFirmwareID []*firmware
+
+func (a byFirmwareID) Len() int      { return len(a) }
+func (a byFirmwareID) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byFirmwareID) Less(i, j int) bool {
+	return firmwareID(a[i].HardwareRevision, a[i].Version) < firmwareID(a[j].HardwareRevision, a[j].Version)
+}
+
+// deleteFirmware deletes a firmware that no unfinished rollout uses.
+func deleteFirmware(hardwareRevision, version string) error {
+	if _, err := loadFirmware(hardwareRevision, version); err != nil {
+		return err
+	}
+	list, err := rollouts()
+	if err != nil {
+		return err
+	}
+	for _, ro := range list {
+		if ro.HardwareRevision == hardwareRevision && ro.Version == version && !ro.finished() {
+			return firmwareError(fmt.Sprintf("Firmware is used by rollout %s", ro.ID))
+		}
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	tx := multi(redisClient)
+	tx.send("HDEL", keyFirmware, firmwareID(hardwareRevision, version))
+	tx.send("DEL", keyOfFirmwareImage(hardwareRevision, version))
+	_, err = tx.exec()
+	return err
+}
+
+func (f *firmware) chunk(n int) (*firmwareChunk, error) {
+	if n < 0 || n >= f.Chunks {
+		return nil, firmwareError(fmt.Sprintf("Firmware has chunks 0-%d", f.Chunks-1))
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	start := n * f.ChunkSize
+	data, err := redis.Bytes(redisClient.Do("GETRANGE", keyOfFirmwareImage(f.HardwareRevision, f.Version), start, start+f.ChunkSize-1))
+	if err != nil {
+		return nil, err
+	}
+	return &firmwareChunk{
+		HardwareRevision: f.HardwareRevision,
+		Version:          f.Version,
+		Chunk:            n,
+		Chunks:           f.Chunks,
+		Data:             data,
+		CRC32:            crc32.ChecksumIEEE(data),
+	}, nil
+}
+
+// handleFirmwareChunkRequest returns the requested chunk to a known
+// coordinator and records the download progress of its rollout.
+func handleFirmwareChunkRequest(req *firmwareChunkRequest) (*upload, error) {
+	coordinatorID := fmt.Sprintf("%d", req.CoordinatorID)
+	exists, err := coordinatorExists(coordinatorID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, unknownCoordinatorError(coordinatorID)
+	}
+	f, err := loadFirmware(req.HardwareRevision, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := f.chunk(req.Chunk)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordFirmwareDownload(coordinatorID, f, req.Chunk); err != nil {
+		return nil, err
+	}
+	response := newUploadResponse()
+	response.FirmwareChunk = chunk
+	return &upload{response: response}, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestSaveFirmware(c *C) {
+	image := bytes.Repeat([]byte("0123456789"), 250)
+
+	_, err := saveFirmware("C1", "1.0", "00", image)
+	c.Assert(err, FitsTypeOf, firmwareError(""))
+	_, err = saveFirmware("C1", "1/0", "", image)
+	c.Assert(err, FitsTypeOf, firmwareError(""))
+
+	f, err := saveFirmware("C1", "1.0", "", image)
+	c.Assert(err, IsNil)
+	c.Assert(f.Size, Equals, 2500)
+	c.Assert(f.Chunks, Equals, 3)
+	c.Assert(len(f.Checksum), Equals, 64)
+
+	_, err = saveFirmware("C1", "1.0", "", image)
+	c.Assert(err, FitsTypeOf, firmwareError(""))
+
+	loaded, err := loadFirmware("C1", "1.0")
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Checksum, Equals, f.Checksum)
+	_, err = loadFirmware("C1", "2.0")
+	c.Assert(err, FitsTypeOf, unknownFirmwareError(""))
+
+	chunk, err := f.chunk(2)
+	c.Assert(err, IsNil)
+	c.Assert(chunk.Data, DeepEquals, image[2048:])
+	c.Assert(chunk.CRC32, Equals, crc32.ChecksumIEEE(image[2048:]))
+	_, err = f.chunk(3)
+	c.Assert(err, FitsTypeOf, firmwareError(""))
+
+	c.Assert(deleteFirmware("C1", "1.0"), IsNil)
+	_, err = loadFirmware("C1", "1.0")
+	c.Assert(err, FitsTypeOf, unknownFirmwareError(""))
+}
+
+func (s *TestSuite) TestFirmwareChunkRequest(c *C) {
+	image := bytes.Repeat([]byte{0xAB}, 1500)
+	_, err := saveFirmware("C2", "1.1", "", image)
+	c.Assert(err, IsNil)
+
+	request := func(coordinatorID int64, chunk int) (*uploadResponse, error) {
+		b, err := json.Marshal(&payload{FirmwareChunk: &firmwareChunkRequest{
+			CoordinatorID: coordinatorID, HardwareRevision: "C2", Version: "1.1", Chunk: chunk,
+		}})
+		c.Assert(err, IsNil)
+		u, err := handleJSONUpload(bytes.NewBuffer(b), nil)
+		if err != nil {
+			return nil, err
+		}
+		return u.response, nil
+	}
+
+	_, err = request(441, 0)
+	c.Assert(err, FitsTypeOf, unknownCoordinatorError(""))
+
+	_, err = claimCoordinator("441", "")
+	c.Assert(err, IsNil)
+	response, err := request(441, 1)
+	c.Assert(err, IsNil)
+	c.Assert(response.FirmwareChunk.Chunks, Equals, 2)
+	c.Assert(response.FirmwareChunk.Data, DeepEquals, image[1024:])
+
+	download, err := loadFirmwareDownload("441")
+	c.Assert(err, IsNil)
+	c.Assert(download.Chunk, Equals, 1)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Sensor locations are indexed by latitude. Queries read a latitude band
+// from the index and filter it by longitude or distance.
+const keySensorLocations = "osp:sensor_locations"
+
+const earthRadius = 6371000.0 // metres
+const metresPerDegree = earthRadius * math.Pi / 180
+
+type invalidLocationError string
+
+func (e invalidLocationError) Error() string {
+	return string(e)
+}
+
+// A located sensor is a sensor found by location, with its distance from
+// the searched point when searching by radius.
+type locatedSensor struct {
+	*sensor
+	Distance *float64 `json:"distance,omitempty"` // metres
+}
+
+type byDistance []*locatedSensor
+
+func (a byDistance) Len() int           { return len(a) }
+func (a byDistance) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDistance) Less(i, j int) bool { return *a[i].Distance < *a[j].Distance }
+
+// A bounding box in the order used by GeoJSON. When MinLng is greater than
+// MaxLng, the box crosses the antimeridian.
+type boundingBox struct {
+	MinLng, MinLat, MaxLng, MaxLat float64
+}
+
+type featureCollection struct {
+	Type     string     `json:"type"`
+	Features []*feature `json:"features"`
+}
+
+type feature struct {
+	Type       string             `json:"type"`
+	Geometry   *pointGeometry     `json:"geometry"`
+	Properties *featureProperties `json:"properties"`
+}
+
+type pointGeometry struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // longitude, latitude
+}
+
+type featureProperties struct {
+	SensorID      string             `json:"sensor_id"`
+	Label         string             `json:"label"`
+	CoordinatorID string             `json:"coordinator_id"`
+	Time          *time.Time         `json:"time,omitempty"`
+	Values        map[string]float64 `json:"values,omitempty"`
+}
+
+func validateLocation(lat, lng *float64) error {
+	if (lat == nil) != (lng == nil) {
+		return invalidLocationError("Both lat and lng must be given")
+	}
+	if lat == nil {
+		return nil
+	}
+	if math.IsNaN(*lat) || *lat < -90 || *lat > 90 {
+		return invalidLocationError("lat must be in range -90..90")
+	}
+	if math.IsNaN(*lng) || *lng < -180 || *lng > 180 {
+		return invalidLocationError("lng must be in range -180..180")
+	}
+	return nil
+}
+
+func parseBoundingBox(s string) (*boundingBox, error) {
+	list := parseList(s)
+	if len(list) != 4 {
+		return nil, invalidLocationError("bbox must be min_lng,min_lat,max_lng,max_lat")
+	}
+	var values [4]float64
+	for i, item := range list {
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, invalidLocationError("Invalid bbox value " + item)
+		}
+		values[i] = f
+	}
+	bb := &boundingBox{MinLng: values[0], MinLat: values[1], MaxLng: values[2], MaxLat: values[3]}
+	if err := validateLocation(&bb.MinLat, &bb.MinLng); err != nil {
+		return nil, err
+	}
+	if err := validateLocation(&bb.MaxLat, &bb.MaxLng); err != nil {
+		return nil, err
+	}
+	if bb.MinLat > bb.MaxLat {
+		return nil, invalidLocationError("bbox min_lat is greater than max_lat")
+	}
+	return bb, nil
+}
+
+func (bb *boundingBox) contains(lat, lng float64) bool {
+	if lat < bb.MinLat || lat > bb.MaxLat {
+		return false
+	}
+	if bb.MinLng <= bb.MaxLng {
+		return lng >= bb.MinLng && lng <= bb.MaxLng
+	}
+	return lng >= bb.MinLng || lng <= bb.MaxLng
+}
+
+// distance returns the great-circle distance between two points in metres.
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// setSensorLocation stores the location of the sensor and updates the
+// location index. Location is removed when lat and lng are nil.
+func setSensorLocation(redisClient redis.Conn, sensorID string, lat, lng *float64) error {
+	if err := validateLocation(lat, lng); err != nil {
+		return err
+	}
+	if lat == nil {
+		if _, err := redisClient.Do("HDEL", keyOfSensor(sensorID), "lat", "lng"); err != nil {
+			return err
+		}
+		_, err := redisClient.Do("ZREM", keySensorLocations, sensorID)
+		return err
+	}
+	if _, err := redisClient.Do("HMSET", keyOfSensor(sensorID),
+		"lat", strconv.FormatFloat(*lat, 'f', -1, 64),
+		"lng", strconv.FormatFloat(*lng, 'f', -1, 64)); err != nil {
+		return err
+	}
+	_, err := redisClient.Do("ZADD", keySensorLocations, *lat, sensorID)
+	return err
+}
+
+// parseLocation parses a stored location. Locations used to be free text,
+// callers treat invalid values as missing.
+func parseLocation(latValue, lngValue string) (*float64, *float64, error) {
+	lat, err := parseOptionalFloat(latValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	lng, err := parseOptionalFloat(lngValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateLocation(lat, lng); err != nil {
+		return nil, nil, err
+	}
+	return lat, lng, nil
+}
+
+// parseCoordinate parses a latitude or longitude given in JSON either as a
+// number or, like older clients send them, as a string. Null and empty
+// string mean missing.
+func parseCoordinate(name string, raw json.RawMessage) (*float64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return &f, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, invalidLocationError(fmt.Sprintf("Invalid %s", name))
+	}
+	value, err := parseOptionalFloat(s)
+	if err != nil {
+		return nil, invalidLocationError(fmt.Sprintf("Invalid %s %q", name, s))
+	}
+	return value, nil
+}
+
+// locatedSensorsInLatitudes loads sensors of the index in given range of
+// latitudes.
+func locatedSensorsInLatitudes(minLat, maxLat float64) ([]*sensor, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	ids, err := redis.Strings(redisClient.Do("ZRANGEBYSCORE", keySensorLocations, minLat, maxLat))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*sensor, 0)
+	for _, sensorID := range ids {
+		coordinatorID, err := findCoordinatorIDBySensorID(sensorID)
+		if err != nil {
+			return nil, err
+		}
+		s, err := loadSensor(coordinatorID, sensorID)
+		if err != nil {
+			return nil, err
+		}
+		if s.Lat == nil {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// sensorsNear returns sensors within radius metres of the point, nearest
+// first.
+func sensorsNear(lat, lng, radius float64) ([]*locatedSensor, error) {
+	if err := validateLocation(&lat, &lng); err != nil {
+		return nil, err
+	}
+	if radius <= 0 {
+		return nil, invalidLocationError("radius must be positive")
+	}
+	band := radius / metresPerDegree
+	sensors, err := locatedSensorsInLatitudes(lat-band, lat+band)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*locatedSensor, 0)
+	for _, s := range sensors {
+		d := distance(lat, lng, *s.Lat, *s.Lng)
+		if d <= radius {
+			result = append(result, &locatedSensor{sensor: s, Distance: &d})
+		}
+	}
+	sort.Sort(byDistance(result))
+	return result, nil
+}
+
+// sensorsWithin returns located sensors inside the bounding box, or all
+// located sensors when the box is nil.
+func sensorsWithin(bb *boundingBox) ([]*sensor, error) {
+	if bb == nil {
+		return locatedSensorsInLatitudes(-90, 90)
+	}
+	sensors, err := locatedSensorsInLatitudes(bb.MinLat, bb.MaxLat)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*sensor, 0)
+	for _, s := range sensors {
+		if bb.contains(*s.Lat, *s.Lng) {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// sensorFeatures builds a GeoJSON feature collection of the sensors with
+// their latest readings.
+func sensorFeatures(sensors []*sensor) (*featureCollection, error) {
+	fc := &featureCollection{Type: "FeatureCollection", Features: make([]*feature, 0)}
+	for _, s := range sensors {
+		props := &featureProperties{
+			SensorID:      s.ID,
+			Label:         s.Label,
+			CoordinatorID: s.ControllerID,
+		}
+		t, err := lastTickOfSensor(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			if err := setMoisture(s.ID, []*tick{t}); err != nil {
+				return nil, err
+			}
+			props.Time = &t.Datetime
+			props.Values = t.channelValues()
+		}
+		fc.Features = append(fc.Features, &feature{
+			Type: "Feature",
+			Geometry: &pointGeometry{
+				Type:        "Point",
+				Coordinates: [2]float64{*s.Lng, *s.Lat},
+			},
+			Properties: props,
+		})
+	}
+	return fc, nil
+}
+
+// reindexSensorLocations adds stored locations of all known sensors to the
+// location index. Locations saved before the index existed are indexed
+// this way.
+func reindexSensorLocations() (int, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	ids, err := redis.Strings(redisClient.Do("HKEYS", keySensorToController))
+	if err != nil {
+		return 0, err
+	}
+	indexed := 0
+	for _, sensorID := range ids {
+		list, err := redis.Strings(redisClient.Do("HMGET", keyOfSensor(sensorID), "lat", "lng"))
+		if err != nil {
+			return indexed, err
+		}
+		lat, lng, err := parseLocation(list[0], list[1])
+		if err != nil {
+			log.Println("Ignoring invalid location of sensor", sensorID, list[0], list[1], err)
+			continue
+		}
+		if lat == nil {
+			continue
+		}
+		if err := setSensorLocation(redisClient, sensorID, lat, lng); err != nil {
+			return indexed, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
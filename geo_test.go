@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestValidateLocation(c *C) {
+	c.Assert(validateLocation(nil, nil), IsNil)
+	c.Assert(validateLocation(floatPtr(58.38), floatPtr(26.72)), IsNil)
+	c.Assert(validateLocation(floatPtr(58.38), nil), Not(IsNil))
+	c.Assert(validateLocation(floatPtr(91), floatPtr(0)), Not(IsNil))
+	c.Assert(validateLocation(floatPtr(0), floatPtr(-181)), Not(IsNil))
+
+	_, _, err := parseLocation("Tartu", "")
+	c.Assert(err, Not(IsNil))
+	lat, lng, err := parseLocation("58.38", "26.72")
+	c.Assert(err, IsNil)
+	c.Assert(*lat, Equals, 58.38)
+	c.Assert(*lng, Equals, 26.72)
+}
+
+func (s *TestSuite) TestUnmarshalSensorLocation(c *C) {
+	var sn sensor
+	c.Assert(json.Unmarshal([]byte(`{"label":"stack","lat":"58.38","lng":26.72}`), &sn), IsNil)
+	c.Assert(sn.Label, Equals, "stack")
+	c.Assert(*sn.Lat, Equals, 58.38)
+	c.Assert(*sn.Lng, Equals, 26.72)
+
+	sn = sensor{}
+	c.Assert(json.Unmarshal([]byte(`{"lat":"","lng":null}`), &sn), IsNil)
+	c.Assert(sn.Lat, IsNil)
+	c.Assert(sn.Lng, IsNil)
+
+	err := json.Unmarshal([]byte(`{"lat":"Tartu","lng":"26.72"}`), &sn)
+	c.Assert(err, FitsTypeOf, invalidLocationError(""))
+}
+
+func (s *TestSuite) TestDistance(c *C) {
+	// a degree along a meridian
+	d := distance(58, 26, 59, 26)
+	c.Assert(math.Abs(d-metresPerDegree) < 0.001, Equals, true)
+	// a degree along the equator
+	d = distance(0, 179.5, 0, -179.5)
+	c.Assert(math.Abs(d-metresPerDegree) < 0.001, Equals, true)
+	c.Assert(distance(10, 20, 10, 20), Equals, float64(0))
+}
+
+func (s *TestSuite) TestBoundingBox(c *C) {
+	bb, err := parseBoundingBox("26,58,27,59")
+	c.Assert(err, IsNil)
+	c.Assert(bb.contains(58.5, 26.5), Equals, true)
+	c.Assert(bb.contains(58.5, 25), Equals, false)
+
+	bb, err = parseBoundingBox("170,-10,-170,10")
+	c.Assert(err, IsNil)
+	c.Assert(bb.contains(0, 175), Equals, true)
+	c.Assert(bb.contains(0, -175), Equals, true)
+	c.Assert(bb.contains(0, 0), Equals, false)
+
+	_, err = parseBoundingBox("0,10,1,5")
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *TestSuite) TestSensorsNear(c *C) {
+	c.Assert((&sensor{ID: "3C001", Lat: floatPtr(58.3780), Lng: floatPtr(26.7290)}).save(), IsNil)
+	c.Assert((&sensor{ID: "3C002", Lat: floatPtr(58.3800), Lng: floatPtr(26.7300)}).save(), IsNil)
+	c.Assert((&sensor{ID: "3C003", Lat: floatPtr(59.4370), Lng: floatPtr(24.7536)}).save(), IsNil)
+
+	sensors, err := sensorsNear(58.3781, 26.7291, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(len(sensors), Equals, 2)
+	c.Assert(sensors[0].ID, Equals, "3C001")
+	c.Assert(sensors[1].ID, Equals, "3C002")
+
+	c.Assert((&sensor{ID: "3C002"}).save(), IsNil)
+	sensors, err = sensorsNear(58.3781, 26.7291, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(len(sensors), Equals, 1)
+
+	c.Assert((&sensor{ID: "3C001"}).save(), IsNil)
+	c.Assert((&sensor{ID: "3C003"}).save(), IsNil)
+}
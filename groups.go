@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const keyGroups = "osp:groups"
+
+// Readings older than this are left out when group rules are checked.
+const groupReadingMaxAge = time.Hour
+
+const (
+	statisticMean   = "mean"
+	statisticMin    = "min"
+	statisticMax    = "max"
+	statisticSpread = "spread"
+)
+
+func keyOfSensorGroups(sensorID string) string {
+	return fmt.Sprintf("osp:sensor:%s:groups", sensorID)
+}
+
+// Rules of a group that are broken, by rule, with the alert message.
+func keyOfGroupBrokenRules(groupID string) string {
+	return fmt.Sprintf("osp:group:%s:broken_rules", groupID)
+}
+
+// A group is a named set of sensors, for example a barn or a stack. Sensors
+// of a group can belong to different coordinators.
+type group struct {
+	ID          string       `json:"id"`
+	Label       string       `json:"label"`
+	Description string       `json:"description,omitempty"`
+	SensorIDs   []string     `json:"sensor_ids"`
+	Rules       []*groupRule `json:"rules,omitempty"`
+}
+
+// A group rule raises an alert when a statistic of the latest readings of
+// the group members is above or below a limit.
+type groupRule struct {
+	Channel   string   `json:"channel"`
+	Statistic string   `json:"statistic"`
+	Above     *float64 `json:"above,omitempty"`
+	Below     *float64 `json:"below,omitempty"`
+}
+
+type unknownGroupError string
+
+func (e unknownGroupError) Error() string {
+	return fmt.Sprintf("Unknown group %s", string(e))
+}
+
+// Aggregate statistics of the values of one channel of group members.
+type groupAggregate struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Spread float64 `json:"spread"`
+}
+
+type groupSeries struct {
+	GroupID string            `json:"group_id"`
+	Channel string            `json:"channel"`
+	Start   time.Time         `json:"start"`
+	End     time.Time         `json:"end"`
+	Bucket  int64             `json:"bucket"` // seconds
+	Times   []time.Time       `json:"times"`
+	Points  []*groupAggregate `json:"points"` // null for buckets without readings
+}
+
+func (rule *groupRule) validate() error {
+	if len(rule.Channel) == 0 {
+		return errors.New("Missing rule channel")
+	}
+	switch rule.Statistic {
+	case statisticMean, statisticMin, statisticMax, statisticSpread:
+	default:
+		return fmt.Errorf("Rule statistic must be one of %s, %s, %s, %s",
+			statisticMean, statisticMin, statisticMax, statisticSpread)
+	}
+	if rule.Above == nil && rule.Below == nil {
+		return errors.New("Rule needs above or below limit")
+	}
+	return nil
+}
+
+// key identifies the rule when its state is stored, editing the rule makes
+// it a new rule.
+func (rule *groupRule) key() string {
+	limit := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return fmt.Sprintf("%g", *f)
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", rule.Channel, rule.Statistic, limit(rule.Above), limit(rule.Below))
+}
+
+// check returns an alert message when the aggregate breaks the rule.
+func (rule *groupRule) check(a *groupAggregate) string {
+	value := a.statistic(rule.Statistic)
+	if rule.Above != nil && value > *rule.Above {
+		return fmt.Sprintf("%s %s %g is above %g", rule.Channel, rule.Statistic, value, *rule.Above)
+	}
+	if rule.Below != nil && value < *rule.Below {
+		return fmt.Sprintf("%s %s %g is below %g", rule.Channel, rule.Statistic, value, *rule.Below)
+	}
+	return ""
+}
+
+func (a *groupAggregate) statistic(name string) float64 {
+	switch name {
+	case statisticMin:
+		return a.Min
+	case statisticMax:
+		return a.Max
+	case statisticSpread:
+		return a.Spread
+	}
+	return a.Mean
+}
+
+func aggregate(values []float64) *groupAggregate {
+	if len(values) == 0 {
+		return nil
+	}
+	a := &groupAggregate{Count: len(values), Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, value := range values {
+		a.Mean += value
+		a.Min = math.Min(a.Min, value)
+		a.Max = math.Max(a.Max, value)
+	}
+	a.Mean /= float64(len(values))
+	a.Spread = a.Max - a.Min
+	return a
+}
+
+// aggregateDots aggregates a channel of the dots of one bucket of several
+// sensors. Dots of sensors without readings in the bucket are nil.
+func aggregateDots(dots []*tick, channel string) *groupAggregate {
+	var values []float64
+	for _, t := range dots {
+		if t == nil {
+			continue
+		}
+		if value, ok := t.channelValues()[channel]; ok {
+			values = append(values, value)
+		}
+	}
+	return aggregate(values)
+}
+
+func (g *group) validate() error {
+	if len(g.ID) == 0 {
+		return errors.New("Missing group ID")
+	}
+	if len(g.Label) == 0 {
+		g.Label = g.ID
+	}
+	if len(g.SensorIDs) > maxComparedSensors {
+		return fmt.Errorf("Group cannot have more than %d sensors", maxComparedSensors)
+	}
+	for _, rule := range g.Rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadGroup(groupID string) (*group, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyGroups, groupID))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, unknownGroupError(groupID)
+		}
+		return nil, err
+	}
+
+	var g group
+	if err := json.Unmarshal(b, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// save stores the group and updates the sensor to group index, which is
+// used for checking group rules when readings arrive.
+func (g *group) save() error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	g.SensorIDs = uniqueSorted(g.SensorIDs)
+
+	old, err := loadGroup(g.ID)
+	if _, ok := err.(unknownGroupError); ok {
+		old, err = &group{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	tx := multi(redisClient)
+	for _, sensorID := range old.SensorIDs {
+		tx.send("SREM", keyOfSensorGroups(sensorID), g.ID)
+	}
+	for _, sensorID := range g.SensorIDs {
+		tx.send("SADD", keyOfSensorGroups(sensorID), g.ID)
+	}
+	tx.send("HSET", keyGroups, g.ID, b)
+	kept := make(map[string]bool)
+	for _, rule := range g.Rules {
+		kept[rule.key()] = true
+	}
+	for _, rule := range old.Rules {
+		if !kept[rule.key()] {
+			tx.send("HDEL", keyOfGroupBrokenRules(g.ID), rule.key())
+		}
+	}
+	_, err = tx.exec()
+	return err
+}
+
+func deleteGroup(groupID string) error {
+	g, err := loadGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	tx := multi(redisClient)
+	for _, sensorID := range g.SensorIDs {
+		tx.send("SREM", keyOfSensorGroups(sensorID), g.ID)
+	}
+	tx.send("HDEL", keyGroups, g.ID)
+	tx.send("DEL", keyOfGroupBrokenRules(g.ID))
+	_, err = tx.exec()
+	return err
+}
+
+func groups() ([]*group, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyGroups))
+	if err != nil {
+		return nil, err
+	}
+	var result []*group
+	for _, value := range bb {
+		var g group
+		if err := json.Unmarshal(value.([]byte), &g); err != nil {
+			return nil, err
+		}
+		result = append(result, &g)
+	}
+
+	sort.Sort(byGroupID(result))
+	return result, nil
+}
+
+type byGroupID []*group
+
+func (a byGroupID) Len() int           { return len(a) }
+func (a byGroupID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byGroupID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+func groupIDsOfSensor(sensorID string) ([]string, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	return redis.Strings(redisClient.Do("SMEMBERS", keyOfSensorGroups(sensorID)))
+}
+
+func uniqueSorted(list []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, s := range list {
+		if len(s) > 0 && !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// series aggregates a channel of the group members into buckets.
+func (g *group) series(channel string, start, end int, bucket time.Duration) (*groupSeries, error) {
+	c, err := compareSensors(g.SensorIDs, "", start, end, bucket)
+	if err != nil {
+		return nil, err
+	}
+	gs := &groupSeries{
+		GroupID: g.ID,
+		Channel: channel,
+		Start:   c.Start,
+		End:     c.End,
+		Bucket:  c.Bucket,
+		Times:   c.Times,
+		Points:  make([]*groupAggregate, len(c.Times)),
+	}
+	dots := make([]*tick, len(c.Series))
+	for n := range c.Times {
+		for i, series := range c.Series {
+			dots[i] = series.Dots[n]
+		}
+		gs.Points[n] = aggregateDots(dots, channel)
+	}
+	return gs, nil
+}
+
+// latest aggregates a channel of the last readings of the group members.
+func (g *group) latest(channel string) (*groupAggregate, error) {
+	var dots []*tick
+	for _, sensorID := range g.SensorIDs {
+		t, err := lastTickOfSensor(sensorID)
+		if err != nil {
+			return nil, err
+		}
+		if t == nil || time.Since(t.Datetime) > groupReadingMaxAge {
+			continue
+		}
+		if err := setMoisture(sensorID, []*tick{t}); err != nil {
+			return nil, err
+		}
+		dots = append(dots, t)
+	}
+	return aggregateDots(dots, channel), nil
+}
+
+// checkGroupRules checks the rules of the groups the sensors of the ticks
+// belong to. An alert is returned only when a rule becomes broken, and
+// when a broken rule is met again, not on every reading while it stays
+// broken.
+func checkGroupRules(ticks []*tick) ([]*alert, error) {
+	var groupIDs []string
+	for _, t := range ticks {
+		ids, err := groupIDsOfSensor(t.SensorID)
+		if err != nil {
+			return nil, err
+		}
+		groupIDs = append(groupIDs, ids...)
+	}
+
+	var alerts []*alert
+	for _, groupID := range uniqueSorted(groupIDs) {
+		g, err := loadGroup(groupID)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range g.Rules {
+			a, err := g.latest(rule.Channel)
+			if err != nil {
+				return nil, err
+			}
+			if a == nil {
+				continue
+			}
+			message, err := g.ruleTransition(rule, rule.check(a))
+			if err != nil {
+				return nil, err
+			}
+			if len(message) > 0 {
+				alerts = append(alerts, &alert{GroupID: g.ID, Channel: rule.Channel, Message: message, sensorIDs: g.SensorIDs})
+			}
+		}
+	}
+	return alerts, nil
+}
+
+// ruleTransition stores whether the rule is broken, given the message of
+// a broken rule or an empty message. It returns the alert message when the
+// rule became broken or was met again, empty when nothing changed. Of
+// concurrent uploads only one sees the change.
+func (g *group) ruleTransition(rule *groupRule, message string) (string, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	key := keyOfGroupBrokenRules(g.ID)
+	if len(message) > 0 {
+		changed, err := redis.Bool(redisClient.Do("HSETNX", key, rule.key(), message))
+		if err != nil || !changed {
+			return "", err
+		}
+		return message, nil
+	}
+	changed, err := redis.Bool(redisClient.Do("HDEL", key, rule.key()))
+	if err != nil || !changed {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s is back within limits", rule.Channel, rule.Statistic), nil
+}
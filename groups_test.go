@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestAggregateDots(c *C) {
+	dots := []*tick{
+		{Temperature: 10},
+		nil,
+		{Temperature: 16},
+		{Channels: map[string]float64{"co2": 400}},
+	}
+	a := aggregateDots(dots, channelTemperature)
+	c.Assert(*a, Equals, groupAggregate{Count: 2, Mean: 13, Min: 10, Max: 16, Spread: 6})
+	c.Assert(aggregateDots(dots, "humidity"), IsNil)
+}
+
+func (s *TestSuite) TestGroupRuleCheck(c *C) {
+	rule := &groupRule{Channel: channelTemperature, Statistic: statisticSpread, Above: floatPtr(5)}
+	c.Assert(rule.validate(), IsNil)
+	c.Assert(rule.check(&groupAggregate{Spread: 4}), Equals, "")
+	c.Assert(rule.check(&groupAggregate{Spread: 6}), Equals, "temperature spread 6 is above 5")
+
+	c.Assert((&groupRule{Channel: channelTemperature, Statistic: "median", Above: floatPtr(5)}).validate(), Not(IsNil))
+	c.Assert((&groupRule{Channel: channelTemperature, Statistic: statisticMax}).validate(), Not(IsNil))
+}
+
+func (s *TestSuite) TestGroupSave(c *C) {
+	g := &group{ID: "barn", SensorIDs: []string{"1A002", "1A001", "1A002"}}
+	c.Assert(g.save(), IsNil)
+	c.Assert(g.Label, Equals, "barn")
+	c.Assert(g.SensorIDs, DeepEquals, []string{"1A001", "1A002"})
+
+	g.SensorIDs = []string{"1A003"}
+	c.Assert(g.save(), IsNil)
+	ids, err := groupIDsOfSensor("1A001")
+	c.Assert(err, IsNil)
+	c.Assert(len(ids), Equals, 0)
+	ids, err = groupIDsOfSensor("1A003")
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []string{"barn"})
+
+	c.Assert(deleteGroup("barn"), IsNil)
+	_, err = loadGroup("barn")
+	c.Assert(err, FitsTypeOf, unknownGroupError(""))
+}
+
+func (s *TestSuite) TestCheckGroupRules(c *C) {
+	now := time.Now()
+	c.Assert(saveTicks([]*tick{{SensorID: "2B001", Datetime: now, Temperature: 10, coordinatorID: "8"}}), IsNil)
+	c.Assert(saveTicks([]*tick{{SensorID: "2B002", Datetime: now, Temperature: 20, coordinatorID: "8"}}), IsNil)
+	g := &group{
+		ID:        "stack",
+		SensorIDs: []string{"2B001", "2B002"},
+		Rules: []*groupRule{
+			{Channel: channelTemperature, Statistic: statisticMax, Above: floatPtr(15)},
+			{Channel: channelTemperature, Statistic: statisticMean, Below: floatPtr(0)},
+		},
+	}
+	c.Assert(g.save(), IsNil)
+
+	alerts, err := checkGroupRules([]*tick{{SensorID: "2B001"}})
+	c.Assert(err, IsNil)
+	c.Assert(len(alerts), Equals, 1)
+	c.Assert(alerts[0].GroupID, Equals, "stack")
+	c.Assert(alerts[0].Message, Equals, "temperature max 20 is above 15")
+	c.Assert(alerts[0].sensorIDs, DeepEquals, []string{"2B001", "2B002"})
+
+	// no new alert while the rule stays broken
+	alerts, err = checkGroupRules([]*tick{{SensorID: "2B002"}})
+	c.Assert(err, IsNil)
+	c.Assert(len(alerts), Equals, 0)
+
+	c.Assert(saveTicks([]*tick{{SensorID: "2B002", Datetime: now.Add(time.Second), Temperature: 12, coordinatorID: "8"}}), IsNil)
+	alerts, err = checkGroupRules([]*tick{{SensorID: "2B002"}})
+	c.Assert(err, IsNil)
+	c.Assert(len(alerts), Equals, 1)
+	c.Assert(alerts[0].Message, Equals, "temperature max is back within limits")
+
+	c.Assert(deleteGroup("stack"), IsNil)
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/toggl/bugsnag"
@@ -19,16 +25,85 @@ func defineRoutes() {
 	coordinators := api.PathPrefix("/coordinators").Subrouter()
 	coordinators.HandleFunc("/{coordinator_id}/sensors", getCoordinatorSensors).Methods("GET")
 	coordinators.HandleFunc("/{coordinator_id}/readings", getCoordinatorReadings).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/dots", getCoordinatorDots).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/stream", getCoordinatorStream).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/export", getCoordinatorExport).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/compare", getCoordinatorComparison).Methods("GET")
 	coordinators.HandleFunc("/{coordinator_id}/log", getCoordinatorLog).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/pending", getCoordinatorPendingSensors).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/claim", postClaimSensor).Methods("POST")
+	coordinators.HandleFunc("/{coordinator_id}/install", postInstallSensor).Methods("POST")
+	coordinators.HandleFunc("/{coordinator_id}/config", getCoordinatorConfig).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/clock_skew", getCoordinatorClockSkew).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/sessions", getCoordinatorSessions).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/uploads", getCoordinatorUploads).Methods("GET")
+	coordinators.HandleFunc("/{coordinator_id}/config", putCoordinatorConfig).Methods("POST", "PUT")
 	coordinators.HandleFunc("/{coordinator_id}", putCoordinator).Methods("POST", "PUT")
 	coordinators.HandleFunc("/{coordinator_id}/{hash}", getCoordinator).Methods("GET")
 
 	sensors := api.PathPrefix("/sensors").Subrouter()
+	sensors.HandleFunc("/stream", getSensorsStream).Methods("GET")
+	sensors.HandleFunc("/export", getSensorsExport).Methods("GET")
+	sensors.HandleFunc("/compare", getSensorsComparison).Methods("GET")
+	sensors.HandleFunc("/nearby", getSensorsNearby).Methods("GET")
+	sensors.HandleFunc("/within", getSensorsWithin).Methods("GET")
+	sensors.HandleFunc("/geojson", getSensorsGeoJSON).Methods("GET")
 	sensors.HandleFunc("/{sensor_id}", putSensor).Methods("POST", "PUT")
 	sensors.HandleFunc("/{sensor_id}/ticks", getSensorTicks).Methods("GET")
 	sensors.HandleFunc("/{sensor_id}/dots", getSensorDots).Methods("GET")
+	sensors.HandleFunc("/{sensor_id}/channels", getSensorChannels).Methods("GET")
+	sensors.HandleFunc("/{sensor_id}/export", getSensorExport).Methods("GET")
+	sensors.HandleFunc("/{sensor_id}/replace", postSensorReplacement).Methods("POST")
+	sensors.HandleFunc("/{sensor_id}/replacements", getSensorReplacements).Methods("GET")
+	sensors.HandleFunc("/{sensor_id}/assignments", getSensorAssignments).Methods("GET")
+
+	api.HandleFunc("/groups", getGroups).Methods("GET")
+	groups := api.PathPrefix("/groups").Subrouter()
+	groups.HandleFunc("/{group_id}", getGroup).Methods("GET")
+	groups.HandleFunc("/{group_id}", putGroup).Methods("POST", "PUT")
+	groups.HandleFunc("/{group_id}", deleteGroupByID).Methods("DELETE")
+	groups.HandleFunc("/{group_id}/series", getGroupSeries).Methods("GET")
+	groups.HandleFunc("/{group_id}/compare", getGroupComparison).Methods("GET")
+
+	api.HandleFunc("/layouts", getLayouts).Methods("GET")
+	layouts := api.PathPrefix("/layouts").Subrouter()
+	layouts.HandleFunc("/{layout_id}", getLayout).Methods("GET")
+	layouts.HandleFunc("/{layout_id}", putLayout).Methods("POST", "PUT")
+	layouts.HandleFunc("/{layout_id}", deleteLayoutByID).Methods("DELETE")
+	layouts.HandleFunc("/{layout_id}/heatmap", getLayoutHeatmap).Methods("GET")
+
+	api.HandleFunc("/profiles", getSensorProfiles).Methods("GET")
+	api.HandleFunc("/materials", getMoistureCurves).Methods("GET")
 
 	api.HandleFunc("/admin/coordinators", getAdminCoordinators).Methods("GET")
+	api.HandleFunc("/admin/profiles/{name}", putSensorProfile).Methods("POST", "PUT")
+	api.HandleFunc("/admin/materials/{material}", putMoistureCurve).Methods("POST", "PUT")
+	api.HandleFunc("/admin/import", postImport).Methods("POST")
+	api.HandleFunc("/admin/pending", getPendingDevices).Methods("GET")
+	api.HandleFunc("/admin/provisioning", getProvisionedSensors).Methods("GET")
+	api.HandleFunc("/admin/provisioning", postProvisioning).Methods("POST")
+	api.HandleFunc("/admin/pending/coordinators/{coordinator_id}/claim", postClaimCoordinator).Methods("POST")
+	api.HandleFunc("/admin/pending/{kind}/{id}", deletePendingDevice).Methods("DELETE")
+	api.HandleFunc("/admin/clock_skew", getClockSkews).Methods("GET")
+	api.HandleFunc("/admin/sessions/unidentified", getUnidentifiedSessions).Methods("GET")
+	api.HandleFunc("/admin/uploads/unidentified", getUnidentifiedUploads).Methods("GET")
+	api.HandleFunc("/admin/coordinators/{coordinator_id}/replay", postReplay).Methods("POST")
+	api.HandleFunc("/admin/ingest", getIngestStats).Methods("GET")
+	api.HandleFunc("/admin/dead_letters", getDeadLetters).Methods("GET")
+	api.HandleFunc("/admin/dead_letters/{dead_letter_id}", getDeadLetter).Methods("GET")
+	api.HandleFunc("/admin/dead_letters/{dead_letter_id}", putDeadLetter).Methods("POST", "PUT")
+	api.HandleFunc("/admin/dead_letters/{dead_letter_id}", deleteDeadLetterByID).Methods("DELETE")
+	api.HandleFunc("/admin/dead_letters/{dead_letter_id}/requeue", postRequeueDeadLetter).Methods("POST")
+	api.HandleFunc("/admin/firmware", getFirmwares).Methods("GET")
+	api.HandleFunc("/admin/firmware/{hardware_revision}/{version}", getFirmware).Methods("GET")
+	api.HandleFunc("/admin/firmware/{hardware_revision}/{version}", postFirmware).Methods("POST", "PUT")
+	api.HandleFunc("/admin/firmware/{hardware_revision}/{version}", deleteFirmwareByID).Methods("DELETE")
+	api.HandleFunc("/admin/rollouts", getRollouts).Methods("GET")
+	api.HandleFunc("/admin/rollouts/{rollout_id}", getRollout).Methods("GET")
+	api.HandleFunc("/admin/rollouts/{rollout_id}", putRollout).Methods("POST", "PUT")
+	api.HandleFunc("/admin/rollouts/{rollout_id}/{action:advance|pause|resume|cancel}", postRolloutAction).Methods("POST")
+
+	api.HandleFunc("/upload", postUpload).Methods("POST")
 
 	api.HandleFunc("/v2/log", getJSONLogs).Methods("GET")
 	api.HandleFunc("/v2/logs", getJSONLogs).Methods("GET")
@@ -39,20 +114,7 @@ func defineRoutes() {
 func getAdminCoordinators(w http.ResponseWriter, r *http.Request) {
 	log.Println(r)
 
-	auth, err := parseToken(r)
-	if err != nil {
-		bugsnag.Notify(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if auth == nil {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"Ardusensor admin\"")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	if auth.Username != *adminUsername || auth.Password != *adminPassword {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"Ardusensor admin\"")
-		w.WriteHeader(http.StatusUnauthorized)
+	if !authorizeAdmin(w, r) {
 		return
 	}
 
@@ -74,13 +136,105 @@ func getAdminCoordinators(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// isAdmin tells if the request has admin credentials.
+func isAdmin(r *http.Request) (bool, error) {
+	auth, err := parseToken(r)
+	if err != nil {
+		return false, err
+	}
+	return auth != nil && auth.Username == *adminUsername && auth.Password == *adminPassword, nil
+}
+
+// authorizeAdmin checks admin credentials of the request. If they're missing
+// or wrong, it writes the response and returns false.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	admin, err := isAdmin(r)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !admin {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"Ardusensor admin\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// authorizeOwner lets through the admin and holders of the coordinator
+// token.
+func authorizeOwner(w http.ResponseWriter, r *http.Request, coordinatorID, token string) bool {
+	admin, err := isAdmin(r)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if admin {
+		return true
+	}
+	if len(token) > 0 && hmac.Equal([]byte(token), []byte(tokenForCoordinator(coordinatorID))) {
+		return true
+	}
+	http.Error(w, "Incorrect token for this coordinator", http.StatusUnauthorized)
+	return false
+}
+
+// Number of items returned by listings when no limit is given, and the
+// largest limit allowed.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageOfRequest parses offset and limit of a paginated listing.
+func pageOfRequest(w http.ResponseWriter, r *http.Request) (offset, limit int, ok bool) {
+	limit = defaultPageLimit
+	if len(r.FormValue("offset")) > 0 {
+		var err error
+		offset, err = strconv.Atoi(r.FormValue("offset"))
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	if len(r.FormValue("limit")) > 0 {
+		var err error
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			http.Error(w, fmt.Sprintf("Limit must be between 1 and %d", maxPageLimit), http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+// isValidationError tells if the error was caused by invalid input
+// and should be reported to client as a bad request.
+func isValidationError(err error) bool {
+	switch err.(type) {
+	case staleTickError, unknownProfileError, outOfRangeError, unknownMaterialError, invalidLocationError, replacementError, unknownCoordinatorError,
+		provisioningError, unknownLayoutError, configError, firmwareError, unknownFirmwareError, rolloutError,
+		comparisonError, layoutError, requeueError:
+		return true
+	}
+	return err == errNoTickForCalibration
+}
+
 func getCoordinatorLog(w http.ResponseWriter, r *http.Request) {
 	coordinatorID, err := strconv.Atoi(mux.Vars(r)["coordinator_id"])
 	if err != nil {
 		http.Error(w, "Missing or invalid coordinator_id", http.StatusBadRequest)
 		return
 	}
-	writeLogs(w, r, loggingKeyJSON, coordinatorID)
+	page, err := searchUploads(strconv.Itoa(coordinatorID), &uploadQuery{Limit: maxPageLimit})
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeLogs(w, page.Uploads)
 }
 
 func getCoordinator(w http.ResponseWriter, r *http.Request) {
@@ -120,6 +274,7 @@ func getCoordinator(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// putCoordinator sets label and profile of a claimed coordinator.
 func putCoordinator(w http.ResponseWriter, r *http.Request) {
 	log.Println(r)
 
@@ -136,17 +291,52 @@ func putCoordinator(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var c coordinator
-	if err := json.Unmarshal(b, &c); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// fields left out are kept as they are
+	var req struct {
+		Label   *string `json:"label"`
+		Profile string  `json:"profile"`
+		Token   string  `json:"token"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, req.Token) {
 		return
 	}
 
-	if err := setCoordinatorLabel(coordinatorID, c.Label); err != nil {
+	// coordinators are only made known by claiming them
+	exists, err := coordinatorExists(coordinatorID)
+	if err != nil {
 		bugsnag.Notify(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !exists {
+		http.Error(w, unknownCoordinatorError(coordinatorID).Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Profile) > 0 {
+		if err := setCoordinatorProfile(coordinatorID, req.Profile); err != nil {
+			if isValidationError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			bugsnag.Notify(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.Label != nil {
+		if err := setCoordinatorLabel(coordinatorID, *req.Label); err != nil {
+			bugsnag.Notify(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -169,12 +359,16 @@ func putSensor(w http.ResponseWriter, r *http.Request) {
 
 	var s sensor
 	if err := json.Unmarshal(b, &s); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	s.ID = sensorID
 
 	if err := s.save(); err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		bugsnag.Notify(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -218,6 +412,33 @@ func getCoordinatorSensors(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func getSensorChannels(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorID, exists := mux.Vars(r)["sensor_id"]
+	if !exists {
+		http.Error(w, "Missing sensor_id", http.StatusBadRequest)
+		return
+	}
+
+	channels, err := sensorChannels(sensorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(channels)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
 func getSensorDots(w http.ResponseWriter, r *http.Request) {
 	log.Println(r)
 
@@ -256,6 +477,12 @@ func getSensorDots(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := setMoisture(sensorID, ticks); err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	var dots []*tick
 	if dotsPerDay > 0 {
 		dots = findAverages(ticks, dotsPerDay, start, end)
@@ -300,6 +527,12 @@ func getSensorTicks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := setMoisture(sensorID, result); err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	b, err := json.Marshal(result)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -352,17 +585,2347 @@ func getCoordinatorReadings(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func getJSONLogs(w http.ResponseWriter, r *http.Request) {
-	writeLogs(w, r, loggingKeyJSON, 0)
+func getSensorProfiles(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	profiles, err := sensorProfiles()
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(profiles)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func putSensorProfile(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	name, ok := mux.Vars(r)["name"]
+	if !ok {
+		http.Error(w, "Missing profile name", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var p sensorProfile
+	if err := json.Unmarshal(b, &p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.Name = name
+
+	if err := p.save(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err = json.Marshal(p)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
 }
 
-func writeLogs(w http.ResponseWriter, r *http.Request, key string, coordinatorID int) {
-	b, err := getLogs(key, coordinatorID)
+func getMoistureCurves(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	curves, err := moistureCurves()
 	if err != nil {
 		bugsnag.Notify(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain")
+
+	b, err := json.Marshal(curves)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func putMoistureCurve(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	material, ok := mux.Vars(r)["material"]
+	if !ok {
+		http.Error(w, "Missing material", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var mc moistureCurve
+	if err := json.Unmarshal(b, &mc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mc.Material = material
+
+	if err := mc.save(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err = json.Marshal(mc)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getCoordinatorDots(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, err := strconv.ParseInt(mux.Vars(r)["coordinator_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	start, err := strconv.Atoi(r.FormValue("start"))
+	if err != nil {
+		http.Error(w, "Invalid start", http.StatusBadRequest)
+		return
+	}
+
+	end, err := strconv.Atoi(r.FormValue("end"))
+	if err != nil {
+		http.Error(w, "Invalid end", http.StatusBadRequest)
+		return
+	}
+
+	dotsPerDay, err := strconv.Atoi(r.FormValue("dots_per_day"))
+	if err != nil {
+		http.Error(w, "Invalid dots_per_day", http.StatusBadRequest)
+		return
+	}
+	if dotsPerDay < 0 || dotsPerDay > 24 {
+		http.Error(w, "dots_per_day must be in range 0-24", http.StatusBadRequest)
+		return
+	}
+
+	readings, err := coordinatorReadingsByScore(coordinatorID, start, end)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var dots []*coordinatorReading
+	if dotsPerDay > 0 {
+		dots = findCoordinatorAverages(readings, dotsPerDay, start, end)
+	} else {
+		dots = readings
+	}
+
+	b, err := json.Marshal(dots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getCoordinatorStream(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	streamEvents(w, r, newSubscription(coordinatorID, nil))
+}
+
+func getSensorsStream(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorIDs := parseList(r.FormValue("ids"))
+	if len(sensorIDs) == 0 {
+		http.Error(w, "Missing ids", http.StatusBadRequest)
+		return
+	}
+
+	streamEvents(w, r, newSubscription("", sensorIDs))
+}
+
+// parseList parses a comma separated list, skipping empty items.
+func parseList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func getSensorExport(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorID, exists := mux.Vars(r)["sensor_id"]
+	if !exists {
+		http.Error(w, "Missing sensor_id", http.StatusBadRequest)
+		return
+	}
+
+	writeExport(w, r, []string{sensorID}, "", "sensor_"+sensorID)
+}
+
+func getSensorsExport(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorIDs := parseList(r.FormValue("ids"))
+	if len(sensorIDs) == 0 {
+		http.Error(w, "Missing ids", http.StatusBadRequest)
+		return
+	}
+
+	writeExport(w, r, sensorIDs, "", "sensors")
+}
+
+func getCoordinatorExport(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	sensorIDs, err := sensorIDsOfCoordinatorHistory(coordinatorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeExport(w, r, sensorIDs, coordinatorID, "coordinator_"+coordinatorID)
+}
+
+// writeExport writes ticks of the sensors. When coordinator ID is given,
+// only ticks from the periods the sensors belonged to it are written.
+func writeExport(w http.ResponseWriter, r *http.Request, sensorIDs []string, coordinatorID, filename string) {
+	opts := &exportOptions{
+		sensorIDs:     sensorIDs,
+		format:        r.FormValue("format"),
+		channels:      parseList(r.FormValue("channels")),
+		location:      time.UTC,
+		coordinatorID: coordinatorID,
+	}
+
+	var err error
+	opts.start, err = strconv.Atoi(r.FormValue("start"))
+	if err != nil {
+		http.Error(w, "Missing or invalid start", http.StatusBadRequest)
+		return
+	}
+
+	opts.end, err = strconv.Atoi(r.FormValue("end"))
+	if err != nil {
+		http.Error(w, "Missing or invalid end", http.StatusBadRequest)
+		return
+	}
+
+	if len(opts.format) == 0 {
+		opts.format = exportFormatCSV
+	}
+	var contentType string
+	switch opts.format {
+	case exportFormatCSV:
+		contentType = "text/csv"
+	case exportFormatNDJSON:
+		contentType = "application/x-ndjson"
+	default:
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	if tz := r.FormValue("tz"); len(tz) > 0 {
+		opts.location, err = time.LoadLocation(tz)
+		if err != nil {
+			http.Error(w, "Invalid tz", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if bucket := r.FormValue("bucket"); len(bucket) > 0 {
+		opts.bucket, err = time.ParseDuration(bucket)
+		if err != nil || opts.bucket < time.Minute {
+			http.Error(w, "bucket must be a duration of at least 1m", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", filename, opts.format))
+	w.WriteHeader(http.StatusOK)
+
+	if err := exportTicks(w, opts); err != nil {
+		// headers are sent already, all we can do is to cut the response short
+		bugsnag.Notify(err)
+		log.Println("Export failed", err)
+	}
+}
+
+func postImport(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	// body is the file, options are in query
+	query := r.URL.Query()
+	opts := &importOptions{
+		format:      query.Get("format"),
+		sensorID:    query.Get("sensor_id"),
+		timeColumn:  query.Get("time_column"),
+		raw:         query.Get("raw") == "true",
+		dryRun:      query.Get("dry_run") == "true",
+		skipInvalid: query.Get("skip_invalid") == "true",
+	}
+	var err error
+	opts.columns, err = parseColumnMappings(query.Get("columns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := opts.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	report, err := importTicks(r.Body, opts)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if report.Invalid > 0 && !opts.skipInvalid && !opts.dryRun {
+		status = http.StatusUnprocessableEntity
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func getSensorsComparison(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorIDs := parseList(r.FormValue("ids"))
+	if len(sensorIDs) == 0 {
+		http.Error(w, "Missing ids", http.StatusBadRequest)
+		return
+	}
+
+	writeComparison(w, r, sensorIDs, "")
+}
+
+func getCoordinatorComparison(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	sensorIDs, err := sensorIDsOfCoordinatorHistory(coordinatorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeComparison(w, r, sensorIDs, coordinatorID)
+}
+
+// writeComparison writes series of the sensors aligned to buckets. When
+// coordinator ID is given, only ticks from the periods the sensors belonged
+// to it are compared.
+func writeComparison(w http.ResponseWriter, r *http.Request, sensorIDs []string, coordinatorID string) {
+	start, end, bucket, err := parseBucketRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c, err := compareSensors(sensorIDs, coordinatorID, start, end, bucket)
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// parseBucketRange parses start and end of a time range, and a bucket given
+// either as a duration or, like for dots, as a number of dots per day.
+func parseBucketRange(r *http.Request) (int, int, time.Duration, error) {
+	start, err := strconv.Atoi(r.FormValue("start"))
+	if err != nil {
+		return 0, 0, 0, errors.New("Missing or invalid start")
+	}
+
+	end, err := strconv.Atoi(r.FormValue("end"))
+	if err != nil {
+		return 0, 0, 0, errors.New("Missing or invalid end")
+	}
+
+	if s := r.FormValue("dots_per_day"); len(s) > 0 {
+		dotsPerDay, err := strconv.Atoi(s)
+		if err != nil || dotsPerDay < 1 || dotsPerDay > 24 {
+			return 0, 0, 0, errors.New("dots_per_day must be in range 1-24")
+		}
+		return start, end, time.Duration(24/dotsPerDay) * time.Hour, nil
+	}
+
+	bucket, err := time.ParseDuration(r.FormValue("bucket"))
+	if err != nil || bucket < time.Minute {
+		return 0, 0, 0, errors.New("bucket must be a duration of at least 1m")
+	}
+	return start, end, bucket, nil
+}
+
+func getGroups(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	list, err := groups()
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// groupOfRequest loads the group of the request, writing an error response
+// when it cannot be loaded.
+func groupOfRequest(w http.ResponseWriter, r *http.Request) (*group, bool) {
+	groupID, ok := mux.Vars(r)["group_id"]
+	if !ok {
+		http.Error(w, "Missing group_id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	g, err := loadGroup(groupID)
+	if err != nil {
+		if _, ok := err.(unknownGroupError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return g, true
+}
+
+func getGroup(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	g, ok := groupOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := json.Marshal(g)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func putGroup(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	groupID, ok := mux.Vars(r)["group_id"]
+	if !ok {
+		http.Error(w, "Missing group_id", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var g group
+	if err := json.Unmarshal(b, &g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.ID = groupID
+
+	if err := g.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := g.save(); err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(g)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func deleteGroupByID(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	g, ok := groupOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := deleteGroup(g.ID); err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getGroupSeries(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	g, ok := groupOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	channel := r.FormValue("channel")
+	if len(channel) == 0 {
+		channel = channelTemperature
+	}
+
+	start, end, bucket, err := parseBucketRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gs, err := g.series(channel, start, end, bucket)
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(gs)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getGroupComparison(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	g, ok := groupOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	writeComparison(w, r, g.SensorIDs, "")
+}
+
+// getSensorsNearby returns sensors within radius metres of lat, lng.
+func getSensorsNearby(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	var values [3]float64
+	for i, name := range []string{"lat", "lng", "radius"} {
+		f, err := strconv.ParseFloat(r.FormValue(name), 64)
+		if err != nil {
+			http.Error(w, "Missing or invalid "+name, http.StatusBadRequest)
+			return
+		}
+		values[i] = f
+	}
+
+	sensors, err := sensorsNear(values[0], values[1], values[2])
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(sensors)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getSensorsWithin returns sensors inside a bounding box given as
+// bbox=min_lng,min_lat,max_lng,max_lat.
+func getSensorsWithin(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	bb, err := parseBoundingBox(r.FormValue("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sensors, err := sensorsWithin(bb)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(sensors)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getSensorsGeoJSON returns located sensors with their latest readings as
+// a GeoJSON feature collection, optionally limited to a bounding box.
+func getSensorsGeoJSON(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	var bb *boundingBox
+	if s := r.FormValue("bbox"); len(s) > 0 {
+		var err error
+		bb, err = parseBoundingBox(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sensors, err := sensorsWithin(bb)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fc, err := sensorFeatures(sensors)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(fc)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// postSensorReplacement links new hardware, given as new_sensor_id, to
+// the sensor. Time of the swap defaults to now. Hardware of another
+// coordinator can only be linked by an admin.
+func postSensorReplacement(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorID, ok := mux.Vars(r)["sensor_id"]
+	if !ok {
+		http.Error(w, "Missing sensor_id", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		NewSensorID string     `json:"new_sensor_id"`
+		ReplacedAt  *time.Time `json:"replaced_at"`
+		Token       string     `json:"token"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replacedAt := time.Now()
+	if req.ReplacedAt != nil {
+		replacedAt = *req.ReplacedAt
+	}
+
+	sensorID, err = resolveSensorID(sensorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	coordinatorID, err := findCoordinatorIDBySensorID(sensorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(coordinatorID) == 0 {
+		if !authorizeAdmin(w, r) {
+			return
+		}
+	} else if !authorizeOwner(w, r, coordinatorID, req.Token) {
+		return
+	}
+
+	admin, err := isAdmin(r)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rep, err := replaceSensor(sensorID, req.NewSensorID, replacedAt, admin)
+	if err != nil {
+		if _, ok := err.(sensorOwnedError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(rep)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getSensorReplacements returns the swap points of the sensor, for
+// marking them on charts.
+func getSensorReplacements(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorID, ok := mux.Vars(r)["sensor_id"]
+	if !ok {
+		http.Error(w, "Missing sensor_id", http.StatusBadRequest)
+		return
+	}
+
+	sensorID, err := resolveSensorID(sensorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	replacements, err := sensorReplacements(sensorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(replacements)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getSensorAssignments returns the periods the sensor has belonged to
+// coordinators.
+func getSensorAssignments(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	sensorID, ok := mux.Vars(r)["sensor_id"]
+	if !ok {
+		http.Error(w, "Missing sensor_id", http.StatusBadRequest)
+		return
+	}
+
+	assignments, err := sensorAssignments(sensorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(assignments)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getPendingDevices(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	var err error
+	var pending pendingDevices
+	pending.Coordinators, err = pendingDevicesOf(deviceKindCoordinator, "")
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pending.Sensors, err = pendingDevicesOf(deviceKindSensor, "")
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(pending)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func postClaimCoordinator(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Label string `json:"label"`
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, err := claimCoordinator(coordinatorID, req.Label)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(c)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// deletePendingDevice dismisses a pending device. It's held pending again
+// when it sends data next time.
+func deletePendingDevice(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	var kind string
+	switch mux.Vars(r)["kind"] {
+	case "coordinators":
+		kind = deviceKindCoordinator
+	case "sensors":
+		kind = deviceKindSensor
+	default:
+		http.Error(w, "kind must be coordinators or sensors", http.StatusBadRequest)
+		return
+	}
+
+	if err := dismissPendingDevice(kind, mux.Vars(r)["id"]); err != nil {
+		if err == errNotPending {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getCoordinatorPendingSensors lists unknown sensors that have sent data
+// through the coordinator.
+func getCoordinatorPendingSensors(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, r.FormValue("token")) {
+		return
+	}
+
+	sensors, err := pendingDevicesOf(deviceKindSensor, coordinatorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(sensors)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// postClaimSensor adds a sensor to the coordinator. Caller must be the
+// admin or give the coordinator token. Only the admin can move a sensor
+// from another coordinator.
+func postClaimSensor(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		SensorID string `json:"sensor_id"`
+		Token    string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, req.Token) {
+		return
+	}
+
+	if len(req.SensorID) == 0 {
+		http.Error(w, "Missing sensor_id", http.StatusBadRequest)
+		return
+	}
+
+	admin, err := isAdmin(r)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := claimSensor(req.SensorID, coordinatorID, admin); err != nil {
+		if _, ok := err.(sensorOwnedError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// postUpload takes an upload in the same format as the JSON upload port,
+// and responds with what would be sent back over the connection.
+func postUpload(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, err := ingest.submit(bytes.NewBuffer(b), &uploadSource{RemoteAddr: r.RemoteAddr, ConnectedAt: time.Now()})
+	if err != nil {
+		if err == errIngestQueueFull {
+			w.Header().Set("Retry-After", strconv.Itoa(ingestRetryAfter))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		switch err.(type) {
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(u.response)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getCoordinatorSessions returns upload sessions of the coordinator,
+// latest first.
+func getCoordinatorSessions(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, r.FormValue("token")) {
+		return
+	}
+
+	offset, limit, ok := pageOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := coordinatorSessions(coordinatorID, offset, limit)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getUnidentifiedSessions returns upload sessions that did not tell a
+// coordinator ID, latest first.
+func getUnidentifiedSessions(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	offset, limit, ok := pageOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := unidentifiedSessions(offset, limit)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// postReplay reprocesses archived uploads of the coordinator between start
+// and end, in unix seconds. Stored readings are replaced only when write is
+// true, otherwise the differences are reported.
+func postReplay(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	opts := &replayOptions{coordinatorID: coordinatorID, write: r.FormValue("write") == "true"}
+	var err error
+	if len(r.FormValue("start")) > 0 {
+		opts.start, err = strconv.ParseInt(r.FormValue("start"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid start", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(r.FormValue("end")) > 0 {
+		opts.end, err = strconv.ParseInt(r.FormValue("end"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid end", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := replayUploads(opts)
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getCoordinatorClockSkew returns clock skew samples of the coordinator
+// between start and end, in unix seconds. Defaults to the last week.
+func getCoordinatorClockSkew(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, r.FormValue("token")) {
+		return
+	}
+
+	end := int(time.Now().Unix())
+	if len(r.FormValue("end")) > 0 {
+		var err error
+		end, err = strconv.Atoi(r.FormValue("end"))
+		if err != nil {
+			http.Error(w, "Invalid end", http.StatusBadRequest)
+			return
+		}
+	}
+	start := end - int(clockDriftPeriod.Seconds())
+	if len(r.FormValue("start")) > 0 {
+		var err error
+		start, err = strconv.Atoi(r.FormValue("start"))
+		if err != nil {
+			http.Error(w, "Invalid start", http.StatusBadRequest)
+			return
+		}
+	}
+
+	h, err := clockSkewHistoryOf(coordinatorID, start, end)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getClockSkews lists latest clock skew and drift of coordinators, the
+// worst first.
+func getClockSkews(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	list, err := coordinatorClockSkews()
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getCoordinatorConfig returns the desired and reported configuration of
+// the coordinator, and whether the desired one has been applied.
+func getCoordinatorConfig(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, r.FormValue("token")) {
+		return
+	}
+
+	status, err := coordinatorConfigStatusOf(coordinatorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// putCoordinatorConfig replaces the desired configuration of the
+// coordinator. It's sent to the coordinator on its next upload.
+func putCoordinatorConfig(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cfg coordinatorConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := setDesiredConfig(coordinatorID, &cfg); err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status, err := coordinatorConfigStatusOf(coordinatorID)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(status)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getProvisionedSensors(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	sensors, err := provisionedSensors(r.FormValue("series"))
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(sensors)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// postProvisioning registers a series of sensor IDs, for example series
+// 1A from 1 to 100 gives IDs 1A001-1A100. Returns newly provisioned sensors.
+func postProvisioning(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Series  string `json:"series"`
+		Start   int    `json:"start"`
+		End     int    `json:"end"`
+		Payload string `json:"payload"` // QR code format, default if empty
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sensors, err := provisionSeries(req.Series, req.Start, req.End, req.Payload)
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(sensors)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// postInstallSensor claims a provisioned sensor, given by scanned QR code,
+// into the coordinator with its label and position. Caller must be the
+// admin or give the coordinator token.
+func postInstallSensor(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var inst installation
+	if err := json.Unmarshal(b, &inst); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, inst.Token) {
+		return
+	}
+
+	admin, err := isAdmin(r)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s, err := inst.install(coordinatorID, admin)
+	if err != nil {
+		if _, ok := err.(sensorOwnedError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(s)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getLayouts(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	list, err := layouts()
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// layoutOfRequest loads the layout of the request, writing an error
+// response when it cannot be loaded.
+func layoutOfRequest(w http.ResponseWriter, r *http.Request) (*layout, bool) {
+	layoutID, ok := mux.Vars(r)["layout_id"]
+	if !ok {
+		http.Error(w, "Missing layout_id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	l, err := loadLayout(layoutID)
+	if err != nil {
+		if _, ok := err.(unknownLayoutError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return l, true
+}
+
+func getLayout(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	l, ok := layoutOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func putLayout(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	layoutID, ok := mux.Vars(r)["layout_id"]
+	if !ok {
+		http.Error(w, "Missing layout_id", http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var l layout
+	if err := json.Unmarshal(b, &l); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.ID = layoutID
+
+	if err := l.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := l.save(); err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err = json.Marshal(l)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func deleteLayoutByID(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	layoutID, ok := mux.Vars(r)["layout_id"]
+	if !ok {
+		http.Error(w, "Missing layout_id", http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteLayout(layoutID); err != nil {
+		if _, ok := err.(unknownLayoutError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getLayoutHeatmap interpolates the last readings before given time into
+// a grid of nx * ny (* nz for 3D layouts) cells.
+func getLayoutHeatmap(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	l, ok := layoutOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	at := time.Now()
+	if s := r.FormValue("time"); len(s) > 0 {
+		seconds, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid time", http.StatusBadRequest)
+			return
+		}
+		at = time.Unix(seconds, 0)
+	}
+
+	maxAge := time.Hour
+	if s := r.FormValue("max_age"); len(s) > 0 {
+		var err error
+		maxAge, err = time.ParseDuration(s)
+		if err != nil || maxAge <= 0 {
+			http.Error(w, "Invalid max_age", http.StatusBadRequest)
+			return
+		}
+	}
+
+	channel := r.FormValue("channel")
+	if len(channel) == 0 {
+		channel = channelTemperature
+	}
+
+	size := [3]int{20, 20, 10}
+	for i, name := range []string{"nx", "ny", "nz"} {
+		if s := r.FormValue(name); len(s) > 0 {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			size[i] = n
+		}
+	}
+
+	hm, err := l.heatmap(channel, at, maxAge, size)
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(hm)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getJSONLogs(w http.ResponseWriter, r *http.Request) {
+	list, err := recentUploads(maxPageLimit)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeLogs(w, list)
+}
+
+// writeLogs writes uploads as quoted lines of receive time and body.
+func writeLogs(w http.ResponseWriter, list []*archivedUpload) {
+	buf := bytes.NewBuffer(nil)
+	for _, u := range list {
+		buf.WriteString(strconv.Quote(u.ReceivedAt.String() + " " + u.Body))
+		buf.WriteString("\n\r")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// uploadQueryOfRequest parses time range in unix seconds, search text and
+// pagination of an upload search.
+func uploadQueryOfRequest(w http.ResponseWriter, r *http.Request) (*uploadQuery, bool) {
+	offset, limit, ok := pageOfRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+	q := &uploadQuery{Text: r.FormValue("q"), Offset: offset, Limit: limit}
+	var err error
+	if len(r.FormValue("start")) > 0 {
+		q.Start, err = strconv.ParseInt(r.FormValue("start"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid start", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if len(r.FormValue("end")) > 0 {
+		q.End, err = strconv.ParseInt(r.FormValue("end"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid end", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return q, true
+}
+
+// getCoordinatorUploads searches raw uploads of the coordinator, latest
+// first.
+func getCoordinatorUploads(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	coordinatorID, ok := mux.Vars(r)["coordinator_id"]
+	if !ok {
+		http.Error(w, "Missing coordinator_id", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeOwner(w, r, coordinatorID, r.FormValue("token")) {
+		return
+	}
+
+	q, ok := uploadQueryOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := searchUploads(coordinatorID, q)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getUnidentifiedUploads searches raw uploads that did not tell a
+// coordinator ID, latest first.
+func getUnidentifiedUploads(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	q, ok := uploadQueryOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := searchUploads("", q)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getFirmwares(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	list, err := firmwares()
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func firmwareOfRequest(w http.ResponseWriter, r *http.Request) (*firmware, bool) {
+	vars := mux.Vars(r)
+	f, err := loadFirmware(vars["hardware_revision"], vars["version"])
+	if err != nil {
+		if _, ok := err.(unknownFirmwareError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return f, true
+}
+
+func getFirmware(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	f, ok := firmwareOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// postFirmware uploads a firmware image as request body. When checksum is
+// given, it must match SHA-256 of the image.
+func postFirmware(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	defer r.Body.Close()
+	image, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFirmwareSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	f, err := saveFirmware(vars["hardware_revision"], vars["version"], r.FormValue("checksum"), image)
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func deleteFirmwareByID(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	f, ok := firmwareOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := deleteFirmware(f.HardwareRevision, f.Version); err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getRollouts(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	list, err := rollouts()
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func rolloutOfRequest(w http.ResponseWriter, r *http.Request) (*rollout, bool) {
+	ro, err := loadRollout(mux.Vars(r)["rollout_id"])
+	if err != nil {
+		if _, ok := err.(unknownRolloutError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return ro, true
+}
+
+// writeRolloutStatus writes the rollout with update status of each of its
+// coordinators.
+func writeRolloutStatus(w http.ResponseWriter, ro *rollout) {
+	status, err := ro.status()
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getRollout(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	ro, ok := rolloutOfRequest(w, r)
+	if !ok {
+		return
+	}
+	writeRolloutStatus(w, ro)
+}
+
+func putRollout(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ro rollout
+	if err := json.Unmarshal(b, &ro); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ro.ID = mux.Vars(r)["rollout_id"]
+
+	if err := ro.save(); err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeRolloutStatus(w, &ro)
+}
+
+// postRolloutAction advances, pauses, resumes or cancels the rollout.
+func postRolloutAction(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	ro, ok := rolloutOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ro.apply(mux.Vars(r)["action"]); err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeRolloutStatus(w, ro)
+}
+
+// getDeadLetters lists failed uploads, latest first, optionally of a
+// coordinator or a stage.
+func getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	offset, limit, ok := pageOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := deadLetters(r.FormValue("coordinator_id"), r.FormValue("stage"))
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offset > len(list) {
+		offset = len(list)
+	}
+	list = list[offset:]
+	if len(list) > limit {
+		list = list[:limit]
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func deadLetterOfRequest(w http.ResponseWriter, r *http.Request) (*deadLetter, bool) {
+	dl, err := loadDeadLetter(mux.Vars(r)["dead_letter_id"])
+	if err != nil {
+		if _, ok := err.(unknownDeadLetterError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return dl, true
+}
+
+func getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	dl, ok := deadLetterOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := json.Marshal(dl)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// putDeadLetter replaces the upload of a dead letter with the request body.
+func putDeadLetter(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	dl, ok := deadLetterOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dl, err = editDeadLetter(dl.ID, body)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(dl)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func deleteDeadLetterByID(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	dl, ok := deadLetterOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := deleteDeadLetter(dl.ID); err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// postRequeueDeadLetter processes the upload of a dead letter again.
+func postRequeueDeadLetter(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	dl, ok := deadLetterOfRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := requeueDeadLetter(dl.ID)
+	if err != nil {
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// getIngestStats returns depth and counters of the ingestion queue.
+func getIngestStats(w http.ResponseWriter, r *http.Request) {
+	log.Println(r)
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	b, err := json.Marshal(ingest.stats())
+	if err != nil {
+		bugsnag.Notify(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 	w.Write(b)
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// A column mapping tells which sensor and channel the values of a CSV
+// column belong to. Sensor ID is taken from the row when it's empty.
+type columnMapping struct {
+	sensorID string
+	channel  string
+}
+
+type importOptions struct {
+	format      string
+	sensorID    string // used when file has no sensor_id column
+	timeColumn  string
+	columns     map[string]columnMapping
+	raw         bool // values are raw readings to be converted like uploads are
+	dryRun      bool
+	skipInvalid bool // import valid rows even if some rows are invalid
+}
+
+type importError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type importReport struct {
+	Rows       int            `json:"rows"`
+	Imported   int            `json:"imported"`
+	Duplicates int            `json:"duplicates"`
+	Invalid    int            `json:"invalid"`
+	DryRun     bool           `json:"dry_run,omitempty"`
+	Errors     []*importError `json:"errors,omitempty"`
+}
+
+type importRow struct {
+	row      int
+	sensorID string
+	datetime time.Time
+	values   map[string]float64
+}
+
+func (opts *importOptions) validate() error {
+	if len(opts.format) == 0 {
+		opts.format = exportFormatCSV
+	}
+	if opts.format != exportFormatCSV && opts.format != exportFormatNDJSON {
+		return errors.New("format must be csv or ndjson")
+	}
+	if len(opts.timeColumn) == 0 {
+		opts.timeColumn = "time"
+	}
+	return nil
+}
+
+// parseColumnMappings parses mappings in form "column=sensor:channel" or
+// "column=channel", separated by commas.
+func parseColumnMappings(s string) (map[string]columnMapping, error) {
+	result := make(map[string]columnMapping)
+	for _, item := range parseList(s) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("Invalid column mapping %s", item)
+		}
+		var m columnMapping
+		target := strings.SplitN(parts[1], ":", 2)
+		if len(target) == 2 {
+			m.sensorID, m.channel = target[0], target[1]
+		} else {
+			m.channel = target[0]
+		}
+		if len(m.channel) == 0 {
+			return nil, fmt.Errorf("Missing channel in column mapping %s", item)
+		}
+		result[parts[0]] = m
+	}
+	return result, nil
+}
+
+func parseImportTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// readImportRows parses rows of the file. A CSV row can contain readings
+// of several sensors, so it may produce several import rows.
+func readImportRows(r io.Reader, opts *importOptions) ([]*importRow, []*importError, error) {
+	switch opts.format {
+	case exportFormatCSV:
+		return readImportCSV(r, opts)
+	case exportFormatNDJSON:
+		return readImportNDJSON(r, opts)
+	}
+	return nil, nil, fmt.Errorf("Unsupported import format %s", opts.format)
+}
+
+func readImportCSV(r io.Reader, opts *importOptions) ([]*importRow, []*importError, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeIndex, sensorIndex := -1, -1
+	for i, name := range header {
+		switch name {
+		case opts.timeColumn:
+			timeIndex = i
+		case "sensor_id":
+			sensorIndex = i
+		}
+	}
+	if timeIndex < 0 {
+		return nil, nil, fmt.Errorf("Missing time column %s", opts.timeColumn)
+	}
+
+	var rows []*importRow
+	var errs []*importError
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, &importError{Row: line, Error: err.Error()})
+			continue
+		}
+		if len(record) != len(header) {
+			errs = append(errs, &importError{Row: line, Error: fmt.Sprintf("%d fields expected, got %d", len(header), len(record))})
+			continue
+		}
+
+		datetime, err := parseImportTime(record[timeIndex])
+		if err != nil {
+			errs = append(errs, &importError{Row: line, Error: "Invalid time: " + err.Error()})
+			continue
+		}
+		rowSensorID := opts.sensorID
+		if sensorIndex >= 0 {
+			rowSensorID = record[sensorIndex]
+		}
+
+		bySensor := make(map[string]*importRow)
+		var rowErr error
+		for i, value := range record {
+			if i == timeIndex || i == sensorIndex || len(value) == 0 {
+				continue
+			}
+			m, ok := opts.columns[header[i]]
+			if !ok {
+				m = columnMapping{channel: header[i]}
+			}
+			sensorID := m.sensorID
+			if len(sensorID) == 0 {
+				sensorID = rowSensorID
+			}
+			if len(sensorID) == 0 {
+				rowErr = fmt.Errorf("No sensor ID for column %s", header[i])
+				break
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				rowErr = fmt.Errorf("Invalid value of %s: %s", header[i], value)
+				break
+			}
+			ir, ok := bySensor[sensorID]
+			if !ok {
+				ir = &importRow{row: line, sensorID: sensorID, datetime: datetime, values: make(map[string]float64)}
+				bySensor[sensorID] = ir
+				rows = append(rows, ir)
+			}
+			ir.values[m.channel] = f
+		}
+		if rowErr != nil {
+			errs = append(errs, &importError{Row: line, Error: rowErr.Error()})
+			for sensorID := range bySensor {
+				rows = removeImportRow(rows, bySensor[sensorID])
+			}
+		}
+	}
+	return rows, errs, nil
+}
+
+func removeImportRow(rows []*importRow, row *importRow) []*importRow {
+	for i := range rows {
+		if rows[i] == row {
+			return append(rows[:i], rows[i+1:]...)
+		}
+	}
+	return rows
+}
+
+func readImportNDJSON(r io.Reader, opts *importOptions) ([]*importRow, []*importError, error) {
+	var rows []*importRow
+	var errs []*importError
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var er exportRow
+		if err := json.Unmarshal(scanner.Bytes(), &er); err != nil {
+			errs = append(errs, &importError{Row: line, Error: err.Error()})
+			continue
+		}
+		if len(er.SensorID) == 0 {
+			er.SensorID = opts.sensorID
+		}
+		if len(er.SensorID) == 0 {
+			errs = append(errs, &importError{Row: line, Error: "Missing sensor_id"})
+			continue
+		}
+		datetime, err := parseImportTime(er.Time)
+		if err != nil {
+			errs = append(errs, &importError{Row: line, Error: "Invalid time: " + err.Error()})
+			continue
+		}
+		if len(er.Values) == 0 {
+			errs = append(errs, &importError{Row: line, Error: "No values"})
+			continue
+		}
+		rows = append(rows, &importRow{row: line, sensorID: er.SensorID, datetime: datetime, values: er.Values})
+	}
+	return rows, errs, scanner.Err()
+}
+
+// buildTick turns an import row into a tick, validating the values
+// against the profile of the sensor.
+func (ir *importRow) buildTick(s *sensor, raw bool) (*tick, error) {
+	t := &tick{
+		SensorID: ir.sensorID,
+		Datetime: ir.datetime,
+		Version:  3,
+	}
+
+	channels := make(map[string]float64)
+	for name, value := range ir.values {
+		switch name {
+		case channelTemperature:
+			if raw {
+				t.setTemperatureFromSensorReading(value, s)
+			} else {
+				t.Temperature = value
+			}
+		case channelBatteryVoltage:
+			if raw {
+				t.setBatteryVoltageFromSensorReading(value, s)
+			} else {
+				t.BatteryVoltage = value
+			}
+		case channelCPUTemperature:
+			if raw {
+				t.setCPUTemperatureFromSensorReading(value, s)
+			} else {
+				t.CPUTemperature = floatPtr(value)
+			}
+		case channelMoistureRaw:
+			t.Humidity = int64(value)
+		case channelRadioQuality:
+			t.RadioQuality = int64(value)
+		case channelMoisture:
+			// calculated from moisture_raw when read
+			continue
+		default:
+			channels[name] = value
+		}
+		if !raw {
+			if cp, ok := s.profile.Channels[name]; ok && !cp.inRange(value) {
+				return nil, outOfRangeError{channel: name, value: value, unit: cp.Unit}
+			}
+		}
+	}
+
+	if raw {
+		t.setChannelsFromSensorReading(channels, s)
+	} else if len(channels) > 0 {
+		t.Channels = channels
+	}
+
+	if len(t.alerts) > 0 {
+		return nil, errors.New(t.alerts[0].Message)
+	}
+	return t, nil
+}
+
+func tickExists(sensorID string, datetime time.Time) (bool, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	n, err := redis.Int(redisClient.Do("ZCOUNT", keyOfSensorTicks(sensorID), datetime.Unix(), datetime.Unix()))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// importTicks validates all rows before writing anything. Unless invalid
+// rows are to be skipped, a single invalid row aborts the import. Ticks are
+// written in a single transaction.
+func importTicks(r io.Reader, opts *importOptions) (*importReport, error) {
+	rows, errs, err := readImportRows(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &importReport{DryRun: opts.dryRun}
+	sensors := make(map[string]*sensor)
+	seen := make(map[string]bool)
+	var ticks []*tick
+	for _, ir := range rows {
+		s, ok := sensors[ir.sensorID]
+		if !ok {
+			s, err = loadSensor("", ir.sensorID)
+			if err != nil {
+				return nil, err
+			}
+			sensors[ir.sensorID] = s
+		}
+
+		t, err := ir.buildTick(s, opts.raw)
+		if err != nil {
+			errs = append(errs, &importError{Row: ir.row, Error: err.Error()})
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%d", t.SensorID, t.Datetime.Unix())
+		if seen[key] {
+			report.Duplicates++
+			continue
+		}
+		seen[key] = true
+
+		exists, err := tickExists(t.SensorID, t.Datetime)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			report.Duplicates++
+			continue
+		}
+		ticks = append(ticks, t)
+	}
+
+	allRows := make(map[int]bool)
+	for _, ir := range rows {
+		allRows[ir.row] = true
+	}
+	invalidRows := make(map[int]bool)
+	for _, e := range errs {
+		allRows[e.Row] = true
+		invalidRows[e.Row] = true
+	}
+	report.Rows = len(allRows)
+	report.Invalid = len(invalidRows)
+	report.Errors = errs
+
+	if opts.dryRun || (len(errs) > 0 && !opts.skipInvalid) {
+		return report, nil
+	}
+
+	if err := saveImportedTicks(ticks); err != nil {
+		return nil, err
+	}
+	report.Imported = len(ticks)
+	return report, nil
+}
+
+func saveImportedTicks(ticks []*tick) error {
+	if len(ticks) == 0 {
+		return nil
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	tx := multi(redisClient)
+	for _, t := range ticks {
+		b, err := json.Marshal(t)
+		if err != nil {
+			tx.fail(err)
+			break
+		}
+		tx.send("ZADD", keyOfSensorTicks(t.SensorID), t.Datetime.Unix(), b)
+		for name := range t.Channels {
+			tx.send("SADD", keyOfSensorChannels(t.SensorID), name)
+		}
+	}
+	_, err := tx.exec()
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestParseColumnMappings(c *C) {
+	m, err := parseColumnMappings("t1=1A001:temperature, hum=moisture_raw")
+	c.Assert(err, IsNil)
+	c.Assert(m["t1"], Equals, columnMapping{sensorID: "1A001", channel: "temperature"})
+	c.Assert(m["hum"], Equals, columnMapping{channel: "moisture_raw"})
+
+	_, err = parseColumnMappings("t1")
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *TestSuite) TestReadImportCSV(c *C) {
+	opts := &importOptions{
+		format:   exportFormatCSV,
+		sensorID: "1A001",
+		columns: map[string]columnMapping{
+			"t2": {sensorID: "1A002", channel: channelTemperature},
+		},
+	}
+	c.Assert(opts.validate(), IsNil)
+
+	in := "time,temperature,t2\n" +
+		"1414800000,20.5,21\n" +
+		"2014-11-01T01:00:00Z,19,\n" +
+		"1414807200,x,1\n" +
+		"bad,1,2\n"
+	rows, errs, err := readImportRows(strings.NewReader(in), opts)
+	c.Assert(err, IsNil)
+	c.Assert(len(rows), Equals, 3)
+	c.Assert(rows[0].sensorID, Equals, "1A001")
+	c.Assert(rows[0].values, DeepEquals, map[string]float64{channelTemperature: 20.5})
+	c.Assert(rows[1].sensorID, Equals, "1A002")
+	c.Assert(rows[2].row, Equals, 3)
+	c.Assert(rows[2].datetime.Unix(), Equals, int64(1414803600))
+
+	c.Assert(len(errs), Equals, 2)
+	c.Assert(errs[0].Row, Equals, 4)
+	c.Assert(errs[1].Row, Equals, 5)
+}
+
+func (s *TestSuite) TestReadImportNDJSON(c *C) {
+	opts := &importOptions{format: exportFormatNDJSON}
+	c.Assert(opts.validate(), IsNil)
+
+	in := `{"sensor_id":"1A001","time":"2014-11-01T00:00:00Z","values":{"temperature":20,"co2":400}}` + "\n" +
+		`{"time":"2014-11-01T00:00:00Z","values":{"temperature":20}}` + "\n"
+	rows, errs, err := readImportRows(strings.NewReader(in), opts)
+	c.Assert(err, IsNil)
+	c.Assert(len(rows), Equals, 1)
+	c.Assert(len(errs), Equals, 1)
+	c.Assert(errs[0].Row, Equals, 2)
+}
+
+func (s *TestSuite) TestImportRowBuildTick(c *C) {
+	sensor := &sensor{profile: builtinSensorProfiles[defaultSensorProfile]}
+
+	ir := &importRow{sensorID: "1A001", values: map[string]float64{channelTemperature: 621, channelMoistureRaw: 92, "co2": 400}}
+	t, err := ir.buildTick(sensor, true)
+	c.Assert(err, IsNil)
+	c.Assert(t.Temperature, Equals, float64(20.233199999999997))
+	c.Assert(t.RawTemperature, Equals, float64(621))
+	c.Assert(t.Humidity, Equals, int64(92))
+	c.Assert(t.Channels["co2"], Equals, float64(400))
+
+	ir.values[channelTemperature] = 200
+	_, err = ir.buildTick(sensor, false)
+	c.Assert(err, FitsTypeOf, outOfRangeError{})
+
+	ir.values[channelTemperature] = 2
+	_, err = ir.buildTick(sensor, true)
+	c.Assert(err, Not(IsNil))
+}
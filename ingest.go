@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Coordinators refused because the server is busy are told to retry after
+// this many seconds.
+const ingestRetryAfter = 60
+
+var errIngestQueueFull = errors.New("Server is busy, try again later")
+
+// An ingestQueue processes uploads with a fixed number of workers, so that
+// a burst of connections does not overwhelm Redis. When the queue is full,
+// an upload waits for room up to the given time and is refused after that.
+type ingestQueue struct {
+	handler uploadHandler
+	jobs    chan *ingestJob
+	workers int
+	wait    time.Duration
+
+	busy      int64
+	maxDepth  int64
+	accepted  int64
+	delayed   int64
+	refused   int64
+	processed int64
+}
+
+type ingestJob struct {
+	buf    *bytes.Buffer
+	src    *uploadSource
+	result chan *ingestResult
+}
+
+type ingestResult struct {
+	u   *upload
+	err error
+}
+
+// Counters of an ingestion queue since the server was started. Delayed
+// uploads had to wait for room in the queue.
+type ingestStats struct {
+	Workers       int   `json:"workers"`
+	Busy          int64 `json:"busy"`
+	QueueDepth    int   `json:"queue_depth"`
+	QueueSize     int   `json:"queue_size"`
+	MaxQueueDepth int64 `json:"max_queue_depth"`
+	Accepted      int64 `json:"accepted"`
+	Delayed       int64 `json:"delayed"`
+	Refused       int64 `json:"refused"`
+	Processed     int64 `json:"processed"`
+}
+
+// The ingestion queue of the server, uploads over TCP and HTTP go through
+// it.
+var ingest *ingestQueue
+
+func newIngestQueue(handler uploadHandler, workers, size int, wait time.Duration) *ingestQueue {
+	q := &ingestQueue{
+		handler: handler,
+		jobs:    make(chan *ingestJob, size),
+		workers: workers,
+		wait:    wait,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *ingestQueue) work() {
+	for job := range q.jobs {
+		atomic.AddInt64(&q.busy, 1)
+		u, err := q.handler(job.buf, job.src)
+		atomic.AddInt64(&q.busy, -1)
+		atomic.AddInt64(&q.processed, 1)
+		job.result <- &ingestResult{u: u, err: err}
+	}
+}
+
+// submit queues the upload and waits until it has been processed. It's an
+// uploadHandler itself. When the queue stays full, errIngestQueueFull is
+// returned.
+func (q *ingestQueue) submit(buf *bytes.Buffer, src *uploadSource) (*upload, error) {
+	job := &ingestJob{buf: buf, src: src, result: make(chan *ingestResult, 1)}
+	select {
+	case q.jobs <- job:
+	default:
+		atomic.AddInt64(&q.delayed, 1)
+		timer := time.NewTimer(q.wait)
+		select {
+		case q.jobs <- job:
+			timer.Stop()
+		case <-timer.C:
+			atomic.AddInt64(&q.refused, 1)
+			return nil, errIngestQueueFull
+		}
+	}
+	atomic.AddInt64(&q.accepted, 1)
+	depth := int64(len(q.jobs))
+	for {
+		max := atomic.LoadInt64(&q.maxDepth)
+		if depth <= max || atomic.CompareAndSwapInt64(&q.maxDepth, max, depth) {
+			break
+		}
+	}
+
+	r := <-job.result
+	return r.u, r.err
+}
+
+func (q *ingestQueue) stats() *ingestStats {
+	return &ingestStats{
+		Workers:       q.workers,
+		Busy:          atomic.LoadInt64(&q.busy),
+		QueueDepth:    len(q.jobs),
+		QueueSize:     cap(q.jobs),
+		MaxQueueDepth: atomic.LoadInt64(&q.maxDepth),
+		Accepted:      atomic.LoadInt64(&q.accepted),
+		Delayed:       atomic.LoadInt64(&q.delayed),
+		Refused:       atomic.LoadInt64(&q.refused),
+		Processed:     atomic.LoadInt64(&q.processed),
+	}
+}
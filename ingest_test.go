@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestIngestQueue(c *C) {
+	release := make(chan bool)
+	started := make(chan bool, 10)
+	handler := func(buf *bytes.Buffer, src *uploadSource) (*upload, error) {
+		started <- true
+		<-release
+		return &upload{response: newUploadResponse()}, nil
+	}
+	q := newIngestQueue(handler, 1, 1, 50*time.Millisecond)
+
+	done := make(chan error, 2)
+	submit := func() {
+		_, err := q.submit(bytes.NewBufferString("{}"), nil)
+		done <- err
+	}
+	go submit()
+	<-started // the worker is busy
+	go submit()
+	for len(q.jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := q.submit(bytes.NewBufferString("{}"), nil)
+	c.Assert(err, Equals, errIngestQueueFull)
+
+	stats := q.stats()
+	c.Assert(stats.Busy, Equals, int64(1))
+	c.Assert(stats.QueueDepth, Equals, 1)
+	c.Assert(stats.MaxQueueDepth, Equals, int64(1))
+	c.Assert(stats.Delayed, Equals, int64(1))
+	c.Assert(stats.Refused, Equals, int64(1))
+
+	close(release)
+	c.Assert(<-done, IsNil)
+	c.Assert(<-done, IsNil)
+
+	stats = q.stats()
+	c.Assert(stats.Accepted, Equals, int64(2))
+	c.Assert(stats.Processed, Equals, int64(2))
+	c.Assert(stats.QueueDepth, Equals, 0)
+}
+
+func (s *TestSuite) TestSaveTicksOfUpload(c *C) {
+	now := time.Now()
+	ticks := []*tick{
+		{SensorID: "5B001", Datetime: now, Temperature: 10, Channels: map[string]float64{"co2": 400}, coordinatorID: "50"},
+		{SensorID: "5B001", Datetime: now.Add(time.Second), Temperature: 11, Channels: map[string]float64{"light": 10}, coordinatorID: "50"},
+		{SensorID: "5B002", Datetime: now, Temperature: 12, coordinatorID: "50"},
+	}
+	c.Assert(saveTicks(ticks), IsNil)
+
+	stored, err := findTicksByRange("5B001", 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(len(stored), Equals, 2)
+	sensorIDs, err := sensorIDsOfCoordinator("50")
+	c.Assert(err, IsNil)
+	c.Assert(len(sensorIDs), Equals, 2)
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+	channels, err := redis.Strings(redisClient.Do("SMEMBERS", keyOfSensorChannels("5B001")))
+	c.Assert(err, IsNil)
+	sort.Strings(channels)
+	c.Assert(channels, DeepEquals, []string{"co2", "light"})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	labelFormatPNG = "png"
+	labelFormatSVG = "svg"
+)
+
+// Light modules around a QR code, in modules.
+const qrQuietZone = 4
+
+// Options of printing sensor labels. Each label has a QR code of the
+// payload and the sensor ID below it. Labels are laid out in a grid of
+// columns and rows per sheet, label size is in pixels.
+type labelOptions struct {
+	series    string
+	start     int
+	end       int
+	payload   string
+	format    string
+	output    string
+	labelSize int
+	columns   int
+	rows      int
+	level     qrLevel
+}
+
+type label struct {
+	text string
+	qr   *qrCode
+}
+
+func (opts *labelOptions) validate() error {
+	if err := validateSeries(opts.series, opts.start, opts.end, opts.payload); err != nil {
+		return err
+	}
+	if opts.format != labelFormatPNG && opts.format != labelFormatSVG {
+		return fmt.Errorf("Label format must be %s or %s", labelFormatPNG, labelFormatSVG)
+	}
+	if opts.columns < 1 || opts.rows < 1 {
+		return errors.New("Label grid needs at least one column and row")
+	}
+	if opts.labelSize < 1 {
+		return errors.New("Invalid label size")
+	}
+	return nil
+}
+
+// makeLabels encodes labels of the sensors of the series.
+func makeLabels(opts *labelOptions) ([]*label, error) {
+	var result []*label
+	for n := opts.start; n <= opts.end; n++ {
+		sensorID := seriesSensorID(opts.series, n)
+		qr, err := encodeQR([]byte(fmt.Sprintf(opts.payload, sensorID)), opts.level)
+		if err != nil {
+			return nil, err
+		}
+		if labelModuleSize(opts.labelSize, qr) < 1 {
+			return nil, fmt.Errorf("Label size %d is too small for QR code of %d modules", opts.labelSize, qr.size)
+		}
+		result = append(result, &label{text: sensorID, qr: qr})
+	}
+	return result, nil
+}
+
+// The sensor ID is printed on the bottom band of a label, the QR code
+// fills the square above it.
+func labelTextBand(labelSize int) int {
+	return labelSize / 6
+}
+
+func labelModuleSize(labelSize int, qr *qrCode) int {
+	return (labelSize - labelTextBand(labelSize)) / (qr.size + 2*qrQuietZone)
+}
+
+// writeLabelSheets writes the labels into sheets of the grid and returns
+// the file names.
+func writeLabelSheets(labels []*label, opts *labelOptions) ([]string, error) {
+	if err := os.MkdirAll(opts.output, 0777); err != nil {
+		return nil, err
+	}
+	perSheet := opts.columns * opts.rows
+	var result []string
+	for page := 0; page*perSheet < len(labels); page++ {
+		end := (page + 1) * perSheet
+		if end > len(labels) {
+			end = len(labels)
+		}
+		filename := filepath.Join(opts.output, fmt.Sprintf("labels-%s-%d.%s", opts.series, page+1, opts.format))
+		if err := writeLabelSheet(filename, labels[page*perSheet:end], opts); err != nil {
+			return nil, err
+		}
+		result = append(result, filename)
+	}
+	return result, nil
+}
+
+func writeLabelSheet(filename string, labels []*label, opts *labelOptions) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if opts.format == labelFormatSVG {
+		err = writeLabelsSVG(w, labels, opts)
+	} else {
+		err = writeLabelsPNG(w, labels, opts)
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// labelOrigin returns top left corner of the nth label of a sheet.
+func labelOrigin(n int, opts *labelOptions) (int, int) {
+	return n % opts.columns * opts.labelSize, n / opts.columns * opts.labelSize
+}
+
+// qrOrigin returns the top left corner of the first module of the QR code
+// of a label, and the module size.
+func qrOrigin(x, y int, l *label, opts *labelOptions) (int, int, int) {
+	moduleSize := labelModuleSize(opts.labelSize, l.qr)
+	side := (l.qr.size + 2*qrQuietZone) * moduleSize
+	area := opts.labelSize - labelTextBand(opts.labelSize)
+	offset := (area-side)/2 + qrQuietZone*moduleSize
+	return x + (opts.labelSize-side)/2 + qrQuietZone*moduleSize, y + offset, moduleSize
+}
+
+func sheetSize(labels []*label, opts *labelOptions) (int, int) {
+	rows := (len(labels) + opts.columns - 1) / opts.columns
+	return opts.columns * opts.labelSize, rows * opts.labelSize
+}
+
+func writeLabelsPNG(w io.Writer, labels []*label, opts *labelOptions) error {
+	width, height := sheetSize(labels, opts)
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	fill := func(x, y, w, h int) {
+		for yy := y; yy < y+h; yy++ {
+			for xx := x; xx < x+w; xx++ {
+				img.SetGray(xx, yy, color.Gray{})
+			}
+		}
+	}
+
+	for n, l := range labels {
+		x, y := labelOrigin(n, opts)
+		qx, qy, moduleSize := qrOrigin(x, y, l, opts)
+		for my := 0; my < l.qr.size; my++ {
+			for mx := 0; mx < l.qr.size; mx++ {
+				if l.qr.dark(mx, my) {
+					fill(qx+mx*moduleSize, qy+my*moduleSize, moduleSize, moduleSize)
+				}
+			}
+		}
+
+		band := labelTextBand(opts.labelSize)
+		scale := textScale(l.text, opts.labelSize, band)
+		textWidth := len(l.text)*(glyphWidth+1)*scale - scale
+		tx := x + (opts.labelSize-textWidth)/2
+		ty := y + opts.labelSize - band + (band-glyphHeight*scale)/2
+		for _, c := range strings.ToUpper(l.text) {
+			glyph := labelFont[c]
+			for gy, row := range glyph {
+				for gx, dot := range row {
+					if dot == '#' {
+						fill(tx+gx*scale, ty+gy*scale, scale, scale)
+					}
+				}
+			}
+			tx += (glyphWidth + 1) * scale
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// textScale returns the largest scale of the bitmap font at which the text
+// fits in the text band of a label.
+func textScale(text string, labelSize, band int) int {
+	scale := band * 2 / 3 / glyphHeight
+	if n := len(text); n > 0 {
+		if fit := labelSize * 9 / 10 / (n*(glyphWidth+1) - 1); fit < scale {
+			scale = fit
+		}
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	return scale
+}
+
+func writeLabelsSVG(w io.Writer, labels []*label, opts *labelOptions) error {
+	width, height := sheetSize(labels, opts)
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		width, height, width, height)
+	fmt.Fprintf(w, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", width, height)
+
+	band := labelTextBand(opts.labelSize)
+	for n, l := range labels {
+		x, y := labelOrigin(n, opts)
+		qx, qy, moduleSize := qrOrigin(x, y, l, opts)
+		var path []string
+		for my := 0; my < l.qr.size; my++ {
+			// runs of dark modules of a row are drawn as one rectangle
+			for mx := 0; mx < l.qr.size; mx++ {
+				if !l.qr.dark(mx, my) {
+					continue
+				}
+				run := 1
+				for l.qr.dark(mx+run, my) {
+					run++
+				}
+				path = append(path, fmt.Sprintf("M%d %dh%dv%dh-%dz",
+					qx+mx*moduleSize, qy+my*moduleSize, run*moduleSize, moduleSize, run*moduleSize))
+				mx += run
+			}
+		}
+		fmt.Fprintf(w, `<path d="%s" fill="#000"/>`+"\n", strings.Join(path, ""))
+
+		fontSize := textScale(l.text, opts.labelSize, band) * (glyphHeight + 2)
+		fmt.Fprintf(w, `<text x="%d" y="%d" font-family="Helvetica, Arial, sans-serif" font-size="%d" text-anchor="middle" dominant-baseline="middle">%s</text>`+"\n",
+			x+opts.labelSize/2, y+opts.labelSize-band/2, fontSize, svgEscape(l.text))
+	}
+	_, err := io.WriteString(w, "</svg>\n")
+	return err
+}
+
+func svgEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// A 5x7 bitmap font for sensor IDs in PNG labels. Lower case letters are
+// printed in upper case, other characters are left blank.
+var labelFont = map[rune][glyphHeight]string{
+	'0': {" ### ", "#   #", "#  ##", "# # #", "##  #", "#   #", " ### "},
+	'1': {"  #  ", " ##  ", "  #  ", "  #  ", "  #  ", "  #  ", " ### "},
+	'2': {" ### ", "#   #", "    #", "   # ", "  #  ", " #   ", "#####"},
+	'3': {"#####", "   # ", "  #  ", "   # ", "    #", "#   #", " ### "},
+	'4': {"   # ", "  ## ", " # # ", "#  # ", "#####", "   # ", "   # "},
+	'5': {"#####", "#    ", "#### ", "    #", "    #", "#   #", " ### "},
+	'6': {"  ## ", " #   ", "#    ", "#### ", "#   #", "#   #", " ### "},
+	'7': {"#####", "    #", "   # ", "  #  ", " #   ", " #   ", " #   "},
+	'8': {" ### ", "#   #", "#   #", " ### ", "#   #", "#   #", " ### "},
+	'9': {" ### ", "#   #", "#   #", " ####", "    #", "   # ", " ##  "},
+	'A': {" ### ", "#   #", "#   #", "#####", "#   #", "#   #", "#   #"},
+	'B': {"#### ", "#   #", "#   #", "#### ", "#   #", "#   #", "#### "},
+	'C': {" ### ", "#   #", "#    ", "#    ", "#    ", "#   #", " ### "},
+	'D': {"#### ", "#   #", "#   #", "#   #", "#   #", "#   #", "#### "},
+	'E': {"#####", "#    ", "#    ", "#### ", "#    ", "#    ", "#####"},
+	'F': {"#####", "#    ", "#    ", "#### ", "#    ", "#    ", "#    "},
+	'G': {" ### ", "#   #", "#    ", "# ###", "#   #", "#   #", " ####"},
+	'H': {"#   #", "#   #", "#   #", "#####", "#   #", "#   #", "#   #"},
+	'I': {" ### ", "  #  ", "  #  ", "  #  ", "  #  ", "  #  ", " ### "},
+	'J': {"  ###", "   # ", "   # ", "   # ", "   # ", "#  # ", " ##  "},
+	'K': {"#   #", "#  # ", "# #  ", "##   ", "# #  ", "#  # ", "#   #"},
+	'L': {"#    ", "#    ", "#    ", "#    ", "#    ", "#    ", "#####"},
+	'M': {"#   #", "## ##", "# # #", "# # #", "#   #", "#   #", "#   #"},
+	'N': {"#   #", "#   #", "##  #", "# # #", "#  ##", "#   #", "#   #"},
+	'O': {" ### ", "#   #", "#   #", "#   #", "#   #", "#   #", " ### "},
+	'P': {"#### ", "#   #", "#   #", "#### ", "#    ", "#    ", "#    "},
+	'Q': {" ### ", "#   #", "#   #", "#   #", "# # #", "#  # ", " ## #"},
+	'R': {"#### ", "#   #", "#   #", "#### ", "# #  ", "#  # ", "#   #"},
+	'S': {" ####", "#    ", "#    ", " ### ", "    #", "    #", "#### "},
+	'T': {"#####", "  #  ", "  #  ", "  #  ", "  #  ", "  #  ", "  #  "},
+	'U': {"#   #", "#   #", "#   #", "#   #", "#   #", "#   #", " ### "},
+	'V': {"#   #", "#   #", "#   #", "#   #", "#   #", " # # ", "  #  "},
+	'W': {"#   #", "#   #", "#   #", "# # #", "# # #", "# # #", " # # "},
+	'X': {"#   #", "#   #", " # # ", "  #  ", " # # ", "#   #", "#   #"},
+	'Y': {"#   #", "#   #", " # # ", "  #  ", "  #  ", "  #  ", "  #  "},
+	'Z': {"#####", "    #", "   # ", "  #  ", " #   ", "#    ", "#####"},
+	'-': {"     ", "     ", "     ", "#####", "     ", "     ", "     "},
+	'_': {"     ", "     ", "     ", "     ", "     ", "     ", "#####"},
+	'.': {"     ", "     ", "     ", "     ", "     ", " ##  ", " ##  "},
+	':': {"     ", " ##  ", " ##  ", "     ", " ##  ", " ##  ", "     "},
+}
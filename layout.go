@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const keyLayouts = "osp:layouts"
+
+const maxHeatmapCells = 100000
+
+// Power of inverse distance weighting. Higher values make the heatmap
+// follow the nearest sensor more closely.
+const idwPower = 2
+
+// A layout places sensors on a floor plan, or inside a stack when it has
+// depth. Positions are in the units of the layout, for example metres.
+type layout struct {
+	ID        string               `json:"id"`
+	Label     string               `json:"label"`
+	Width     float64              `json:"width"`
+	Height    float64              `json:"height"`
+	Depth     float64              `json:"depth,omitempty"` // 2D layout when zero
+	Positions map[string]*position `json:"positions"`
+}
+
+type position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z,omitempty"`
+}
+
+type unknownLayoutError string
+
+func (e unknownLayoutError) Error() string {
+	return fmt.Sprintf("Unknown layout %s", string(e))
+}
+
+// A heatmap holds values interpolated to the centres of the cells of a
+// grid. Values are indexed by z, y and x.
+type heatmap struct {
+	LayoutID string          `json:"layout_id"`
+	Channel  string          `json:"channel"`
+	Time     time.Time       `json:"time"`
+	Size     [3]int          `json:"size"` // cells along x, y and z
+	Points   []*heatmapPoint `json:"points"`
+	Values   [][][]float64   `json:"values"` // null when no sensor has a reading
+}
+
+// A heatmap point is a reading of a sensor the heatmap is interpolated from.
+type heatmapPoint struct {
+	SensorID string    `json:"sensor_id"`
+	Position *position `json:"position"`
+	Time     time.Time `json:"time"`
+	Value    float64   `json:"value"`
+}
+
+// A layoutError tells that a layout or a heatmap of it is not valid.
+type layoutError string
+
+func (e layoutError) Error() string {
+	return string(e)
+}
+
+func (l *layout) validate() error {
+	if len(l.ID) == 0 {
+		return layoutError("Missing layout ID")
+	}
+	if len(l.Label) == 0 {
+		l.Label = l.ID
+	}
+	if l.Width <= 0 {
+		return layoutError("Layout width must be positive")
+	}
+	if l.Height <= 0 {
+		return layoutError("Layout height must be positive")
+	}
+	if l.Depth < 0 {
+		return layoutError("Layout depth cannot be negative")
+	}
+	if len(l.Positions) > maxComparedSensors {
+		return layoutError(fmt.Sprintf("Layout cannot have more than %d sensors", maxComparedSensors))
+	}
+	for sensorID, p := range l.Positions {
+		if p == nil {
+			return layoutError(fmt.Sprintf("Missing position of sensor %s", sensorID))
+		}
+		if p.X < 0 || p.X > l.Width || p.Y < 0 || p.Y > l.Height || p.Z < 0 || p.Z > l.Depth {
+			return layoutError(fmt.Sprintf("Position of sensor %s is outside the layout", sensorID))
+		}
+	}
+	return nil
+}
+
+func loadLayout(layoutID string) (*layout, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyLayouts, layoutID))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, unknownLayoutError(layoutID)
+		}
+		return nil, err
+	}
+
+	var l layout
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (l *layout) save() error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keyLayouts, l.ID, b)
+	return err
+}
+
+func deleteLayout(layoutID string) error {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	n, err := redis.Int(redisClient.Do("HDEL", keyLayouts, layoutID))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return unknownLayoutError(layoutID)
+	}
+	return nil
+}
+
+func layouts() ([]*layout, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyLayouts))
+	if err != nil {
+		return nil, err
+	}
+	var result []*layout
+	for _, value := range bb {
+		var l layout
+		if err := json.Unmarshal(value.([]byte), &l); err != nil {
+			return nil, err
+		}
+		result = append(result, &l)
+	}
+
+	sort.Sort(byLayoutID(result))
+	return result, nil
+}
+
+type byLayoutID []*layout
+
+func (a byLayoutID) Len() int           { return len(a) }
+func (a byLayoutID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLayoutID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// heatmapPoints finds the last reading of each sensor of the layout that
+// is at most maxAge older than the given time.
+func (l *layout) heatmapPoints(channel string, at time.Time, maxAge time.Duration) ([]*heatmapPoint, error) {
+	var sensorIDs []string
+	for sensorID := range l.Positions {
+		sensorIDs = append(sensorIDs, sensorID)
+	}
+	sort.Strings(sensorIDs)
+
+	var points []*heatmapPoint
+	for _, sensorID := range sensorIDs {
+		ticks, err := findTicksByScore(sensorID, int(at.Add(-maxAge).Unix()), int(at.Unix()))
+		if err != nil {
+			return nil, err
+		}
+		if err := setMoisture(sensorID, ticks); err != nil {
+			return nil, err
+		}
+		for i := len(ticks) - 1; i >= 0; i-- {
+			if value, ok := ticks[i].channelValues()[channel]; ok {
+				points = append(points, &heatmapPoint{
+					SensorID: sensorID,
+					Position: l.Positions[sensorID],
+					Time:     ticks[i].Datetime,
+					Value:    value,
+				})
+				break
+			}
+		}
+	}
+	return points, nil
+}
+
+// interpolate fills a grid of given size over the layout using inverse
+// distance weighting of the points.
+func (l *layout) interpolate(points []*heatmapPoint, size [3]int) [][][]float64 {
+	if len(points) == 0 {
+		return nil
+	}
+	cellWidth := l.Width / float64(size[0])
+	cellHeight := l.Height / float64(size[1])
+	cellDepth := l.Depth / float64(size[2])
+
+	values := make([][][]float64, size[2])
+	for z := range values {
+		values[z] = make([][]float64, size[1])
+		for y := range values[z] {
+			values[z][y] = make([]float64, size[0])
+			for x := range values[z][y] {
+				values[z][y][x] = inverseDistanceWeighting(points, &position{
+					X: (float64(x) + 0.5) * cellWidth,
+					Y: (float64(y) + 0.5) * cellHeight,
+					Z: (float64(z) + 0.5) * cellDepth,
+				})
+			}
+		}
+	}
+	return values
+}
+
+func inverseDistanceWeighting(points []*heatmapPoint, at *position) float64 {
+	var sum, weights float64
+	for _, p := range points {
+		d := math.Sqrt(math.Pow(p.Position.X-at.X, 2) + math.Pow(p.Position.Y-at.Y, 2) + math.Pow(p.Position.Z-at.Z, 2))
+		if d == 0 {
+			return p.Value
+		}
+		w := 1 / math.Pow(d, idwPower)
+		sum += w * p.Value
+		weights += w
+	}
+	return sum / weights
+}
+
+func (l *layout) heatmap(channel string, at time.Time, maxAge time.Duration, size [3]int) (*heatmap, error) {
+	if l.Depth == 0 {
+		size[2] = 1
+	}
+	for i, name := range []string{"nx", "ny", "nz"} {
+		if size[i] < 1 {
+			return nil, layoutError(fmt.Sprintf("Heatmap %s must be positive", name))
+		}
+	}
+	// divided instead of multiplied, so that huge sizes cannot overflow
+	if size[0] > maxHeatmapCells/size[1]/size[2] {
+		return nil, layoutError(fmt.Sprintf("Heatmap cannot have more than %d cells", maxHeatmapCells))
+	}
+
+	points, err := l.heatmapPoints(channel, at, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &heatmap{
+		LayoutID: l.ID,
+		Channel:  channel,
+		Time:     at,
+		Size:     size,
+		Points:   points,
+		Values:   l.interpolate(points, size),
+	}, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestLayoutValidate(c *C) {
+	l := &layout{ID: "stack", Width: 10, Height: 5, Depth: 3, Positions: map[string]*position{
+		"1A001": {X: 1, Y: 1, Z: 1},
+	}}
+	c.Assert(l.validate(), IsNil)
+	c.Assert(l.Label, Equals, "stack")
+
+	l.Positions["1A002"] = &position{X: 11, Y: 1}
+	c.Assert(l.validate(), Not(IsNil))
+
+	l.Depth = 0
+	l.Positions = map[string]*position{"1A001": {X: 1, Y: 1, Z: 1}}
+	c.Assert(l.validate(), Not(IsNil))
+
+	l.Depth = -1
+	c.Assert(l.validate(), ErrorMatches, "Layout depth cannot be negative")
+}
+
+func (s *TestSuite) TestHeatmapSizeLimit(c *C) {
+	l := &layout{ID: "stack", Width: 10, Height: 5, Depth: 3}
+	_, err := l.heatmap(channelTemperature, time.Now(), time.Hour, [3]int{1 << 32, 1 << 32, 1})
+	c.Assert(err, ErrorMatches, "Heatmap cannot have more than .* cells")
+	c.Assert(isValidationError(err), Equals, true)
+
+	_, err = l.heatmap(channelTemperature, time.Now(), time.Hour, [3]int{20, 20, 0})
+	c.Assert(err, ErrorMatches, "Heatmap nz must be positive")
+}
+
+func (s *TestSuite) TestLayoutInterpolate(c *C) {
+	l := &layout{Width: 4, Height: 1}
+	points := []*heatmapPoint{
+		{Position: &position{X: 0.5, Y: 0.5}, Value: 10},
+		{Position: &position{X: 3.5, Y: 0.5}, Value: 20},
+	}
+	values := l.interpolate(points, [3]int{4, 1, 1})
+	c.Assert(len(values), Equals, 1)
+	c.Assert(len(values[0]), Equals, 1)
+	row := values[0][0]
+	c.Assert(row[0], Equals, float64(10))
+	c.Assert(row[3], Equals, float64(20))
+	c.Assert(row[1] > 10 && row[1] < 15, Equals, true)
+	c.Assert(row[1]+row[2], Equals, float64(30))
+
+	c.Assert(l.interpolate(nil, [3]int{4, 1, 1}), IsNil)
+}
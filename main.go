@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -31,10 +33,16 @@ var (
 	bugsnagAPIKey = flag.String("bugsnag_apikey", "", "")
 	adminUsername = flag.String("admin_username", "foo", "Admin API username")
 	adminPassword = flag.String("admin_password", "bar", "Admin API password")
+	tokenSecret   = flag.String("token_secret", "", "Secret coordinator tokens are derived from, without it tokens can be computed from coordinator IDs")
+
+	ingestWorkers         = flag.Int("ingest_workers", 8, "Number of uploads processed at a time")
+	ingestQueueSize       = flag.Int("ingest_queue", 100, "Number of uploads that can wait to be processed")
+	ingestQueueWait       = flag.Duration("ingest_queue_wait", 10*time.Second, "How long an upload waits for room in a full queue before it's refused")
+	uploadRetention       = flag.Duration("upload_retention", 30*24*time.Hour, "How long raw uploads of coordinators are archived")
+	calibrationMaxTickAge = flag.Duration("calibration_max_tick_age", 15*time.Minute, "Max age of the last tick that a calibration reference point can be paired with")
 )
 
 const socketTimeoutSeconds = 30
-const defaultCoordinatorID = "1"
 
 func main() {
 	flag.Parse()
@@ -44,6 +52,13 @@ func main() {
 	redisPool = getRedisPool(*redisHost)
 	defer redisPool.Close()
 
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	defineRoutes()
 
 	if err := os.Mkdir(filepath.Join(*workdir, "log"), 0755); err != nil {
@@ -58,9 +73,16 @@ func main() {
 		log.SetOutput(f)
 	}
 
+	if len(*tokenSecret) == 0 {
+		log.Println("No token secret given, coordinator tokens can be computed from coordinator IDs")
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	serveTCP("JSON", *jsonPort, handleJSONUpload)
+	go listenForEvents()
+
+	ingest = newIngestQueue(handleJSONUpload, *ingestWorkers, *ingestQueueSize, *ingestQueueWait)
+	serveTCP("JSON", *jsonPort, ingest.submit)
 
 	log.Println("API started on port", *webserverPort)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *webserverPort), http.DefaultServeMux))
@@ -70,9 +92,27 @@ type upload struct {
 	ticks    []*tick
 	cr       controllerReading
 	debugLog string
+	response *uploadResponse
 }
 
-type uploadHandler func(buf *bytes.Buffer) (*upload, error)
+// uploadResponse is sent back to the coordinator after its upload has been
+// processed. Clock offset is what the coordinator has to add to its clock
+// to be in time with the server.
+type uploadResponse struct {
+	ServerTime    time.Time          `json:"server_time"`
+	ClockOffset   *float64           `json:"clock_offset,omitempty"` // sec
+	Config        *coordinatorConfig `json:"config,omitempty"`       // settings to change
+	Firmware      *firmware          `json:"firmware,omitempty"`     // firmware to download
+	FirmwareChunk *firmwareChunk     `json:"firmware_chunk,omitempty"`
+	Error         string             `json:"error,omitempty"`       // when the request was invalid
+	RetryAfter    int                `json:"retry_after,omitempty"` // sec, when the server was busy
+}
+
+func newUploadResponse() *uploadResponse {
+	return &uploadResponse{ServerTime: time.Now()}
+}
+
+type uploadHandler func(buf *bytes.Buffer, src *uploadSource) (*upload, error)
 
 func serveTCP(name string, port int, handler uploadHandler) {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
@@ -96,7 +136,19 @@ func handleConnection(conn net.Conn, port int, handler uploadHandler) {
 	defer conn.Close()
 	log.Println("New connection on port", port)
 
-	ch := make(chan *bytes.Buffer, 1)
+	s := newSession(conn, port)
+	defer func() {
+		if err := s.finish(); err != nil {
+			bugsnag.Notify(err)
+		}
+	}()
+
+	// the upload read, partially when reading failed
+	type read struct {
+		buf *bytes.Buffer
+		err error
+	}
+	ch := make(chan read, 1)
 	go func() {
 		buf := &bytes.Buffer{}
 		for {
@@ -106,15 +158,16 @@ func handleConnection(conn net.Conn, port int, handler uploadHandler) {
 				if err == io.EOF {
 					break
 				}
-				bugsnag.Notify(err)
+				ch <- read{buf, err}
 				return
 			}
+			s.received(n)
 			buf.Write(b[:n])
 			if b[0] == 13 && b[1] == 10 {
 				break
 			}
 		}
-		ch <- buf
+		ch <- read{buf, nil}
 	}()
 
 	timeout := make(chan bool, 1)
@@ -123,23 +176,63 @@ func handleConnection(conn net.Conn, port int, handler uploadHandler) {
 		timeout <- true
 	}()
 
-	var buf *bytes.Buffer
+	var r read
 	select {
-	case buf = <-ch:
-		break
+	case r = <-ch:
 	case <-timeout:
+		// stop reading, and tell the session whose upload timed out
+		conn.SetReadDeadline(time.Now())
+		r = <-ch
+		if r.err == nil {
+			break
+		}
 		log.Println("Connection timeout!")
-		break
+		s.CoordinatorID = coordinatorIDOfUpload(r.buf.Bytes())
+		s.fail(sessionTimeout, nil)
+		return
 	}
+	if r.err != nil {
+		bugsnag.Notify(r.err)
+		s.CoordinatorID = coordinatorIDOfUpload(r.buf.Bytes())
+		s.fail(sessionReadError, r.err)
+		return
+	}
+	buf := r.buf
+
+	s.CoordinatorID = coordinatorIDOfUpload(buf.Bytes())
 
 	start := time.Now()
-	_, err := handler(buf)
-	if err != nil {
+	u, err := handler(buf, &uploadSource{RemoteAddr: s.RemoteAddr, Port: port, ConnectedAt: s.StartedAt})
+	if err == errIngestQueueFull {
+		log.Println("Refusing upload from", s.RemoteAddr, err)
+		s.fail(sessionRefused, err)
+		u = &upload{response: newUploadResponse()}
+		u.response.Error = err.Error()
+		u.response.RetryAfter = ingestRetryAfter
+	} else if err != nil && isValidationError(err) {
+		s.fail(sessionInvalid, err)
+		u = &upload{response: newUploadResponse()}
+		u.response.Error = err.Error()
+	} else if err != nil {
+		s.fail(sessionOutcomeOf(err), err)
 		bugsnag.Notify(err)
 		return
 	}
 
 	log.Println("Upload processed in", time.Since(start))
+
+	b, err := json.Marshal(u.response)
+	if err != nil {
+		s.fail(sessionStorageError, err)
+		bugsnag.Notify(err)
+		return
+	}
+	n, err := conn.Write(append(b, '\r', '\n'))
+	s.BytesSent = int64(n)
+	if err != nil {
+		s.fail(sessionWriteError, err)
+		log.Println("Cannot send upload response", err)
+	}
 }
 
 func parseFloat(value interface{}) (float64, error) {
@@ -185,17 +278,41 @@ func averageMatching(ticks []*tick, start time.Time, end time.Time) tick {
 	var matching int64
 	var avgBatteryVoltage float64
 	var avgTemperature float64
+	var avgCPUTemperature *float64
+	var cpuTemperatureMatching int64
 	var avgHumidity int64
 	var avgRadioQuality int64
+	var avgMoisture *float64
+	var moistureMatching int64
+	var material string
+	var hardwareID string
+	var matched []*tick
 	for _, tick := range ticks {
 		if tick.Datetime.Before(start) || tick.Datetime.After(end) {
 			continue
 		}
+		matched = append(matched, tick)
+		hardwareID = tick.HardwareID
 		avgBatteryVoltage += tick.BatteryVoltage
 		avgRadioQuality += tick.RadioQuality
 		avgTemperature += tick.Temperature
 		avgHumidity += tick.Humidity
 		matching += 1
+		if tick.CPUTemperature != nil {
+			if avgCPUTemperature == nil {
+				avgCPUTemperature = new(float64)
+			}
+			*avgCPUTemperature += *tick.CPUTemperature
+			cpuTemperatureMatching += 1
+		}
+		if tick.Moisture != nil {
+			if avgMoisture == nil {
+				avgMoisture = new(float64)
+			}
+			*avgMoisture += *tick.Moisture
+			moistureMatching += 1
+			material = tick.Material
+		}
 	}
 	if matching > 0 {
 		avgBatteryVoltage /= float64(matching)
@@ -203,12 +320,64 @@ func averageMatching(ticks []*tick, start time.Time, end time.Time) tick {
 		avgTemperature /= float64(matching)
 		avgHumidity /= matching
 	}
+	if cpuTemperatureMatching > 0 {
+		*avgCPUTemperature /= float64(cpuTemperatureMatching)
+	}
+	if moistureMatching > 0 {
+		*avgMoisture /= float64(moistureMatching)
+	}
 	return tick{
 		Datetime:       start,
 		BatteryVoltage: avgBatteryVoltage,
 		RadioQuality:   avgRadioQuality,
 		Temperature:    avgTemperature,
+		CPUTemperature: avgCPUTemperature,
 		Humidity:       avgHumidity,
+		Moisture:       avgMoisture,
+		Material:       material,
+		HardwareID:     hardwareID,
+		Channels:       averageChannels(matched),
+	}
+}
+
+func findCoordinatorAverages(readings []*coordinatorReading, dotsPerDay int, start int, end int) []*coordinatorReading {
+	startTime := time.Unix(int64(start), 0)
+	endTime := time.Unix(int64(end), 0)
+	increment := time.Duration(24/dotsPerDay) * time.Hour
+	var result []*coordinatorReading
+	for startTime.Before(endTime) {
+		next := startTime.Add(increment)
+		result = append(result, averageCoordinatorReadings(readings, startTime, next))
+		startTime = next
+	}
+	return result
+}
+
+func averageCoordinatorReadings(readings []*coordinatorReading, start time.Time, end time.Time) *coordinatorReading {
+	var matching int64
+	var avgGSMCoverage int64
+	var avgBatteryVoltage int64
+	var avgBatteryVoltageVisual float64
+	for _, cr := range readings {
+		if cr.CreatedAt == nil || cr.CreatedAt.Before(start) || cr.CreatedAt.After(end) {
+			continue
+		}
+		avgGSMCoverage += cr.GSMCoverage
+		avgBatteryVoltage += cr.BatteryVoltage
+		avgBatteryVoltageVisual += cr.BatteryVoltageVisual
+		matching += 1
+	}
+	if matching > 0 {
+		avgGSMCoverage /= matching
+		avgBatteryVoltage /= matching
+		avgBatteryVoltageVisual /= float64(matching)
+	}
+	createdAt := start
+	return &coordinatorReading{
+		GSMCoverage:          avgGSMCoverage,
+		BatteryVoltage:       avgBatteryVoltage,
+		BatteryVoltageVisual: avgBatteryVoltageVisual,
+		CreatedAt:            &createdAt,
 	}
 }
 
@@ -243,7 +412,7 @@ func parseJSONTick(coordinatorID string, input string) (*tick, error) {
 	if err != nil {
 		return nil, err
 	}
-	t.setBatteryVoltageFromSensorReading(sensorReading)
+	t.setBatteryVoltageFromSensorReading(sensorReading, sensor)
 
 	t.Humidity, err = parseInt(parts[3])
 	if err != nil {
@@ -258,76 +427,109 @@ func parseJSONTick(coordinatorID string, input string) (*tick, error) {
 	return t, nil
 }
 
-func handleJSONUpload(buf *bytes.Buffer) (*upload, error) {
+// handleJSONUpload processes an upload. Uploads whose data could not be
+// stored are kept as dead letters. Source tells where the upload came
+// from, if known.
+func handleJSONUpload(buf *bytes.Buffer, src *uploadSource) (*upload, error) {
 	log.Println("handleJSONUpload", buf.String())
+	receivedAt := time.Now()
 
-	go func(b *bytes.Buffer) {
-		if err := saveLog(buf, loggingKeyJSON); err != nil {
+	u, stage, err := processJSONUpload(buf.Bytes(), receivedAt, false)
+	if err != nil && len(stage) > 0 && !isValidationError(err) {
+		if _, err := saveDeadLetter(buf.Bytes(), receivedAt, src, stage, err); err != nil {
 			bugsnag.Notify(err)
 		}
-	}(buf)
+	}
+	return u, err
+}
 
+// processJSONUpload saves data of an upload. When saving fails, it returns
+// the stage that failed, or empty stage if the data was saved anyway. A
+// requeued upload is not archived again, and its clock skew is not
+// recorded since it was not just sent.
+func processJSONUpload(body []byte, receivedAt time.Time, requeued bool) (*upload, string, error) {
 	var pl payload
-	if err := json.Unmarshal(buf.Bytes(), &pl); err != nil {
-		return nil, err
+	err := json.Unmarshal(body, &pl)
+	if err == nil && pl.FirmwareChunk != nil {
+		u, err := handleFirmwareChunkRequest(pl.FirmwareChunk)
+		return u, "", err
 	}
 
-	if err := saveCoordinatorReading(pl.Coordinator); err != nil {
-		return nil, err
+	// archived by the ingest worker, so that bursts of uploads do not
+	// write to Redis beyond the workers
+	if !requeued {
+		if _, err := archiveUpload(body, receivedAt); err != nil {
+			bugsnag.Notify(err)
+		}
 	}
 
-	// FIXME: save ticks without converting to old format.
-	// instead convert all old format to new format and delete
-	// old format support afterwards
-	ticks, err := pl.convertToOldFormat()
 	if err != nil {
-		return nil, err
+		return nil, uploadStageParse, err
 	}
 
-	if err := saveTicks(ticks); err != nil {
-		return nil, err
+	held, err := holdUnknownCoordinator(&pl.Coordinator)
+	if err != nil {
+		return nil, uploadStagePending, err
+	}
+	if held {
+		return &upload{response: newUploadResponse()}, "", nil
 	}
 
-	// FIXME: delete, it's used in testing only
-	return &upload{
-		ticks: ticks,
-	}, nil
-}
+	pl.Coordinator.UploadID = uploadIDOf(receivedAt)
+	response := newUploadResponse()
+	if pl.Coordinator.CreatedAt != nil && !requeued {
+		skew, err := recordClockSkew(fmt.Sprintf("%d", pl.Coordinator.CoordinatorID), *pl.Coordinator.CreatedAt, receivedAt)
+		if err != nil {
+			return nil, uploadStageClockSkew, err
+		}
+		response.ClockOffset = &skew.Offset
+	} else if pl.Coordinator.CreatedAt == nil {
+		pl.Coordinator.CreatedAt = &receivedAt
+	}
 
-func (t *tick) Save() error {
-	log.Println("Saving tick", t)
+	if err := saveCoordinatorReading(&pl.Coordinator); err != nil {
+		return nil, uploadStageCoordinatorReading, err
+	}
 
-	b, err := json.Marshal(t)
+	// FIXME: save ticks without converting to old format.
+	// instead convert all old format to new format and delete
+	// old format support afterwards
+	ticks, err := pl.convertToOldFormat(receivedAt)
 	if err != nil {
-		return err
+		return nil, uploadStageConversion, err
 	}
 
-	if err := saveReading(keyOfSensorTicks(t.SensorID), float64(t.Datetime.Unix()), b); err != nil {
-		return err
+	ticks, err = quarantineUnknownSensors(ticks)
+	if err != nil {
+		return nil, uploadStagePending, err
 	}
 
-	if t.coordinatorID == "" {
-		id, err := findCoordinatorIDBySensorID(t.SensorID)
-		if err != nil {
-			return err
-		}
-		t.coordinatorID = id
+	if err := saveTicks(ticks); err != nil {
+		return nil, uploadStageTicks, err
 	}
 
-	if t.coordinatorID == "" {
-		log.Println("Coordinator ID not found by sensor ID", t.SensorID, "saving tick to coordinator", defaultCoordinatorID)
-		t.coordinatorID = defaultCoordinatorID
+	if err := publishUpload(pl.Coordinator, ticks); err != nil {
+		bugsnag.Notify(err)
 	}
 
-	if err := setCoordinatorToken(t.coordinatorID); err != nil {
-		return err
+	// the data is saved, so the upload is acknowledged even without config
+	// or firmware, which are offered again on the next upload
+	if response.Config, err = pendingConfigOfUpload(&pl.Coordinator); err != nil {
+		log.Println("Cannot check config of coordinator", pl.Coordinator.CoordinatorID, err)
+		bugsnag.Notify(err)
+		response.Config = nil
 	}
-
-	if err := addSensorToCoordinator(t.SensorID, t.coordinatorID); err != nil {
-		return err
+	if response.Firmware, err = firmwareOfferOf(&pl.Coordinator); err != nil {
+		log.Println("Cannot check firmware of coordinator", pl.Coordinator.CoordinatorID, err)
+		bugsnag.Notify(err)
+		response.Firmware = nil
 	}
+	response.ServerTime = time.Now()
 
-	return nil
+	return &upload{
+		ticks:    ticks, // FIXME: used in testing only
+		response: response,
+	}, "", nil
 }
 
 func (t tick) String() string {
@@ -335,7 +537,15 @@ func (t tick) String() string {
 		t.coordinatorID, t.Datetime, t.SensorID, t.NextDataSession, t.BatteryVoltage, t.Temperature, t.Humidity, t.RadioQuality)
 }
 
+// tokenForCoordinator derives the token of a coordinator from the token
+// secret. Without a secret the legacy token is used, which anyone knowing
+// the coordinator ID can compute.
 func tokenForCoordinator(coordinatorID string) string {
+	if len(*tokenSecret) > 0 {
+		h := hmac.New(sha256.New, []byte(*tokenSecret))
+		h.Write([]byte(coordinatorID))
+		return fmt.Sprintf("%x", h.Sum(nil))
+	}
 	h := md5.New()
 	h.Write([]byte(fmt.Sprintf("OPEN%sSENSOR%sPLATFORM", coordinatorID, coordinatorID)))
 	return fmt.Sprintf("%x", h.Sum(nil))
@@ -343,27 +553,95 @@ func tokenForCoordinator(coordinatorID string) string {
 
 type tickParser func(coordinatorID string, input string) (*tick, error)
 
+// saveTicks writes ticks of an upload in a single transaction, then
+// updates coordinators, memberships and channels once per coordinator and
+// sensor instead of once per tick.
 func saveTicks(ticks []*tick) error {
+	if len(ticks) == 0 {
+		return nil
+	}
+
+	redisClient := redisPool.Get()
+	tx := multi(redisClient)
+	for _, t := range ticks {
+		log.Println("Saving tick", t)
+		b, err := json.Marshal(t)
+		if err != nil {
+			tx.fail(err)
+			break
+		}
+		tx.send("ZADD", keyOfSensorTicks(t.SensorID), t.Datetime.Unix(), b)
+	}
+	_, err := tx.exec()
+	redisClient.Close()
+	if err != nil {
+		return err
+	}
+
+	coordinators := make(map[string]bool)
+	sensors := make(map[string]bool)
+	channels := make(map[string]map[string]float64)
+	var sensorIDs []string
 	for _, t := range ticks {
-		if err := t.Save(); err != nil {
+		if t.coordinatorID == "" {
+			id, err := findCoordinatorIDBySensorID(t.SensorID)
+			if err != nil {
+				return err
+			}
+			t.coordinatorID = id
+		}
+		if t.coordinatorID == "" {
+			return fmt.Errorf("No coordinator for sensor %s", t.SensorID)
+		}
+
+		if !coordinators[t.coordinatorID] {
+			if err := setCoordinatorToken(t.coordinatorID); err != nil {
+				return err
+			}
+			coordinators[t.coordinatorID] = true
+		}
+		if !sensors[t.SensorID+"/"+t.coordinatorID] {
+			if err := addSensorOfUpload(t.SensorID, t.coordinatorID, t.Datetime); err != nil {
+				return err
+			}
+			sensors[t.SensorID+"/"+t.coordinatorID] = true
+		}
+		if _, ok := channels[t.SensorID]; !ok {
+			channels[t.SensorID] = make(map[string]float64)
+			sensorIDs = append(sensorIDs, t.SensorID)
+		}
+		for name, value := range t.Channels {
+			channels[t.SensorID][name] = value
+		}
+	}
+	for _, sensorID := range sensorIDs {
+		if err := addSensorChannels(sensorID, channels[sensorID]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (t tick) calculateTemperatureFromRaw() float64 {
-	return ((t.RawTemperature * 0.001292) - 0.6) / 0.01
-}
-
 func (t *tick) setTemperatureFromSensorReading(sensorReading float64, s *sensor) {
 	t.RawTemperature = sensorReading
 
-	log.Println("[CALCULATE TEMP]", t.SensorID, "sensorReading", sensorReading)
+	log.Println("[CALCULATE TEMP]", t.SensorID, "sensorReading", sensorReading, "profile", s.profile.Name)
+
+	temperature, err := s.profile.convert(channelTemperature, sensorReading)
+	if err != nil {
+		log.Println("[CALCULATE TEMP]", t.SensorID, "discarding temperature:", err)
+		t.addAlert(channelTemperature, err)
+		return
+	}
+	t.Temperature = temperature
 
-	t.Temperature = t.calculateTemperatureFromRaw()
+	log.Println("[CALCULATE TEMP]", t.SensorID, "Temperature from profile", t.Temperature)
 
-	log.Println("[CALCULATE TEMP]", t.SensorID, "Temperature = ((t.RawTemperature * 0.001292) - 0.6) / 0.01", t.Temperature)
+	if s.CalibrationGain != nil {
+		log.Println("[CALCULATE TEMP]", t.SensorID, "CalibrationGain", *s.CalibrationGain)
+		t.Temperature *= *s.CalibrationGain
+		log.Println("[CALCULATE TEMP]", t.SensorID, "Temperature = t.Temperature *= *s.CalibrationGain", t.Temperature)
+	}
 
 	if s.CalibrationConstant != nil {
 		log.Println("[CALCULATE TEMP]", t.SensorID, "CalibrationConstant", *s.CalibrationConstant)
@@ -372,8 +650,25 @@ func (t *tick) setTemperatureFromSensorReading(sensorReading float64, s *sensor)
 	}
 }
 
-func (t *tick) setBatteryVoltageFromSensorReading(sensorReading float64) {
-	t.BatteryVoltage = sensorReading * 0.00384
+func (t *tick) setBatteryVoltageFromSensorReading(sensorReading float64, s *sensor) {
+	batteryVoltage, err := s.profile.convert(channelBatteryVoltage, sensorReading)
+	if err != nil {
+		log.Println("[CALCULATE BATTERY]", t.SensorID, "discarding battery voltage:", err)
+		t.addAlert(channelBatteryVoltage, err)
+		return
+	}
+	t.BatteryVoltage = batteryVoltage
+}
+
+func (t *tick) setCPUTemperatureFromSensorReading(sensorReading float64, s *sensor) {
+	t.RawCPUTemperature = sensorReading
+	cpuTemperature, err := s.profile.convert(channelCPUTemperature, sensorReading)
+	if err != nil {
+		log.Println("[CALCULATE CPU TEMP]", t.SensorID, "discarding CPU temperature:", err)
+		t.addAlert(channelCPUTemperature, err)
+		return
+	}
+	t.CPUTemperature = &cpuTemperature
 }
 
 type authData struct {
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
 	. "gopkg.in/check.v1"
 )
 
@@ -16,8 +21,31 @@ type TestSuite struct{}
 
 var _ = Suite(&TestSuite{})
 
+// Tests use a Redis database of their own, emptied before each test so
+// that the suite can be run again against the same Redis.
+const testRedisDB = 15
+
 func (s *TestSuite) SetUpSuite(c *C) {
 	redisPool = getRedisPool(*redisHost)
+	redisPool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", *redisHost)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("SELECT", testRedisDB); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func (s *TestSuite) SetUpTest(c *C) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err := redisClient.Do("FLUSHDB")
+	c.Assert(err, IsNil)
 }
 
 func (s *TestSuite) TearDownSuite(c *C) {
@@ -27,7 +55,53 @@ func (s *TestSuite) TearDownSuite(c *C) {
 func (s *TestSuite) TestProcessExample(c *C) {
 	b, err := ioutil.ReadFile(filepath.Join("testdata", "example.json"))
 	c.Assert(err, Equals, nil)
-	u, err := handleJSONUpload(bytes.NewBuffer(b))
+
+	var pl payload
+	c.Assert(json.Unmarshal(b, &pl), IsNil)
+	coordinatorID := fmt.Sprintf("%d", pl.Coordinator.CoordinatorID)
+	_, err = claimCoordinator(coordinatorID, "")
+	c.Assert(err, IsNil)
+	for _, sr := range pl.Coordinator.SensorReadings {
+		c.Assert(claimSensor(sr.SensorID, coordinatorID, false), IsNil)
+	}
+
+	u, err := handleJSONUpload(bytes.NewBuffer(b), nil)
 	c.Assert(err, Equals, nil)
 	c.Assert(len(u.ticks), Equals, 20)
 }
+
+func (s *TestSuite) TestFindCoordinatorAverages(c *C) {
+	start := time.Date(2014, 11, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) *time.Time {
+		t := start.Add(time.Duration(hours) * time.Hour)
+		return &t
+	}
+	readings := []*coordinatorReading{
+		{CreatedAt: at(1), GSMCoverage: 20, BatteryVoltage: 160, BatteryVoltageVisual: 4},
+		{CreatedAt: at(2), GSMCoverage: 30, BatteryVoltage: 170, BatteryVoltageVisual: 4.5},
+		{CreatedAt: at(13), GSMCoverage: 10, BatteryVoltage: 150, BatteryVoltageVisual: 3.5},
+	}
+	dots := findCoordinatorAverages(readings, 2, int(start.Unix()), int(start.Add(24*time.Hour).Unix()))
+	c.Assert(len(dots), Equals, 2)
+	c.Assert(dots[0].GSMCoverage, Equals, int64(25))
+	c.Assert(dots[0].BatteryVoltageVisual, Equals, 4.25)
+	c.Assert(dots[1].BatteryVoltage, Equals, int64(150))
+	c.Assert(dots[1].CreatedAt.Equal(*at(12)), Equals, true)
+}
+
+func (s *TestSuite) TestFailedTransactionIsDiscarded(c *C) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+	redisClient.Do("DEL", "osp:test:transaction")
+
+	tx := multi(redisClient)
+	tx.send("SET", "osp:test:transaction", "1")
+	tx.fail(errors.New("Cannot encode"))
+	_, err := tx.exec()
+	c.Assert(err, ErrorMatches, "Cannot encode")
+
+	// connection is not left in MULTI state
+	reply, err := redisClient.Do("GET", "osp:test:transaction")
+	c.Assert(err, IsNil)
+	c.Assert(reply, IsNil)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const keyMoistureCurves = "osp:moisture_curves"
+
+type curvePoint struct {
+	Raw     float64 `json:"raw"`
+	Percent float64 `json:"percent"`
+}
+
+// A moisture curve converts raw moisture counts of a probe into percent
+// moisture content of a material. It's either piecewise linear through the
+// given points, or a polynomial c0 + c1*raw + c2*raw^2 + ...
+type moistureCurve struct {
+	Material     string       `json:"material"`
+	Description  string       `json:"description,omitempty"`
+	Builtin      bool         `json:"builtin,omitempty"`
+	Points       []curvePoint `json:"points,omitempty"`
+	Coefficients []float64    `json:"coefficients,omitempty"`
+}
+
+// Factory curves of the resistive moisture probe. These are coarse and
+// should be replaced with curves measured for the local material.
+var builtinMoistureCurves = map[string]*moistureCurve{
+	"hay": {
+		Material:    "hay",
+		Description: "Baled hay",
+		Builtin:     true,
+		Points:      []curvePoint{{0, 8}, {50, 12}, {100, 17}, {150, 23}, {200, 30}, {255, 40}},
+	},
+	"straw": {
+		Material:    "straw",
+		Description: "Baled straw",
+		Builtin:     true,
+		Points:      []curvePoint{{0, 7}, {50, 11}, {100, 15}, {150, 20}, {200, 27}, {255, 36}},
+	},
+	"grain": {
+		Material:    "grain",
+		Description: "Wheat and barley in storage",
+		Builtin:     true,
+		Points:      []curvePoint{{0, 9}, {50, 12}, {100, 15}, {150, 18}, {200, 22}, {255, 27}},
+	},
+	"soil": {
+		Material:    "soil",
+		Description: "Mineral soil, volumetric water content",
+		Builtin:     true,
+		Points:      []curvePoint{{0, 0}, {50, 8}, {100, 17}, {150, 27}, {200, 38}, {255, 50}},
+	},
+}
+
+// percent converts a raw moisture count into percent moisture content,
+// clamped into range 0-100. Piecewise linear curves are not extrapolated,
+// readings outside of the curve get the value of the nearest end point.
+func (mc *moistureCurve) percent(raw float64) float64 {
+	var result float64
+	if len(mc.Coefficients) > 0 {
+		result = conversion{Coefficients: mc.Coefficients}.apply(raw)
+	} else {
+		result = interpolate(mc.Points, raw)
+	}
+	if result < 0 {
+		return 0
+	}
+	if result > 100 {
+		return 100
+	}
+	return result
+}
+
+func interpolate(points []curvePoint, raw float64) float64 {
+	if len(points) == 0 {
+		return 0
+	}
+	if raw <= points[0].Raw {
+		return points[0].Percent
+	}
+	for i := 1; i < len(points); i++ {
+		if raw <= points[i].Raw {
+			a, b := points[i-1], points[i]
+			return a.Percent + (raw-a.Raw)*(b.Percent-a.Percent)/(b.Raw-a.Raw)
+		}
+	}
+	return points[len(points)-1].Percent
+}
+
+func (mc *moistureCurve) validate() error {
+	if len(mc.Material) == 0 {
+		return errors.New("Missing material")
+	}
+	if len(mc.Points) > 0 && len(mc.Coefficients) > 0 {
+		return errors.New("Curve must have either points or coefficients, not both")
+	}
+	if len(mc.Coefficients) > 0 {
+		return nil
+	}
+	if len(mc.Points) < 2 {
+		return errors.New("Piecewise linear curve needs at least 2 points")
+	}
+	for i := 1; i < len(mc.Points); i++ {
+		if mc.Points[i].Raw <= mc.Points[i-1].Raw {
+			return fmt.Errorf("Curve points must be in increasing order of raw value")
+		}
+	}
+	return nil
+}
+
+func loadMoistureCurve(material string) (*moistureCurve, error) {
+	if mc, ok := builtinMoistureCurves[material]; ok {
+		return mc, nil
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyMoistureCurves, material))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, unknownMaterialError(material)
+		}
+		return nil, err
+	}
+
+	var mc moistureCurve
+	if err := json.Unmarshal(b, &mc); err != nil {
+		return nil, err
+	}
+	return &mc, nil
+}
+
+type unknownMaterialError string
+
+func (e unknownMaterialError) Error() string {
+	return fmt.Sprintf("Unknown material %s", string(e))
+}
+
+func (mc *moistureCurve) save() error {
+	if _, ok := builtinMoistureCurves[mc.Material]; ok {
+		return fmt.Errorf("Cannot overwrite builtin moisture curve %s", mc.Material)
+	}
+	if err := mc.validate(); err != nil {
+		return err
+	}
+	mc.Builtin = false
+
+	b, err := json.Marshal(mc)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keyMoistureCurves, mc.Material, b)
+	return err
+}
+
+func moistureCurves() ([]*moistureCurve, error) {
+	var result []*moistureCurve
+	for _, mc := range builtinMoistureCurves {
+		result = append(result, mc)
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyMoistureCurves))
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range bb {
+		var mc moistureCurve
+		if err := json.Unmarshal(value.([]byte), &mc); err != nil {
+			return nil, err
+		}
+		result = append(result, &mc)
+	}
+
+	sort.Sort(byMaterial(result))
+	return result, nil
+}
+
+type byMaterial []*moistureCurve
+
+func (a byMaterial) Len() int           { return len(a) }
+func (a byMaterial) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMaterial) Less(i, j int) bool { return a[i].Material < a[j].Material }
+
+// setMoisture calculates moisture content of the ticks from their raw
+// moisture counts, using the material curve selected for the sensor.
+// Ticks are left untouched if sensor has no material.
+func setMoisture(sensorID string, ticks []*tick) error {
+	s, err := loadSensor("", sensorID)
+	if err != nil {
+		return err
+	}
+	if len(s.Material) == 0 {
+		return nil
+	}
+	mc, err := loadMoistureCurve(s.Material)
+	if err != nil {
+		return err
+	}
+	for _, t := range ticks {
+		moisture := mc.percent(float64(t.Humidity))
+		t.Moisture = &moisture
+		t.Material = mc.Material
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestMoistureCurvePiecewise(c *C) {
+	mc := &moistureCurve{
+		Material: "test",
+		Points:   []curvePoint{{0, 10}, {100, 20}, {200, 40}},
+	}
+	c.Assert(mc.validate(), IsNil)
+	c.Assert(mc.percent(-5), Equals, float64(10))
+	c.Assert(mc.percent(50), Equals, float64(15))
+	c.Assert(mc.percent(150), Equals, float64(30))
+	c.Assert(mc.percent(500), Equals, float64(40))
+}
+
+func (s *TestSuite) TestMoistureCurvePolynomial(c *C) {
+	mc := &moistureCurve{
+		Material:     "test",
+		Coefficients: []float64{-10, 0.5},
+	}
+	c.Assert(mc.validate(), IsNil)
+	c.Assert(mc.percent(0), Equals, float64(0))
+	c.Assert(mc.percent(100), Equals, float64(40))
+	c.Assert(mc.percent(1000), Equals, float64(100))
+}
+
+func (s *TestSuite) TestMoistureCurveValidate(c *C) {
+	mc := &moistureCurve{
+		Material: "test",
+		Points:   []curvePoint{{100, 10}, {50, 20}},
+	}
+	c.Assert(mc.validate(), Not(IsNil))
+
+	mc.Points = []curvePoint{{0, 10}}
+	c.Assert(mc.validate(), Not(IsNil))
+}
+
+func (s *TestSuite) TestAverageMoisture(c *C) {
+	start := time.Now()
+	low, high := 10.0, 20.0
+	ticks := []*tick{
+		{Datetime: start.Add(time.Minute), Humidity: 50, Moisture: &low, Material: "hay"},
+		{Datetime: start.Add(2 * time.Minute), Humidity: 150, Moisture: &high, Material: "hay"},
+	}
+	avg := averageMatching(ticks, start, start.Add(time.Hour))
+	c.Assert(avg.Humidity, Equals, int64(100))
+	c.Assert(avg.Moisture, Not(IsNil))
+	c.Assert(*avg.Moisture, Equals, float64(15))
+	c.Assert(avg.Material, Equals, "hay")
+}
@@ -9,37 +9,48 @@ import (
 )
 
 type payload struct {
-	Coordinator coordinatorReading `json:"coordinator"`
+	Coordinator   coordinatorReading    `json:"coordinator"`
+	FirmwareChunk *firmwareChunkRequest `json:"firmware_chunk,omitempty"` // sent instead of readings
 }
 
 type sensorReading struct {
-	SensorID          string `json:"sensor_id"`
-	BatteryVoltage    int64  `json:"battery_voltage"`
-	CPUTemperature    int64  `json:"cpu_temperature"`
-	SensorTemperature int64  `json:"sensor_temperature"`
-	Moisture          int64  `json:"moisture"`
-	SendCounter       int64  `json:"sendcounter"`
-	PacketRSSI        int64  `json:"packet_rssi"`
+	SensorID          string             `json:"sensor_id"`
+	BatteryVoltage    int64              `json:"battery_voltage"`
+	CPUTemperature    int64              `json:"cpu_temperature"`
+	SensorTemperature int64              `json:"sensor_temperature"`
+	Moisture          int64              `json:"moisture"`
+	SendCounter       int64              `json:"sendcounter"`
+	PacketRSSI        int64              `json:"packet_rssi"`
+	Channels          map[string]float64 `json:"channels,omitempty"`
 }
 
 type coordinatorReading struct {
-	CoordinatorID  int64           `json:"coordinator_id"`
-	GSMCoverage    int64           `json:"gsm_coverage"`
-	BatteryVoltage int64           `json:"battery_voltage"`
-	Uptime         int64           `json:"uptime"`
-	FirstOverflow  int64           `json:"first_overflow"`
-	Tries          int64           `json:"tries"`
-	Successes      int64           `json:"successes"`
-	SensorReadings []sensorReading `json:"sensor_readings,omitempty"`
-	CreatedAt      *time.Time      `json:"created_at,omitempty"`
+	CoordinatorID        int64              `json:"coordinator_id"`
+	GSMCoverage          int64              `json:"gsm_coverage"`
+	BatteryVoltage       int64              `json:"battery_voltage"`
+	Uptime               int64              `json:"uptime"`
+	FirstOverflow        int64              `json:"first_overflow"`
+	Tries                int64              `json:"tries"`
+	Successes            int64              `json:"successes"`
+	SensorReadings       []sensorReading    `json:"sensor_readings,omitempty"`
+	CreatedAt            *time.Time         `json:"created_at,omitempty"`
+	BatteryVoltageVisual float64            `json:"battery_voltage_visual,omitempty"` // V
+	Config               *coordinatorConfig `json:"config,omitempty"`                 // configuration the coordinator runs with
+	FirmwareVersion      string             `json:"firmware_version,omitempty"`
+	HardwareRevision     string             `json:"hardware_revision,omitempty"`
+	UploadID             string             `json:"upload_id,omitempty"` // set by the server
 }
 
 type coordinator struct {
-	ID     string `json:"id"`
-	Label  string `json:"label"`
-	Token  string `json:"token"`
-	URL    string `json:"url"`
-	LogURL string `json:"log_url"`
+	ID      string `json:"id"`
+	Label   string `json:"label"`
+	Token   string `json:"token"`
+	URL     string `json:"url"`
+	LogURL  string `json:"log_url"`
+	Profile string `json:"profile,omitempty"`
+
+	FirmwareVersion  string `json:"firmware_version,omitempty"`
+	HardwareRevision string `json:"hardware_revision,omitempty"`
 }
 
 type controllerReading struct {
@@ -50,58 +61,107 @@ type controllerReading struct {
 }
 
 type sensor struct {
-	ID                  string     `json:"id"`
-	LastTick            *time.Time `json:"last_tick,omitempty"`
-	ControllerID        string     `json:"controller_id"`
-	Lat                 string     `json:"lat,omitempty"`
-	Lng                 string     `json:"lng,omitempty"`
-	Label               string     `json:"label"`
-	CalibrationConstant *float64   `json:"calibration_constant,omitempty"`
-	CurrentTemperature  *float64   `json:"current_temperature,omitempty"`
+	ID                  string              `json:"id"`
+	LastTick            *time.Time          `json:"last_tick,omitempty"`
+	HardwareID          string              `json:"hardware_id,omitempty"` // when sensor has been replaced
+	ControllerID        string              `json:"controller_id"`
+	Lat                 *float64            `json:"lat,omitempty"`
+	Lng                 *float64            `json:"lng,omitempty"`
+	Label               string              `json:"label"`
+	CalibrationConstant *float64            `json:"calibration_constant,omitempty"`
+	CalibrationGain     *float64            `json:"calibration_gain,omitempty"`
+	CalibrationPoints   []*calibrationPoint `json:"calibration_points,omitempty"`
+	CurrentTemperature  *float64            `json:"current_temperature,omitempty"`
+	ResetCalibration    bool                `json:"reset_calibration,omitempty"`
+	Profile             string              `json:"profile,omitempty"`
+	Material            string              `json:"material,omitempty"`
+	// is not serialized
+	profile *sensorProfile
+}
+
+// UnmarshalJSON accepts location of the sensor as numbers or as strings,
+// older clients send strings.
+func (s *sensor) UnmarshalJSON(b []byte) error {
+	type plainSensor sensor
+	v := struct {
+		*plainSensor
+		Lat json.RawMessage `json:"lat"`
+		Lng json.RawMessage `json:"lng"`
+	}{plainSensor: (*plainSensor)(s)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var err error
+	if s.Lat, err = parseCoordinate("lat", v.Lat); err != nil {
+		return err
+	}
+	s.Lng, err = parseCoordinate("lng", v.Lng)
+	return err
 }
 
 // Deprecated type.
 // Should use the new, reading types instead.
 // FIXME: convert existing, saved ticks to new format, then drop this:
 type tick struct {
-	SensorID        string    `json:"sensor_id,omitempty"`
-	Datetime        time.Time `json:"datetime"`
-	NextDataSession string    `json:"next_data_session,omitempty"`      // sec
-	BatteryVoltage  float64   `json:"battery_voltage_visual,omitempty"` // mV
-	Temperature     float64   `json:"temperature,omitempty"`            // encoded temperature
-	RawTemperature  float64   `json:"raw_temperature,omitempty"`
-	Humidity        int64     `json:"sensor2,omitempty"`       // humidity
-	RadioQuality    int64     `json:"radio_quality,omitempty"` // (LQI=0..255)
-	Sendcounter     int64     `json:"send_counter,omitempty"`  // (LQI=0..255)
-	Version         int64     `json:"version"`
+	SensorID          string             `json:"sensor_id,omitempty"`
+	HardwareID        string             `json:"hardware_id,omitempty"` // when sensor has been replaced
+	Datetime          time.Time          `json:"datetime"`
+	NextDataSession   string             `json:"next_data_session,omitempty"`      // sec
+	BatteryVoltage    float64            `json:"battery_voltage_visual,omitempty"` // mV
+	Temperature       float64            `json:"temperature,omitempty"`            // encoded temperature
+	RawTemperature    float64            `json:"raw_temperature,omitempty"`
+	CPUTemperature    *float64           `json:"cpu_temperature,omitempty"`
+	RawCPUTemperature float64            `json:"raw_cpu_temperature,omitempty"`
+	Humidity          int64              `json:"sensor2,omitempty"`       // humidity
+	RadioQuality      int64              `json:"radio_quality,omitempty"` // (LQI=0..255)
+	Sendcounter       int64              `json:"send_counter,omitempty"`  // (LQI=0..255)
+	Moisture          *float64           `json:"moisture,omitempty"`      // % moisture content, calculated from sensor2
+	Material          string             `json:"material,omitempty"`
+	Channels          map[string]float64 `json:"channels,omitempty"`
+	Version           int64              `json:"version"`
+	UploadID          string             `json:"upload_id,omitempty"` // archived upload the reading came in
 	// is not serialized
 	coordinatorID string
+	alerts        []*alert
 }
 
-func (pl payload) convertToOldFormat() ([]*tick, error) {
+// convertToOldFormat returns readings of the sensors as ticks of the time
+// the upload was received.
+func (pl payload) convertToOldFormat(receivedAt time.Time) ([]*tick, error) {
 	var ticks []*tick
 	for _, sensorReading := range pl.Coordinator.SensorReadings {
 		t := &tick{
 			coordinatorID: fmt.Sprintf("%d", pl.Coordinator.CoordinatorID),
-			Datetime:      time.Now(),
+			Datetime:      receivedAt,
+			UploadID:      pl.Coordinator.UploadID,
 			Version:       3,
 			SensorID:      sensorReading.SensorID,
 			Humidity:      sensorReading.Moisture,
 			Sendcounter:   sensorReading.SendCounter,
 			RadioQuality:  sensorReading.PacketRSSI,
 		}
-		sensor, err := loadSensor(t.coordinatorID, sensorReading.SensorID)
+		sensorID, err := resolveSensorID(sensorReading.SensorID)
+		if err != nil {
+			return nil, err
+		}
+		if sensorID != sensorReading.SensorID {
+			t.SensorID = sensorID
+			t.HardwareID = sensorReading.SensorID
+		}
+		sensor, err := loadSensor(t.coordinatorID, t.SensorID)
 		if err != nil {
 			return nil, err
 		}
 		t.setTemperatureFromSensorReading(float64(sensorReading.SensorTemperature), sensor)
-		t.setBatteryVoltageFromSensorReading(float64(sensorReading.BatteryVoltage))
+		t.setBatteryVoltageFromSensorReading(float64(sensorReading.BatteryVoltage), sensor)
+		t.setCPUTemperatureFromSensorReading(float64(sensorReading.CPUTemperature), sensor)
+		t.setChannelsFromSensorReading(sensorReading.Channels, sensor)
 		ticks = append(ticks, t)
 	}
 	return ticks, nil
 }
 
-func saveCoordinatorReading(cr coordinatorReading) error {
+func saveCoordinatorReading(cr *coordinatorReading) error {
 	log.Println("Saving coordinator reading", cr)
 
 	if !(cr.CoordinatorID > 0) {
@@ -113,6 +173,10 @@ func saveCoordinatorReading(cr coordinatorReading) error {
 		cr.CreatedAt = &now
 	}
 
+	if err := cr.setBatteryVoltage(); err != nil {
+		return err
+	}
+
 	b, err := json.Marshal(cr)
 	if err != nil {
 		return err
@@ -124,3 +188,25 @@ func saveCoordinatorReading(cr coordinatorReading) error {
 
 	return nil
 }
+
+func (cr *coordinatorReading) setBatteryVoltage() error {
+	c, err := loadCoordinator(fmt.Sprintf("%d", cr.CoordinatorID))
+	if err != nil {
+		return err
+	}
+	profileName := defaultCoordinatorProfile
+	if c != nil && len(c.Profile) > 0 {
+		profileName = c.Profile
+	}
+	profile, err := loadSensorProfile(profileName)
+	if err != nil {
+		return err
+	}
+	batteryVoltage, err := profile.convert(channelBatteryVoltage, float64(cr.BatteryVoltage))
+	if err != nil {
+		log.Println("Discarding battery voltage of coordinator", cr.CoordinatorID, err)
+		return nil
+	}
+	cr.BatteryVoltageVisual = batteryVoltage
+	return nil
+}
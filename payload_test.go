@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -49,7 +50,7 @@ func (s *TestSuite) TestPayloadConvertToOldFormat(c *C) {
 
 	c.Assert(pl.Coordinator, Not(IsNil))
 
-	ticks, err := pl.convertToOldFormat()
+	ticks, err := pl.convertToOldFormat(time.Now())
 	c.Assert(err, IsNil)
 
 	c.Assert(ticks, Not(IsNil))
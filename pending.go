@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Devices that are not known yet are held in pending queues until an admin,
+// or for sensors the owner of the coordinator, claims them.
+const keyPendingCoordinators = "osp:pending:coordinators"
+const keyPendingSensors = "osp:pending:sensors"
+
+// Number of latest readings kept of a pending device, for recognising it.
+const pendingSamples = 5
+
+const (
+	deviceKindCoordinator = "coordinator"
+	deviceKindSensor      = "sensor"
+)
+
+type pendingDevice struct {
+	ID            string            `json:"id"`
+	Kind          string            `json:"kind"`
+	CoordinatorID string            `json:"coordinator_id,omitempty"` // coordinator a sensor was last seen through
+	FirstSeen     time.Time         `json:"first_seen"`
+	LastSeen      time.Time         `json:"last_seen"`
+	Count         int               `json:"count"`
+	Samples       []json.RawMessage `json:"samples"`
+}
+
+type pendingDevices struct {
+	Coordinators []*pendingDevice `json:"coordinators"`
+	Sensors      []*pendingDevice `json:"sensors"`
+}
+
+type unknownCoordinatorError string
+
+func (e unknownCoordinatorError) Error() string {
+	return fmt.Sprintf("Unknown coordinator %s", string(e))
+}
+
+var errNotPending = errors.New("Device is not pending")
+
+// A sensorOwnedError tells that a sensor belongs to another coordinator,
+// and only the admin can move it.
+type sensorOwnedError struct {
+	sensorID      string
+	coordinatorID string
+}
+
+func (e sensorOwnedError) Error() string {
+	return fmt.Sprintf("Sensor %s belongs to coordinator %s", e.sensorID, e.coordinatorID)
+}
+
+func keyOfPendingDevices(kind string) string {
+	if kind == deviceKindCoordinator {
+		return keyPendingCoordinators
+	}
+	return keyPendingSensors
+}
+
+func coordinatorExists(coordinatorID string) (bool, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	return redis.Bool(redisClient.Do("SISMEMBER", keyCoordinators, coordinatorID))
+}
+
+func loadPendingDevice(kind, id string) (*pendingDevice, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyOfPendingDevices(kind), id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d pendingDevice
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// recordPendingDevice adds a sighting of an unknown device with a sample
+// of what it sent.
+func recordPendingDevice(kind, id, coordinatorID string, sample interface{}) error {
+	d, err := loadPendingDevice(kind, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if d == nil {
+		log.Println("Holding unknown", kind, id, "pending until claimed")
+		d = &pendingDevice{ID: id, Kind: kind, FirstSeen: now}
+	}
+	d.CoordinatorID = coordinatorID
+	d.LastSeen = now
+	d.Count++
+
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	d.Samples = append(d.Samples, b)
+	if len(d.Samples) > pendingSamples {
+		d.Samples = d.Samples[len(d.Samples)-pendingSamples:]
+	}
+
+	b, err = json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keyOfPendingDevices(kind), id, b)
+	return err
+}
+
+// quarantineUnknownSensors returns ticks of sensors that belong to the
+// coordinator of the upload. Ticks of other sensors, unknown ones and those
+// of another coordinator, are held pending until the sensor is claimed.
+func quarantineUnknownSensors(ticks []*tick) ([]*tick, error) {
+	var known []*tick
+	for _, t := range ticks {
+		coordinatorID, err := findCoordinatorIDBySensorID(t.SensorID)
+		if err != nil {
+			return nil, err
+		}
+		if len(coordinatorID) > 0 && coordinatorID == t.coordinatorID {
+			known = append(known, t)
+			continue
+		}
+		if err := recordPendingDevice(deviceKindSensor, t.SensorID, t.coordinatorID, t); err != nil {
+			return nil, err
+		}
+	}
+	return known, nil
+}
+
+// pendingDevicesOf lists pending devices of given kind. When coordinator ID
+// is given, only sensors seen through that coordinator are listed.
+func pendingDevicesOf(kind, coordinatorID string) ([]*pendingDevice, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyOfPendingDevices(kind)))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*pendingDevice, 0)
+	for _, value := range bb {
+		var d pendingDevice
+		if err := json.Unmarshal(value.([]byte), &d); err != nil {
+			return nil, err
+		}
+		if len(coordinatorID) > 0 && d.CoordinatorID != coordinatorID {
+			continue
+		}
+		result = append(result, &d)
+	}
+	sort.Sort(byLastSeen(result))
+	return result, nil
+}
+
+type byLastSeen []*pendingDevice
+
+func (a byLastSeen) Len() int           { return len(a) }
+func (a byLastSeen) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastSeen) Less(i, j int) bool { return a[i].LastSeen.After(a[j].LastSeen) }
+
+func dismissPendingDevice(kind, id string) error {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	n, err := redis.Int(redisClient.Do("HDEL", keyOfPendingDevices(kind), id))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotPending
+	}
+	return nil
+}
+
+// claimCoordinator makes a coordinator known, so that its uploads are
+// accepted.
+func claimCoordinator(coordinatorID, label string) (*coordinator, error) {
+	if len(coordinatorID) == 0 {
+		return nil, errors.New("Missing coordinator ID")
+	}
+	if err := setCoordinatorToken(coordinatorID); err != nil {
+		return nil, err
+	}
+	if len(label) > 0 {
+		if err := setCoordinatorLabel(coordinatorID, label); err != nil {
+			return nil, err
+		}
+	}
+	if err := dismissPendingDevice(deviceKindCoordinator, coordinatorID); err != nil && err != errNotPending {
+		return nil, err
+	}
+	return loadCoordinator(coordinatorID)
+}
+
+// claimSensor adds a sensor to a known coordinator, so that its readings
+// are accepted. A sensor of another coordinator is moved only when move is
+// set.
+func claimSensor(sensorID, coordinatorID string, move bool) error {
+	if len(sensorID) == 0 {
+		return errors.New("Missing sensor ID")
+	}
+	exists, err := coordinatorExists(coordinatorID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return unknownCoordinatorError(coordinatorID)
+	}
+	previous, err := findCoordinatorIDBySensorID(sensorID)
+	if err != nil {
+		return err
+	}
+	if len(previous) > 0 && previous != coordinatorID && !move {
+		return sensorOwnedError{sensorID: sensorID, coordinatorID: previous}
+	}
+	if err := addSensorToCoordinator(sensorID, coordinatorID, time.Now()); err != nil {
+		return err
+	}
+	if err := dismissPendingDevice(deviceKindSensor, sensorID); err != nil && err != errNotPending {
+		return err
+	}
+	return nil
+}
+
+// holdUnknownCoordinator records an upload of an unknown coordinator and
+// tells whether the upload was held.
+func holdUnknownCoordinator(cr *coordinatorReading) (bool, error) {
+	if !(cr.CoordinatorID > 0) {
+		return false, nil
+	}
+	coordinatorID := fmt.Sprintf("%d", cr.CoordinatorID)
+	exists, err := coordinatorExists(coordinatorID)
+	if err != nil || exists {
+		return false, err
+	}
+	return true, recordPendingDevice(deviceKindCoordinator, coordinatorID, "", cr)
+}
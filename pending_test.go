@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestQuarantine(c *C) {
+	pl := payload{Coordinator: coordinatorReading{
+		CoordinatorID: 61,
+		SensorReadings: []sensorReading{
+			{SensorID: "6F001", SensorTemperature: 621},
+		},
+	}}
+	b, err := json.Marshal(pl)
+	c.Assert(err, IsNil)
+
+	u, err := handleJSONUpload(bytes.NewBuffer(b), nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(u.ticks), Equals, 0)
+	d, err := loadPendingDevice(deviceKindCoordinator, "61")
+	c.Assert(err, IsNil)
+	c.Assert(d.Count, Equals, 1)
+	c.Assert(len(d.Samples), Equals, 1)
+
+	_, err = claimCoordinator("61", "Barn")
+	c.Assert(err, IsNil)
+	d, err = loadPendingDevice(deviceKindCoordinator, "61")
+	c.Assert(err, IsNil)
+	c.Assert(d, IsNil)
+
+	u, err = handleJSONUpload(bytes.NewBuffer(b), nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(u.ticks), Equals, 0)
+	sensors, err := pendingDevicesOf(deviceKindSensor, "61")
+	c.Assert(err, IsNil)
+	c.Assert(len(sensors), Equals, 1)
+	c.Assert(sensors[0].ID, Equals, "6F001")
+
+	c.Assert(claimSensor("6F001", "62", false), FitsTypeOf, unknownCoordinatorError(""))
+	c.Assert(claimSensor("6F001", "61", false), IsNil)
+
+	u, err = handleJSONUpload(bytes.NewBuffer(b), nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(u.ticks), Equals, 1)
+	sensors, err = pendingDevicesOf(deviceKindSensor, "61")
+	c.Assert(err, IsNil)
+	c.Assert(len(sensors), Equals, 0)
+}
+
+func (s *TestSuite) TestQuarantineSensorOfAnotherCoordinator(c *C) {
+	for _, coordinatorID := range []string{"9901", "9902"} {
+		_, err := claimCoordinator(coordinatorID, "")
+		c.Assert(err, IsNil)
+	}
+	c.Assert(claimSensor("6F002", "9901", false), IsNil)
+
+	pl := payload{Coordinator: coordinatorReading{
+		CoordinatorID:  9902,
+		SensorReadings: []sensorReading{{SensorID: "6F002", SensorTemperature: 621}},
+	}}
+	b, err := json.Marshal(pl)
+	c.Assert(err, IsNil)
+	u, err := handleJSONUpload(bytes.NewBuffer(b), nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(u.ticks), Equals, 0)
+
+	coordinatorID, err := findCoordinatorIDBySensorID("6F002")
+	c.Assert(err, IsNil)
+	c.Assert(coordinatorID, Equals, "9901")
+	sensors, err := pendingDevicesOf(deviceKindSensor, "9902")
+	c.Assert(err, IsNil)
+	c.Assert(len(sensors), Equals, 1)
+	c.Assert(sensors[0].ID, Equals, "6F002")
+
+	c.Assert(claimSensor("6F002", "9902", false), FitsTypeOf, sensorOwnedError{})
+	c.Assert(claimSensor("6F002", "9902", true), IsNil)
+	coordinatorID, err = findCoordinatorIDBySensorID("6F002")
+	c.Assert(err, IsNil)
+	c.Assert(coordinatorID, Equals, "9902")
+}
+
+func (s *TestSuite) TestTokenForCoordinatorWithSecret(c *C) {
+	legacy := tokenForCoordinator("9901")
+	*tokenSecret = "s3cret"
+	defer func() { *tokenSecret = "" }()
+	c.Assert(tokenForCoordinator("9901"), Not(Equals), legacy)
+	c.Assert(len(tokenForCoordinator("9901")), Equals, 64)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const keySensorProfiles = "osp:sensor_profiles"
+
+const defaultSensorProfile = "default"
+const defaultCoordinatorProfile = "coordinator"
+
+const (
+	channelTemperature    = "temperature"
+	channelBatteryVoltage = "battery_voltage"
+	channelCPUTemperature = "cpu_temperature"
+)
+
+// A conversion turns a raw sensor reading into an engineering value.
+// When coefficients are given, the raw value is evaluated as a polynomial
+// c0 + c1*raw + c2*raw^2 + ...; otherwise as ((raw * scale) + offset) / divisor.
+type conversion struct {
+	Scale        float64   `json:"scale,omitempty"`
+	Offset       float64   `json:"offset,omitempty"`
+	Divisor      float64   `json:"divisor,omitempty"`
+	Coefficients []float64 `json:"coefficients,omitempty"`
+}
+
+type channelProfile struct {
+	Unit       string     `json:"unit"`
+	Conversion conversion `json:"conversion"`
+	Min        *float64   `json:"min,omitempty"`
+	Max        *float64   `json:"max,omitempty"`
+}
+
+// A sensor profile describes a sensor type or hardware revision: how each
+// of its channels is converted from raw readings and which values are valid.
+type sensorProfile struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description,omitempty"`
+	Builtin     bool                       `json:"builtin,omitempty"`
+	Channels    map[string]*channelProfile `json:"channels"`
+}
+
+type unknownProfileError string
+
+func (e unknownProfileError) Error() string {
+	return fmt.Sprintf("Unknown sensor profile %s", string(e))
+}
+
+type outOfRangeError struct {
+	channel string
+	value   float64
+	unit    string
+}
+
+func (e outOfRangeError) Error() string {
+	return fmt.Sprintf("%s value %v %s is out of valid range", e.channel, e.value, e.unit)
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+var builtinSensorProfiles = map[string]*sensorProfile{
+	defaultSensorProfile: {
+		Name:        defaultSensorProfile,
+		Description: "Ardusensor probe with analog temperature sensor",
+		Builtin:     true,
+		Channels: map[string]*channelProfile{
+			channelTemperature: {
+				Unit:       "°C",
+				Conversion: conversion{Scale: 0.001292, Offset: -0.6, Divisor: 0.01},
+				Min:        floatPtr(-40),
+				Max:        floatPtr(125),
+			},
+			channelBatteryVoltage: {
+				Unit:       "V",
+				Conversion: conversion{Scale: 0.00384},
+				Min:        floatPtr(0),
+				Max:        floatPtr(5),
+			},
+			// internal temperature sensor of the ATmega328
+			channelCPUTemperature: {
+				Unit:       "°C",
+				Conversion: conversion{Scale: 1, Offset: -324.31, Divisor: 1.22},
+				Min:        floatPtr(-40),
+				Max:        floatPtr(85),
+			},
+		},
+	},
+	defaultCoordinatorProfile: {
+		Name:        defaultCoordinatorProfile,
+		Description: "Ardusensor GSM coordinator",
+		Builtin:     true,
+		Channels: map[string]*channelProfile{
+			channelBatteryVoltage: {
+				Unit:       "V",
+				Conversion: conversion{Scale: 0.025},
+				Min:        floatPtr(0),
+				Max:        floatPtr(15),
+			},
+		},
+	},
+}
+
+func (c conversion) apply(raw float64) float64 {
+	if len(c.Coefficients) > 0 {
+		var result float64
+		for i := len(c.Coefficients) - 1; i >= 0; i-- {
+			result = result*raw + c.Coefficients[i]
+		}
+		return result
+	}
+	result := (raw * c.Scale) + c.Offset
+	if c.Divisor != 0 {
+		result /= c.Divisor
+	}
+	return result
+}
+
+func (cp *channelProfile) inRange(value float64) bool {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return false
+	}
+	if cp.Min != nil && value < *cp.Min {
+		return false
+	}
+	if cp.Max != nil && value > *cp.Max {
+		return false
+	}
+	return true
+}
+
+func (p *sensorProfile) channel(name string) (*channelProfile, error) {
+	cp, ok := p.Channels[name]
+	if !ok {
+		return nil, fmt.Errorf("Sensor profile %s has no %s channel", p.Name, name)
+	}
+	return cp, nil
+}
+
+// convert converts a raw reading of the given channel, returning an
+// outOfRangeError when the result is outside of the valid range.
+func (p *sensorProfile) convert(channelName string, raw float64) (float64, error) {
+	cp, err := p.channel(channelName)
+	if err != nil {
+		return 0, err
+	}
+	value := cp.Conversion.apply(raw)
+	if !cp.inRange(value) {
+		return value, outOfRangeError{channel: channelName, value: value, unit: cp.Unit}
+	}
+	return value, nil
+}
+
+func (p *sensorProfile) validate() error {
+	if len(p.Name) == 0 {
+		return errors.New("Missing profile name")
+	}
+	if len(p.Channels) == 0 {
+		return errors.New("Profile must define at least one channel")
+	}
+	for name, cp := range p.Channels {
+		if cp == nil {
+			return fmt.Errorf("Missing definition of channel %s", name)
+		}
+		if cp.Conversion.Scale == 0 && len(cp.Conversion.Coefficients) == 0 {
+			return fmt.Errorf("Channel %s needs a scale or polynomial coefficients", name)
+		}
+		if cp.Min != nil && cp.Max != nil && *cp.Min > *cp.Max {
+			return fmt.Errorf("Channel %s has min greater than max", name)
+		}
+	}
+	return nil
+}
+
+func loadSensorProfile(name string) (*sensorProfile, error) {
+	if len(name) == 0 {
+		name = defaultSensorProfile
+	}
+	if p, ok := builtinSensorProfiles[name]; ok {
+		return p, nil
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keySensorProfiles, name))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, unknownProfileError(name)
+		}
+		return nil, err
+	}
+
+	var p sensorProfile
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *sensorProfile) save() error {
+	if _, ok := builtinSensorProfiles[p.Name]; ok {
+		return fmt.Errorf("Cannot overwrite builtin sensor profile %s", p.Name)
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+	p.Builtin = false
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keySensorProfiles, p.Name, b)
+	return err
+}
+
+func sensorProfiles() ([]*sensorProfile, error) {
+	var result []*sensorProfile
+	for _, p := range builtinSensorProfiles {
+		result = append(result, p)
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keySensorProfiles))
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range bb {
+		var p sensorProfile
+		if err := json.Unmarshal(value.([]byte), &p); err != nil {
+			return nil, err
+		}
+		result = append(result, &p)
+	}
+
+	sort.Sort(byProfileName(result))
+	return result, nil
+}
+
+type byProfileName []*sensorProfile
+
+func (a byProfileName) Len() int           { return len(a) }
+func (a byProfileName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byProfileName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestDefaultProfileConversions(c *C) {
+	p := builtinSensorProfiles[defaultSensorProfile]
+
+	temperature, err := p.convert(channelTemperature, 621)
+	c.Assert(err, IsNil)
+	c.Assert(temperature, Equals, float64(20.233199999999997))
+
+	batteryVoltage, err := p.convert(channelBatteryVoltage, 797)
+	c.Assert(err, IsNil)
+	c.Assert(batteryVoltage, Equals, float64(3.06048))
+}
+
+func (s *TestSuite) TestProfileOutOfRange(c *C) {
+	p := builtinSensorProfiles[defaultSensorProfile]
+
+	_, err := p.convert(channelTemperature, 2)
+	c.Assert(err, FitsTypeOf, outOfRangeError{})
+
+	_, err = p.convert("co2", 2)
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *TestSuite) TestPolynomialConversion(c *C) {
+	conv := conversion{Coefficients: []float64{1, 2, 3}}
+	c.Assert(conv.apply(2), Equals, float64(17))
+}
+
+func (s *TestSuite) TestProfileValidate(c *C) {
+	p := &sensorProfile{Name: "thermistor_v2"}
+	c.Assert(p.validate(), Not(IsNil))
+
+	p.Channels = map[string]*channelProfile{
+		channelTemperature: {Unit: "°C", Min: floatPtr(10), Max: floatPtr(0), Conversion: conversion{Scale: 1}},
+	}
+	c.Assert(p.validate(), Not(IsNil))
+
+	p.Channels[channelTemperature].Max = floatPtr(100)
+	c.Assert(p.validate(), IsNil)
+}
+
+func (s *TestSuite) TestCPUAndCoordinatorBatteryConversions(c *C) {
+	cpuTemperature, err := builtinSensorProfiles[defaultSensorProfile].convert(channelCPUTemperature, 338)
+	c.Assert(err, IsNil)
+	c.Assert(cpuTemperature > 11 && cpuTemperature < 12, Equals, true)
+
+	batteryVoltage, err := builtinSensorProfiles[defaultCoordinatorProfile].convert(channelBatteryVoltage, 166)
+	c.Assert(err, IsNil)
+	c.Assert(batteryVoltage > 4.14 && batteryVoltage < 4.16, Equals, true)
+}
+
+func (s *TestSuite) TestAverageCPUTemperatureSkipsMissing(c *C) {
+	start := time.Now()
+	ticks := []*tick{
+		{Datetime: start.Add(time.Minute), CPUTemperature: floatPtr(20)},
+		{Datetime: start.Add(2 * time.Minute)},
+		{Datetime: start.Add(3 * time.Minute), CPUTemperature: floatPtr(30)},
+	}
+	avg := averageMatching(ticks, start, start.Add(time.Hour))
+	c.Assert(avg.CPUTemperature, Not(IsNil))
+	c.Assert(*avg.CPUTemperature, Equals, float64(25))
+
+	avg = averageMatching(ticks[1:2], start, start.Add(time.Hour))
+	c.Assert(avg.CPUTemperature, IsNil)
+}
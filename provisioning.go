@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const keyProvisionedSensors = "osp:provisioned_sensors"
+
+// QR code payload formats of provisioned series, by series.
+const keyProvisionedPayloads = "osp:provisioned_payloads"
+
+// Max number of sensor IDs provisioned at once.
+const maxProvisionedSeries = 10000
+
+// Sensor labels carry a QR code of "{sensor_id=1A001}" unless printed
+// with another payload format, %s is the sensor ID.
+const defaultLabelPayload = "{sensor_id=%s}"
+
+// A provisioned sensor is a sensor ID that has been printed on a label and
+// can be installed.
+type provisionedSensor struct {
+	SensorID      string     `json:"sensor_id"`
+	Series        string     `json:"series"`
+	Payload       string     `json:"payload,omitempty"` // QR code format, when not the default
+	ProvisionedAt time.Time  `json:"provisioned_at"`
+	InstalledAt   *time.Time `json:"installed_at,omitempty"`
+	CoordinatorID string     `json:"coordinator_id,omitempty"`
+}
+
+type provisioningError string
+
+func (e provisioningError) Error() string {
+	return string(e)
+}
+
+// An installation claims a provisioned sensor into a coordinator. Code is
+// either scanned QR code payload or a plain sensor ID.
+type installation struct {
+	Code     string    `json:"code"`
+	Token    string    `json:"token"`
+	Label    string    `json:"label"`
+	Lat      *float64  `json:"lat,omitempty"`
+	Lng      *float64  `json:"lng,omitempty"`
+	LayoutID string    `json:"layout_id,omitempty"`
+	Position *position `json:"position,omitempty"`
+}
+
+func seriesSensorID(series string, n int) string {
+	return fmt.Sprintf("%s%03d", series, n)
+}
+
+// payloadPattern matches QR code payloads of the format.
+func payloadPattern(format string) *regexp.Regexp {
+	parts := strings.SplitN(format, "%s", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	return regexp.MustCompile("^" + regexp.QuoteMeta(parts[0]) + `([^{}=/?&#\s]+)` + regexp.QuoteMeta(parts[1]) + "$")
+}
+
+// parseSensorCode returns sensor ID of a scanned QR code payload, in the
+// default format or in a format some series was provisioned with, or of a
+// plain sensor ID.
+func parseSensorCode(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	formats := []string{defaultLabelPayload}
+	redisClient := redisPool.Get()
+	custom, err := redis.Strings(redisClient.Do("HVALS", keyProvisionedPayloads))
+	redisClient.Close()
+	if err != nil {
+		return "", err
+	}
+	for _, format := range append(formats, custom...) {
+		if p := payloadPattern(format); p != nil {
+			if m := p.FindStringSubmatch(code); m != nil {
+				return m[1], nil
+			}
+		}
+	}
+	if len(code) == 0 || strings.ContainsAny(code, "{}=/?&# ") {
+		return "", provisioningError("Invalid sensor code " + code)
+	}
+	return code, nil
+}
+
+// validateSeries checks a series of sensor IDs to provision, and the
+// format of QR code payload of its labels.
+func validateSeries(series string, start, end int, payload string) error {
+	if len(series) == 0 {
+		return provisioningError("Missing series")
+	}
+	if start < 0 || end < start {
+		return provisioningError("Invalid range of series")
+	}
+	if end-start+1 > maxProvisionedSeries {
+		return provisioningError(fmt.Sprintf("Cannot provision more than %d sensors at once", maxProvisionedSeries))
+	}
+	if strings.Count(payload, "%s") != 1 || strings.Count(payload, "%") != 1 {
+		return provisioningError("Payload format must contain %s once, for the sensor ID")
+	}
+	return nil
+}
+
+// provisionSeries registers sensor IDs of the series in range start..end,
+// and the payload format their labels are printed with. Sensors
+// provisioned earlier are kept as they are.
+func provisionSeries(series string, start, end int, payload string) ([]*provisionedSensor, error) {
+	if len(payload) == 0 {
+		payload = defaultLabelPayload
+	}
+	if err := validateSeries(series, start, end, payload); err != nil {
+		return nil, err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	if payload != defaultLabelPayload {
+		if _, err := redisClient.Do("HSET", keyProvisionedPayloads, series, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	var result []*provisionedSensor
+	for n := start; n <= end; n++ {
+		ps := &provisionedSensor{
+			SensorID:      seriesSensorID(series, n),
+			Series:        series,
+			ProvisionedAt: now,
+		}
+		if payload != defaultLabelPayload {
+			ps.Payload = payload
+		}
+		b, err := json.Marshal(ps)
+		if err != nil {
+			return nil, err
+		}
+		added, err := redis.Bool(redisClient.Do("HSETNX", keyProvisionedSensors, ps.SensorID, b))
+		if err != nil {
+			return nil, err
+		}
+		if added {
+			result = append(result, ps)
+		}
+	}
+	return result, nil
+}
+
+func loadProvisionedSensor(sensorID string) (*provisionedSensor, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyProvisionedSensors, sensorID))
+	if err == redis.ErrNil {
+		return nil, provisioningError(fmt.Sprintf("Sensor %s has not been provisioned", sensorID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ps provisionedSensor
+	if err := json.Unmarshal(b, &ps); err != nil {
+		return nil, err
+	}
+	return &ps, nil
+}
+
+func (ps *provisionedSensor) save() error {
+	b, err := json.Marshal(ps)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keyProvisionedSensors, ps.SensorID, b)
+	return err
+}
+
+// provisionedSensors lists provisioned sensors, optionally of one series,
+// sorted by sensor ID.
+func provisionedSensors(series string) ([]*provisionedSensor, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyProvisionedSensors))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*provisionedSensor, 0)
+	for _, value := range bb {
+		var ps provisionedSensor
+		if err := json.Unmarshal(value.([]byte), &ps); err != nil {
+			return nil, err
+		}
+		if len(series) > 0 && ps.Series != series {
+			continue
+		}
+		result = append(result, &ps)
+	}
+	sort.Sort(byProvisionedSensorID(result))
+	return result, nil
+}
+
+type byProvisionedSensorID []*provisionedSensor
+
+func (a byProvisionedSensorID) Len() int           { return len(a) }
+func (a byProvisionedSensorID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byProvisionedSensorID) Less(i, j int) bool { return a[i].SensorID < a[j].SensorID }
+
+// install claims a provisioned sensor into the coordinator, and sets its
+// label and position in one go. Label and location are only changed when
+// given. A sensor installed at another coordinator is only moved when move
+// is set.
+func (inst *installation) install(coordinatorID string, move bool) (*sensor, error) {
+	sensorID, err := parseSensorCode(inst.Code)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := loadProvisionedSensor(sensorID)
+	if err != nil {
+		return nil, err
+	}
+	if ps.InstalledAt != nil && ps.CoordinatorID != coordinatorID && !move {
+		return nil, sensorOwnedError{sensorID: sensorID, coordinatorID: ps.CoordinatorID}
+	}
+	if err := validateLocation(inst.Lat, inst.Lng); err != nil {
+		return nil, err
+	}
+
+	var l *layout
+	if len(inst.LayoutID) > 0 {
+		if inst.Position == nil {
+			return nil, provisioningError("Missing position in layout")
+		}
+		l, err = loadLayout(inst.LayoutID)
+		if err != nil {
+			return nil, err
+		}
+		if l.Positions == nil {
+			l.Positions = make(map[string]*position)
+		}
+		l.Positions[sensorID] = inst.Position
+		if err := l.validate(); err != nil {
+			return nil, provisioningError(err.Error())
+		}
+	}
+
+	if err := claimSensor(sensorID, coordinatorID, move); err != nil {
+		return nil, err
+	}
+
+	if err := inst.saveSensorFields(sensorID); err != nil {
+		return nil, err
+	}
+	if l != nil {
+		if err := l.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	ps.InstalledAt = &now
+	ps.CoordinatorID = coordinatorID
+	if err := ps.save(); err != nil {
+		return nil, err
+	}
+
+	return loadSensor(coordinatorID, sensorID)
+}
+
+// saveSensorFields sets the label and the location of the installation
+// that are given, and keeps the others.
+func (inst *installation) saveSensorFields(sensorID string) error {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	if len(inst.Label) > 0 {
+		if _, err := redisClient.Do("HSET", keyOfSensor(sensorID), "label", inst.Label); err != nil {
+			return err
+		}
+	}
+	if inst.Lat != nil {
+		return setSensorLocation(redisClient, sensorID, inst.Lat, inst.Lng)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestParseSensorCode(c *C) {
+	id, err := parseSensorCode("{sensor_id=1A001}")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "1A001")
+	id, err = parseSensorCode(" 1A002\n")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "1A002")
+	_, err = parseSensorCode("{sensor_id=}")
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *TestSuite) TestParseSensorCodeOfCustomPayload(c *C) {
+	_, err := parseSensorCode("https://osp.example/s/8H001")
+	c.Assert(err, Not(IsNil))
+	_, err = provisionSeries("8H", 1, 2, "https://osp.example/s/%s")
+	c.Assert(err, IsNil)
+	id, err := parseSensorCode("https://osp.example/s/8H001")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "8H001")
+	_, err = provisionSeries("8H", 3, 4, "no sensor ID")
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *TestSuite) TestInstallProvisionedSensor(c *C) {
+	added, err := provisionSeries("7G", 1, 3, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(added), Equals, 3)
+	c.Assert(added[2].SensorID, Equals, "7G003")
+	added, err = provisionSeries("7G", 3, 4, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(added), Equals, 1)
+
+	_, err = claimCoordinator("71", "")
+	c.Assert(err, IsNil)
+	c.Assert((&layout{ID: "7G", Width: 10, Height: 10}).save(), IsNil)
+
+	inst := &installation{
+		Code:     "{sensor_id=7G002}",
+		Label:    "North corner",
+		Lat:      floatPtr(57.77),
+		Lng:      floatPtr(26.03),
+		LayoutID: "7G",
+		Position: &position{X: 1, Y: 2},
+	}
+	installed, err := inst.install("71", false)
+	c.Assert(err, IsNil)
+	c.Assert(installed.Label, Equals, "North corner")
+	c.Assert(*installed.Lat, Equals, 57.77)
+
+	coordinatorID, err := findCoordinatorIDBySensorID("7G002")
+	c.Assert(err, IsNil)
+	c.Assert(coordinatorID, Equals, "71")
+	l, err := loadLayout("7G")
+	c.Assert(err, IsNil)
+	c.Assert(*l.Positions["7G002"], Equals, position{X: 1, Y: 2})
+	ps, err := loadProvisionedSensor("7G002")
+	c.Assert(err, IsNil)
+	c.Assert(ps.CoordinatorID, Equals, "71")
+
+	inst.Code = "{sensor_id=7H001}"
+	_, err = inst.install("71", false)
+	c.Assert(err, FitsTypeOf, provisioningError(""))
+
+	inst.Code = "7G003"
+	inst.Position = &position{X: 11, Y: 2}
+	_, err = inst.install("71", false)
+	c.Assert(err, FitsTypeOf, provisioningError(""))
+	coordinatorID, err = findCoordinatorIDBySensorID("7G003")
+	c.Assert(err, IsNil)
+	c.Assert(coordinatorID, Equals, "")
+
+	// reinstalling without label and location keeps them
+	inst = &installation{Code: "7G002"}
+	installed, err = inst.install("71", false)
+	c.Assert(err, IsNil)
+	c.Assert(installed.Label, Equals, "North corner")
+	c.Assert(*installed.Lat, Equals, 57.77)
+
+	_, err = claimCoordinator("72", "")
+	c.Assert(err, IsNil)
+	_, err = inst.install("72", false)
+	c.Assert(err, FitsTypeOf, sensorOwnedError{})
+	coordinatorID, err = findCoordinatorIDBySensorID("7G002")
+	c.Assert(err, IsNil)
+	c.Assert(coordinatorID, Equals, "71")
+	_, err = inst.install("72", true)
+	c.Assert(err, IsNil)
+
+	c.Assert((&sensor{ID: "7G002"}).save(), IsNil)
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A minimal QR code encoder (ISO/IEC 18004), byte mode only, for printing
+// sensor labels. Versions 1-10 are supported, which holds payloads of up to
+// 119 bytes at the highest error correction level.
+
+type qrLevel int
+
+const (
+	qrLevelL qrLevel = iota
+	qrLevelM
+	qrLevelQ
+	qrLevelH
+)
+
+const qrMaxVersion = 10
+
+// Error correction codewords per block and number of blocks, indexed by
+// level and version.
+var qrECCodewordsPerBlock = [4][qrMaxVersion + 1]int{
+	{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18},
+	{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26},
+	{0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24},
+	{0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28},
+}
+
+var qrECBlocks = [4][qrMaxVersion + 1]int{
+	{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4},
+	{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5},
+	{0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8},
+	{0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8},
+}
+
+// Level bits of the format information.
+var qrLevelFormatBits = [4]int{1, 0, 3, 2}
+
+type qrCode struct {
+	version  int
+	level    qrLevel
+	mask     int
+	size     int
+	modules  [][]bool // [y][x], true is dark
+	function [][]bool // modules of finder, timing, alignment and format patterns
+}
+
+func parseQRLevel(s string) (qrLevel, error) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return qrLevelL, nil
+	case "M":
+		return qrLevelM, nil
+	case "Q":
+		return qrLevelQ, nil
+	case "H":
+		return qrLevelH, nil
+	}
+	return 0, fmt.Errorf("Invalid QR error correction level %s, must be one of L, M, Q, H", s)
+}
+
+// encodeQR encodes data into the smallest QR code that holds it, with the
+// mask that has the lowest penalty.
+func encodeQR(data []byte, level qrLevel) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= qrMaxVersion; v++ {
+		if qrDataCapacityBits(v, level) >= qrByteModeBits(v, len(data)) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.New("Data is too long for a QR code")
+	}
+
+	codewords := qrDataCodewords(data, version, level)
+	codewords = qrAddErrorCorrection(codewords, version, level)
+
+	var best *qrCode
+	bestPenalty := 0
+	for mask := 0; mask < 8; mask++ {
+		qr := newQRCode(version, level)
+		qr.drawCodewords(codewords)
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		qr.mask = mask
+		if penalty := qr.penalty(); best == nil || penalty < bestPenalty {
+			best, bestPenalty = qr, penalty
+		}
+	}
+	return best, nil
+}
+
+// dark tells whether the module is dark. Modules outside the code, that is
+// in the quiet zone, are light.
+func (qr *qrCode) dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= qr.size || y >= qr.size {
+		return false
+	}
+	return qr.modules[y][x]
+}
+
+func qrSize(version int) int {
+	return version*4 + 17
+}
+
+// qrRawDataModules returns the number of modules left for data and error
+// correction after the function patterns.
+func qrRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		n := version/7 + 2
+		result -= (25*n-10)*n - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func qrDataCapacityBits(version int, level qrLevel) int {
+	total := qrRawDataModules(version) / 8
+	return (total - qrECCodewordsPerBlock[level][version]*qrECBlocks[level][version]) * 8
+}
+
+func qrCharCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+func qrByteModeBits(version, n int) int {
+	return 4 + qrCharCountBits(version) + n*8
+}
+
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	result := make([]int, n)
+	result[0] = 6
+	for i, pos := n-1, qrSize(version)-7; i > 0; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+type qrBitBuffer []bool
+
+func (b *qrBitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (value>>uint(i))&1 != 0)
+	}
+}
+
+// qrDataCodewords returns data in byte mode, terminated and padded to the
+// capacity of the version.
+func qrDataCodewords(data []byte, version int, level qrLevel) []byte {
+	capacity := qrDataCapacityBits(version, level)
+	var bits qrBitBuffer
+	bits.append(4, 4)
+	bits.append(len(data), qrCharCountBits(version))
+	for _, c := range data {
+		bits.append(int(c), 8)
+	}
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	result := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			result[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	return result
+}
+
+// qrAddErrorCorrection splits data into blocks, adds error correction
+// codewords to each and interleaves the blocks.
+func qrAddErrorCorrection(data []byte, version int, level qrLevel) []byte {
+	numBlocks := qrECBlocks[level][version]
+	ecLen := qrECCodewordsPerBlock[level][version]
+	total := qrRawDataModules(version) / 8
+	numShortBlocks := numBlocks - total%numBlocks
+	shortBlockLen := total / numBlocks
+	divisor := reedSolomonDivisor(ecLen)
+
+	var blocks [][]byte
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortBlockLen - ecLen
+		if i >= numShortBlocks {
+			n++
+		}
+		block := append([]byte{}, data[k:k+n]...)
+		k += n
+		ec := reedSolomonRemainder(block, divisor)
+		if i < numShortBlocks {
+			// short blocks get a placeholder to keep columns aligned
+			block = append(block, 0)
+		}
+		blocks = append(blocks, append(block, ec...))
+	}
+
+	var result []byte
+	for i := 0; i <= shortBlockLen; i++ {
+		for j, block := range blocks {
+			if i != shortBlockLen-ecLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// reedSolomonDivisor returns the generator polynomial of given degree,
+// highest coefficient first with the leading 1 left out.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	var root byte = 1
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// newQRCode returns a code with the function patterns drawn and the format
+// areas reserved.
+func newQRCode(version int, level qrLevel) *qrCode {
+	size := qrSize(version)
+	qr := &qrCode{version: version, level: level, size: size}
+	qr.modules = make([][]bool, size)
+	qr.function = make([][]bool, size)
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, size)
+		qr.function[y] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+	qr.drawFinder(3, 3)
+	qr.drawFinder(size-4, 3)
+	qr.drawFinder(3, size-4)
+
+	positions := qrAlignmentPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			qr.drawAlignment(x, y)
+		}
+	}
+
+	qr.drawFormatBits(0)
+	qr.drawVersionBits()
+	return qr
+}
+
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// drawFinder draws a finder pattern with its separator around center x, y.
+func (qr *qrCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= qr.size || yy >= qr.size {
+				continue
+			}
+			d := maxInt(absInt(dx), absInt(dy))
+			qr.setFunction(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+func (qr *qrCode) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			qr.setFunction(x+dx, y+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+		}
+	}
+}
+
+func (qr *qrCode) drawFormatBits(mask int) {
+	data := qrLevelFormatBits[qr.level]<<3 | mask
+	bits := qrFormatBits(data)
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.size-8, true)
+}
+
+// qrFormatBits returns the 15 bit BCH coded and masked format information.
+func qrFormatBits(data int) int {
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (qr *qrCode) drawVersionBits() {
+	if qr.version < 7 {
+		return
+	}
+	rem := qr.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := qr.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		a, b := qr.size-11+i%3, i/3
+		qr.setFunction(a, b, dark)
+		qr.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places codewords in the zigzag order, two columns at a
+// time from the bottom right corner, skipping the vertical timing pattern.
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < qr.size; vert++ {
+			y := vert
+			if upward {
+				y = qr.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if qr.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				qr.modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+func qrMaskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.function[y][x] && qrMaskBit(mask, x, y) {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read, see section 7.8.3 of the
+// standard.
+func (qr *qrCode) penalty() int {
+	result := 0
+	for i := 0; i < qr.size; i++ {
+		row := func(j int) bool { return qr.dark(j, i) }
+		column := func(j int) bool { return qr.dark(i, j) }
+		result += qr.linePenalty(row) + qr.linePenalty(column)
+	}
+
+	dark := 0
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < qr.size && y+1 < qr.size {
+				c := qr.modules[y][x]
+				if c == qr.modules[y][x+1] && c == qr.modules[y+1][x] && c == qr.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+
+	total := qr.size * qr.size
+	percent := dark * 100 / total
+	result += absInt(percent-50) / 5 * 10
+	return result
+}
+
+// linePenalty scores runs of same colour and finder-like patterns of a row
+// or a column.
+func (qr *qrCode) linePenalty(dark func(int) bool) int {
+	result := 0
+	run := 1
+	for j := 1; j <= qr.size; j++ {
+		if j < qr.size && dark(j) == dark(j-1) {
+			run++
+			continue
+		}
+		if run >= 5 {
+			result += 3 + run - 5
+		}
+		run = 1
+	}
+
+	finder := []bool{true, false, true, true, true, false, true}
+	for j := -4; j < qr.size; j++ {
+		matches := true
+		for k, c := range finder {
+			if dark(j+k) != c {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		before, after := true, true
+		for k := 1; k <= 4; k++ {
+			before = before && !dark(j-k)
+			after = after && !dark(j+6+k)
+		}
+		if before || after {
+			result += 40
+		}
+	}
+	return result
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func maxInt(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
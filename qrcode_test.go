@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestReedSolomon(c *C) {
+	// "HELLO WORLD" in version 1-M, from the QR code tutorial at thonky.com
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ec := reedSolomonRemainder(data, reedSolomonDivisor(10))
+	c.Assert(ec, DeepEquals, []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23})
+}
+
+func (s *TestSuite) TestQRFormatBits(c *C) {
+	c.Assert(qrFormatBits(qrLevelFormatBits[qrLevelL]<<3|0), Equals, 0x77C4) // 111011111000100
+	c.Assert(qrFormatBits(qrLevelFormatBits[qrLevelM]<<3|0), Equals, 0x5412) // 101010000010010
+}
+
+func (s *TestSuite) TestQRCapacity(c *C) {
+	for version := 1; version <= qrMaxVersion; version++ {
+		for level := qrLevelL; level <= qrLevelH; level++ {
+			total := qrRawDataModules(version) / 8
+			blocks := qrECBlocks[level][version]
+			// every block has data codewords besides error correction
+			c.Assert(total/blocks > qrECCodewordsPerBlock[level][version], Equals, true)
+		}
+	}
+	c.Assert(qrRawDataModules(1)/8, Equals, 26)
+	c.Assert(qrRawDataModules(7)/8, Equals, 196)
+	c.Assert(qrRawDataModules(10)/8, Equals, 346)
+	c.Assert(qrAlignmentPositions(7), DeepEquals, []int{6, 22, 38})
+	c.Assert(qrAlignmentPositions(10), DeepEquals, []int{6, 28, 50})
+}
+
+func (s *TestSuite) TestEncodeQR(c *C) {
+	qr, err := encodeQR([]byte("{sensor_id=1A001}"), qrLevelH)
+	c.Assert(err, IsNil)
+	c.Assert(qr.version, Equals, 3)
+	c.Assert(qr.size, Equals, 29)
+	// finder pattern corners and the dark module
+	c.Assert(qr.dark(0, 0), Equals, true)
+	c.Assert(qr.dark(1, 1), Equals, false)
+	c.Assert(qr.dark(28, 0), Equals, true)
+	c.Assert(qr.dark(0, 28), Equals, true)
+	c.Assert(qr.dark(8, 21), Equals, true)
+
+	qr, err = encodeQR([]byte(strings.Repeat("x", 119)), qrLevelH)
+	c.Assert(err, IsNil)
+	c.Assert(qr.version, Equals, 10)
+	_, err = encodeQR([]byte(strings.Repeat("x", 120)), qrLevelH)
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *TestSuite) TestLabels(c *C) {
+	opts := &labelOptions{
+		series:    "1A",
+		start:     1,
+		end:       5,
+		payload:   "{sensor_id=%s}",
+		format:    labelFormatSVG,
+		labelSize: 200,
+		columns:   2,
+		rows:      2,
+		level:     qrLevelH,
+	}
+	c.Assert(opts.validate(), IsNil)
+	tooMany := *opts
+	tooMany.end = maxProvisionedSeries + 1
+	c.Assert(tooMany.validate(), Not(IsNil))
+	labels, err := makeLabels(opts)
+	c.Assert(err, IsNil)
+	c.Assert(len(labels), Equals, 5)
+	c.Assert(labels[4].text, Equals, "1A005")
+
+	var b bytes.Buffer
+	c.Assert(writeLabelsSVG(&b, labels[:4], opts), IsNil)
+	c.Assert(strings.HasPrefix(b.String(), `<svg xmlns="http://www.w3.org/2000/svg" width="400" height="400"`), Equals, true)
+	c.Assert(strings.Count(b.String(), "<text"), Equals, 4)
+	c.Assert(strings.Contains(b.String(), ">1A004</text>"), Equals, true)
+
+	b.Reset()
+	c.Assert(writeLabelsPNG(&b, labels[4:], opts), IsNil)
+	c.Assert(bytes.HasPrefix(b.Bytes(), []byte("\x89PNG")), Equals, true)
+
+	opts.labelSize = 30
+	_, err = makeLabels(opts)
+	c.Assert(err, Not(IsNil))
+	opts.payload = "%d"
+	c.Assert(opts.validate(), Not(IsNil))
+}
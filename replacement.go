@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Hardware IDs of replacement sensors are aliases of the logical sensor
+// they replaced. Readings of a replacement are saved under the logical
+// sensor ID, so that its history continues in one series.
+const keySensorAliases = "osp:sensor_aliases"
+
+func keyOfSensorReplacements(sensorID string) string {
+	return fmt.Sprintf("osp:sensor:%s:replacements", sensorID)
+}
+
+// A replacement marks the point where hardware of a logical sensor was
+// swapped.
+type replacement struct {
+	SensorID      string    `json:"sensor_id"`
+	OldHardwareID string    `json:"old_hardware_id"`
+	NewHardwareID string    `json:"new_hardware_id"`
+	ReplacedAt    time.Time `json:"replaced_at"`
+	MovedTicks    int       `json:"moved_ticks"`
+}
+
+type replacementError string
+
+func (e replacementError) Error() string {
+	return string(e)
+}
+
+// resolveSensorID returns the logical sensor ID of a hardware ID.
+func resolveSensorID(hardwareID string) (string, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	sensorID, err := redis.String(redisClient.Do("HGET", keySensorAliases, hardwareID))
+	if err == redis.ErrNil {
+		return hardwareID, nil
+	}
+	return sensorID, err
+}
+
+func sensorReplacements(sensorID string) ([]*replacement, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("LRANGE", keyOfSensorReplacements(sensorID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*replacement, 0)
+	for _, value := range bb {
+		var r replacement
+		if err := json.Unmarshal(value.([]byte), &r); err != nil {
+			return nil, err
+		}
+		result = append(result, &r)
+	}
+	return result, nil
+}
+
+// currentHardwareID returns the hardware ID the logical sensor currently
+// has.
+func currentHardwareID(sensorID string) (string, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("LINDEX", keyOfSensorReplacements(sensorID), -1))
+	if err == redis.ErrNil {
+		return sensorID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var r replacement
+	if err := json.Unmarshal(b, &r); err != nil {
+		return "", err
+	}
+	return r.NewHardwareID, nil
+}
+
+// replaceSensor links new hardware to the logical sensor, so that label,
+// position, groups and alert rules of the sensor apply to the new hardware.
+// Readings the new hardware has sent before are moved to the logical
+// sensor. Calibration is reset, as it belongs to the old probe. Hardware
+// of another coordinator is only taken when move is set.
+func replaceSensor(sensorID, newHardwareID string, replacedAt time.Time, move bool) (*replacement, error) {
+	sensorID, err := resolveSensorID(sensorID)
+	if err != nil {
+		return nil, err
+	}
+	if len(newHardwareID) == 0 {
+		return nil, replacementError("Missing new hardware ID")
+	}
+	if newHardwareID == sensorID {
+		return nil, replacementError("Sensor cannot replace itself")
+	}
+	linked, err := resolveSensorID(newHardwareID)
+	if err != nil {
+		return nil, err
+	}
+	if linked != newHardwareID {
+		return nil, replacementError(fmt.Sprintf("Sensor %s already replaces sensor %s", newHardwareID, linked))
+	}
+	replacements, err := sensorReplacements(newHardwareID)
+	if err != nil {
+		return nil, err
+	}
+	if len(replacements) > 0 {
+		return nil, replacementError(fmt.Sprintf("Sensor %s has replacements of its own", newHardwareID))
+	}
+
+	oldHardwareID, err := currentHardwareID(sensorID)
+	if err != nil {
+		return nil, err
+	}
+	r := &replacement{
+		SensorID:      sensorID,
+		OldHardwareID: oldHardwareID,
+		NewHardwareID: newHardwareID,
+		ReplacedAt:    replacedAt,
+	}
+
+	ticks, err := findTicksByRange(newHardwareID, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	coordinatorID, err := findCoordinatorIDBySensorID(newHardwareID)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := findCoordinatorIDBySensorID(sensorID)
+	if err != nil {
+		return nil, err
+	}
+	if len(coordinatorID) > 0 && coordinatorID != owner && !move {
+		return nil, sensorOwnedError{newHardwareID, coordinatorID}
+	}
+	r.MovedTicks = len(ticks)
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	tx := multi(redisClient)
+	for _, t := range ticks {
+		t.SensorID = sensorID
+		t.HardwareID = newHardwareID
+		tb, err := json.Marshal(t)
+		if err != nil {
+			tx.fail(err)
+			break
+		}
+		tx.send("ZADD", keyOfSensorTicks(sensorID), t.Datetime.Unix(), tb)
+	}
+	tx.send("DEL", keyOfSensorTicks(newHardwareID))
+	tx.send("SUNIONSTORE", keyOfSensorChannels(sensorID), keyOfSensorChannels(sensorID), keyOfSensorChannels(newHardwareID))
+	tx.send("DEL", keyOfSensorChannels(newHardwareID))
+	if len(coordinatorID) > 0 {
+		tx.send("SREM", keyOfCoordinatorSensors(coordinatorID), newHardwareID)
+		tx.send("HDEL", keySensorToController, newHardwareID)
+	}
+	tx.send("HSET", keySensorAliases, newHardwareID, sensorID)
+	tx.send("RPUSH", keyOfSensorReplacements(sensorID), b)
+	if _, err := tx.exec(); err != nil {
+		return nil, err
+	}
+
+	if err := resetCalibration(sensorID); err != nil {
+		return nil, err
+	}
+	if err := dismissPendingDevice(deviceKindSensor, newHardwareID); err != nil && err != errNotPending {
+		return nil, err
+	}
+
+	log.Println("Sensor", sensorID, "replaced", oldHardwareID, "with", newHardwareID)
+	return r, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestReplaceSensor(c *C) {
+	old := time.Now().Add(-2 * time.Hour)
+	c.Assert(saveTicks([]*tick{{SensorID: "4D001", Datetime: old, Temperature: 10, coordinatorID: "7"}}), IsNil)
+	c.Assert(saveTicks([]*tick{{SensorID: "4D002", Datetime: old.Add(time.Hour), Temperature: 11, coordinatorID: "7"}}), IsNil)
+
+	// hardware of another coordinator is not taken unless moved
+	c.Assert(saveTicks([]*tick{{SensorID: "4D009", Datetime: old, Temperature: 12, coordinatorID: "8"}}), IsNil)
+	_, err := replaceSensor("4D001", "4D009", time.Now(), false)
+	c.Assert(err, FitsTypeOf, sensorOwnedError{})
+	ticks, err := findTicksByRange("4D009", 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(len(ticks), Equals, 1)
+
+	r, err := replaceSensor("4D001", "4D002", time.Now(), false)
+	c.Assert(err, IsNil)
+	c.Assert(r.OldHardwareID, Equals, "4D001")
+	c.Assert(r.MovedTicks, Equals, 1)
+
+	sensorID, err := resolveSensorID("4D002")
+	c.Assert(err, IsNil)
+	c.Assert(sensorID, Equals, "4D001")
+
+	ticks, err = findTicksByScore("4D001", 0, int(time.Now().Unix()))
+	c.Assert(err, IsNil)
+	c.Assert(len(ticks), Equals, 2)
+	c.Assert(ticks[1].HardwareID, Equals, "4D002")
+
+	ids, err := sensorIDsOfCoordinator("7")
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []string{"4D001"})
+
+	_, err = replaceSensor("4D001", "4D002", time.Now(), false)
+	c.Assert(err, FitsTypeOf, replacementError(""))
+
+	// replacing the replacement continues the same logical sensor
+	r, err = replaceSensor("4D002", "4D003", time.Now(), false)
+	c.Assert(err, IsNil)
+	c.Assert(r.SensorID, Equals, "4D001")
+	c.Assert(r.OldHardwareID, Equals, "4D002")
+
+	hardwareID, err := currentHardwareID("4D001")
+	c.Assert(err, IsNil)
+	c.Assert(hardwareID, Equals, "4D003")
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Readings stored with the ID of their upload are paired on it. Readings
+// stored before uploads had IDs are looked up this long after the upload
+// was received, or until the next upload.
+const replayMatchWindow = 30 * time.Second
+
+// Uploads of a coordinator received between start and end, in unix
+// seconds, are replayed. Zero start or end leaves the range open. Stored
+// readings are only replaced when write is set.
+type replayOptions struct {
+	coordinatorID string
+	start         int64
+	end           int64
+	write         bool
+}
+
+// A replayDiff shows a reading as it is stored and as replaying the upload
+// produced it. Stored is nil when no reading was found for the upload.
+type replayDiff struct {
+	UploadID string      `json:"upload_id"`
+	SensorID string      `json:"sensor_id,omitempty"` // empty for coordinator readings
+	Datetime time.Time   `json:"datetime"`
+	Changes  []string    `json:"changes,omitempty"` // fields that differ
+	Stored   interface{} `json:"stored"`
+	Replayed interface{} `json:"replayed"`
+}
+
+type replayError struct {
+	UploadID string `json:"upload_id"`
+	Error    string `json:"error"`
+}
+
+type replayReport struct {
+	Uploads   int            `json:"uploads"`
+	Readings  int            `json:"readings"`
+	Unchanged int            `json:"unchanged"`
+	Changed   int            `json:"changed"`
+	Missing   int            `json:"missing"`
+	Skipped   int            `json:"skipped"` // readings of unknown sensors
+	Failed    int            `json:"failed"`  // uploads that could not be replayed
+	Written   int            `json:"written"`
+	DryRun    bool           `json:"dry_run,omitempty"`
+	Diffs     []*replayDiff  `json:"diffs,omitempty"`
+	Errors    []*replayError `json:"errors,omitempty"`
+}
+
+// A tick stored of an upload, raw so that it can be replaced.
+type storedTick struct {
+	tick   *tick
+	raw    []byte
+	paired bool
+}
+
+// A replayed reading and the reading stored of the same upload, raw so
+// that it can be replaced.
+type replayedReading struct {
+	key       string
+	score     int64
+	sensorID  string
+	datetime  time.Time
+	stored    interface{}
+	storedRaw []byte
+	replayed  interface{}
+}
+
+// replayUploads feeds archived uploads of a coordinator through parsing
+// and conversion again, using current sensor profiles and calibration, and
+// compares the result with the stored readings. In write mode changed
+// readings are replaced. Missing readings are only reported, they may have
+// been deleted on purpose. Nothing else an upload does, like recording
+// config or publishing, is repeated.
+func replayUploads(opts *replayOptions) (*replayReport, error) {
+	exists, err := coordinatorExists(opts.coordinatorID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, unknownCoordinatorError(opts.coordinatorID)
+	}
+
+	uploads, err := archivedUploadsBetween(opts.coordinatorID, opts.start, opts.end)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &replayReport{Uploads: len(uploads), DryRun: !opts.write}
+	for i, u := range uploads {
+		until := u.ReceivedAt.Add(replayMatchWindow)
+		if i+1 < len(uploads) && uploads[i+1].ReceivedAt.Before(until) {
+			until = uploads[i+1].ReceivedAt
+		}
+		readings, skipped, err := replayUpload(u, until)
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, &replayError{UploadID: u.ID, Error: err.Error()})
+			continue
+		}
+		report.Skipped += skipped
+		for _, rr := range readings {
+			report.Readings++
+			changes, err := changedFields(rr.stored, rr.replayed)
+			if err != nil {
+				return nil, err
+			}
+			if rr.stored != nil && len(changes) == 0 {
+				report.Unchanged++
+				continue
+			}
+			if rr.stored == nil {
+				report.Missing++
+			} else {
+				report.Changed++
+			}
+			report.Diffs = append(report.Diffs, &replayDiff{
+				UploadID: u.ID,
+				SensorID: rr.sensorID,
+				Datetime: rr.datetime,
+				Changes:  changes,
+				Stored:   rr.stored,
+				Replayed: rr.replayed,
+			})
+			if !opts.write || rr.stored == nil {
+				continue
+			}
+			if err := rr.replace(); err != nil {
+				return nil, err
+			}
+			report.Written++
+		}
+	}
+	return report, nil
+}
+
+// replayUpload returns the readings an upload produces now, paired with
+// the readings stored of it, and the number of readings of unknown sensors.
+// Readings stored before uploads had IDs are paired when saved after the
+// upload was received and before until.
+func replayUpload(u *archivedUpload, until time.Time) ([]*replayedReading, int, error) {
+	var pl payload
+	if err := json.Unmarshal([]byte(u.Body), &pl); err != nil {
+		return nil, 0, err
+	}
+	pl.Coordinator.UploadID = u.ID
+
+	var readings []*replayedReading
+	cr, err := replayCoordinatorReading(pl.Coordinator, u, until)
+	if err != nil {
+		return nil, 0, err
+	}
+	readings = append(readings, cr)
+
+	ticks, err := pl.convertToOldFormat(u.ReceivedAt)
+	if err != nil {
+		return nil, 0, err
+	}
+	skipped := 0
+	stored := make(map[string][]*storedTick)
+	for _, t := range ticks {
+		coordinatorID, err := findCoordinatorIDBySensorID(t.SensorID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(coordinatorID) == 0 {
+			skipped++
+			continue
+		}
+		if _, ok := stored[t.SensorID]; !ok {
+			stored[t.SensorID], err = storedTicksOf(t.SensorID, u, until)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		readings = append(readings, replayTick(t, stored[t.SensorID]))
+	}
+	return readings, skipped, nil
+}
+
+// ofUpload tells if a reading stored with the upload ID, and saved at the
+// time, is of the upload.
+func ofUpload(uploadID string, at time.Time, u *archivedUpload, until time.Time) bool {
+	if len(uploadID) > 0 {
+		return uploadID == u.ID
+	}
+	return !at.Before(u.ReceivedAt) && at.Before(until)
+}
+
+func replayCoordinatorReading(cr coordinatorReading, u *archivedUpload, until time.Time) (*replayedReading, error) {
+	key := keyOfCoordinatorReadings(cr.CoordinatorID)
+	min, max := u.ReceivedAt.Unix(), until.Unix()
+	if cr.CreatedAt != nil {
+		min, max = cr.CreatedAt.Unix(), cr.CreatedAt.Unix()
+	}
+	list, err := storedReadings(key, min, max)
+	if err != nil {
+		return nil, err
+	}
+	rr := &replayedReading{key: key}
+	for _, b := range list {
+		var stored coordinatorReading
+		if err := json.Unmarshal(b, &stored); err != nil {
+			return nil, err
+		}
+		if stored.CreatedAt == nil {
+			continue
+		}
+		if cr.CreatedAt != nil && !stored.CreatedAt.Equal(*cr.CreatedAt) {
+			continue
+		}
+		if cr.CreatedAt != nil && len(stored.UploadID) > 0 && stored.UploadID != u.ID {
+			continue
+		}
+		if cr.CreatedAt == nil && !ofUpload(stored.UploadID, *stored.CreatedAt, u, until) {
+			continue
+		}
+		rr.stored, rr.storedRaw = &stored, b
+		break
+	}
+
+	createdAt := u.ReceivedAt
+	if cr.CreatedAt != nil {
+		createdAt = *cr.CreatedAt
+	} else if rr.stored != nil {
+		createdAt = *rr.stored.(*coordinatorReading).CreatedAt
+	}
+	cr.CreatedAt = &createdAt
+	if rr.stored != nil {
+		cr.UploadID = rr.stored.(*coordinatorReading).UploadID
+	}
+	if err := cr.setBatteryVoltage(); err != nil {
+		return nil, err
+	}
+	rr.score, rr.datetime, rr.replayed = createdAt.Unix(), createdAt, &cr
+	return rr, nil
+}
+
+// storedTicksOf returns ticks of the sensor stored of the upload, oldest
+// first.
+func storedTicksOf(sensorID string, u *archivedUpload, until time.Time) ([]*storedTick, error) {
+	list, err := storedReadings(keyOfSensorTicks(sensorID), u.ReceivedAt.Unix(), until.Unix())
+	if err != nil {
+		return nil, err
+	}
+	var result []*storedTick
+	for _, b := range list {
+		var t tick
+		if err := json.Unmarshal(b, &t); err != nil {
+			return nil, err
+		}
+		if ofUpload(t.UploadID, t.Datetime, u, until) {
+			result = append(result, &storedTick{tick: &t, raw: b})
+		}
+	}
+	sort.Stable(byStoredTickDatetime(result))
+	return result, nil
+}
+
+// replayTick pairs a replayed tick with a stored tick of the upload not
+// paired yet. An upload can have several readings of a sensor, a stored
+// tick of the same raw readings is preferred.
+func replayTick(t *tick, stored []*storedTick) *replayedReading {
+	var match *storedTick
+	for _, st := range stored {
+		if st.paired {
+			continue
+		}
+		if match == nil {
+			match = st
+		}
+		if sameRawReadings(st.tick, t) {
+			match = st
+			break
+		}
+	}
+
+	rr := &replayedReading{key: keyOfSensorTicks(t.SensorID), sensorID: t.SensorID}
+	if match != nil {
+		match.paired = true
+		rr.stored, rr.storedRaw = match.tick, match.raw
+		t.Datetime, t.UploadID = match.tick.Datetime, match.tick.UploadID
+	}
+	rr.score, rr.datetime, rr.replayed = t.Datetime.Unix(), t.Datetime, t
+	return rr
+}
+
+func sameRawReadings(a, b *tick) bool {
+	return a.HardwareID == b.HardwareID &&
+		a.RawTemperature == b.RawTemperature &&
+		a.RawCPUTemperature == b.RawCPUTemperature &&
+		a.Humidity == b.Humidity &&
+		a.Sendcounter == b.Sendcounter &&
+		a.RadioQuality == b.RadioQuality
+}
+
+func storedReadings(key string, min, max int64) ([][]byte, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("ZRANGEBYSCORE", key, min, max))
+	if err != nil {
+		return nil, err
+	}
+	result := make([][]byte, len(bb))
+	for i, value := range bb {
+		result[i] = value.([]byte)
+	}
+	return result, nil
+}
+
+// replace writes the replayed reading in place of the stored one.
+func (rr *replayedReading) replace() error {
+	b, err := json.Marshal(rr.replayed)
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	tx := multi(redisClient)
+	if rr.storedRaw != nil {
+		tx.send("ZREM", rr.key, rr.storedRaw)
+	}
+	tx.send("ZADD", rr.key, rr.score, b)
+	_, err = tx.exec()
+	return err
+}
+
+// changedFields returns names of JSON fields that differ, all fields of
+// replayed when nothing is stored.
+func changedFields(stored, replayed interface{}) ([]string, error) {
+	a, err := jsonFields(stored)
+	if err != nil {
+		return nil, err
+	}
+	b, err := jsonFields(replayed)
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for name, value := range b {
+		if !reflect.DeepEqual(a[name], value) {
+			changes = append(changes, name)
+		}
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			changes = append(changes, name)
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+func jsonFields(v interface{}) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if v == nil || reflect.ValueOf(v).IsNil() {
+		return fields, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("Cannot compare readings: %v", err)
+	}
+	return fields, nil
+}
+
+type byStoredTickDatetime []*storedTick
+
+func (a byStoredTickDatetime) Len() int      { return len(a) }
+func (a byStoredTickDatetime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byStoredTickDatetime) Less(i, j int) bool {
+	return a[i].tick.Datetime.Before(a[j].tick.Datetime)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestReplayUploads(c *C) {
+	_, err := claimCoordinator("48", "")
+	c.Assert(err, IsNil)
+	c.Assert(claimSensor("8R001", "48", false), IsNil)
+
+	// coordinators send buffered readings, several of a sensor per upload
+	for _, raw := range []int64{1000, 1100} {
+		b, err := json.Marshal(&payload{Coordinator: coordinatorReading{
+			CoordinatorID:  48,
+			SensorReadings: []sensorReading{{SensorID: "8R001", SensorTemperature: raw}, {SensorID: "8R001", SensorTemperature: raw + 10}},
+		}})
+		c.Assert(err, IsNil)
+		_, err = handleJSONUpload(bytes.NewBuffer(b), nil)
+		c.Assert(err, IsNil)
+	}
+
+	opts := &replayOptions{coordinatorID: "48"}
+	report, err := replayUploads(opts)
+	c.Assert(err, IsNil)
+	c.Assert(report.Uploads, Equals, 2)
+	c.Assert(report.Readings, Equals, 6)
+	c.Assert(report.Unchanged, Equals, 6)
+	c.Assert(report.DryRun, Equals, true)
+
+	stored, err := findTicksByRange("8R001", 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(len(stored), Equals, 4)
+	uploads, err := archivedUploadsBetween("48", 0, 0)
+	c.Assert(err, IsNil)
+	for _, t := range stored {
+		c.Assert(t.UploadID == uploads[0].ID || t.UploadID == uploads[1].ID, Equals, true)
+	}
+
+	redisClient := redisPool.Get()
+	_, err = redisClient.Do("HSET", keyOfSensor("8R001"), "calibration_constant", 1.5)
+	redisClient.Close()
+	c.Assert(err, IsNil)
+
+	report, err = replayUploads(opts)
+	c.Assert(err, IsNil)
+	c.Assert(report.Changed, Equals, 4)
+	c.Assert(report.Written, Equals, 0)
+	c.Assert(report.Diffs[0].SensorID, Equals, "8R001")
+	c.Assert(report.Diffs[0].Changes, DeepEquals, []string{"temperature"})
+
+	opts.write = true
+	report, err = replayUploads(opts)
+	c.Assert(err, IsNil)
+	c.Assert(report.Written, Equals, 4)
+
+	replayed, err := findTicksByRange("8R001", 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(len(replayed), Equals, 4)
+	sort.Sort(byTickDatetime(stored))
+	sort.Sort(byTickDatetime(replayed))
+	for i := range stored {
+		c.Assert(replayed[i].RawTemperature, Equals, stored[i].RawTemperature)
+		c.Assert(replayed[i].Temperature, Equals, stored[i].Temperature+1.5)
+		c.Assert(replayed[i].Datetime.Equal(stored[i].Datetime), Equals, true)
+	}
+
+	redisClient = redisPool.Get()
+	_, err = redisClient.Do("DEL", keyOfSensorTicks("8R001"))
+	redisClient.Close()
+	c.Assert(err, IsNil)
+
+	opts.write = false
+	report, err = replayUploads(opts)
+	c.Assert(err, IsNil)
+	c.Assert(report.Missing, Equals, 4)
+	c.Assert(report.Unchanged, Equals, 2)
+
+	// deleted readings are not brought back
+	opts.write = true
+	report, err = replayUploads(opts)
+	c.Assert(err, IsNil)
+	c.Assert(report.Missing, Equals, 4)
+	c.Assert(report.Written, Equals, 0)
+	replayed, err = findTicksByRange("8R001", 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(len(replayed), Equals, 0)
+
+	_, err = replayUploads(&replayOptions{coordinatorID: "480"})
+	c.Assert(err, FitsTypeOf, unknownCoordinatorError(""))
+}
+
+type byTickDatetime []*tick
+
+func (a byTickDatetime) Len() int           { return len(a) }
+func (a byTickDatetime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTickDatetime) Less(i, j int) bool { return a[i].Datetime.Before(a[j].Datetime) }
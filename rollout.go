@@ -0,0 +1,536 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const keyRollouts = "osp:rollouts"
+
+// Unfinished rollouts of the coordinator, by rollout ID.
+func keyOfCoordinatorRollouts(coordinatorID string) string {
+	return "osp:controller:" + coordinatorID + ":rollouts"
+}
+
+// Last firmware chunk requested by each coordinator.
+const keyFirmwareDownloads = "osp:firmware_downloads"
+
+const (
+	rolloutActive    = "active"
+	rolloutPaused    = "paused"
+	rolloutCompleted = "completed"
+	rolloutCancelled = "cancelled"
+)
+
+// Firmware update status of a coordinator in a rollout.
+const (
+	updateWaiting      = "waiting" // stage has not started yet
+	updatePending      = "pending"
+	updateDownloading  = "downloading"
+	updateDownloaded   = "downloaded" // until the coordinator reports the new version
+	updateDone         = "updated"
+	updateIncompatible = "incompatible" // coordinator has another hardware revision
+	updateUnknown      = "unknown"      // coordinator has not reported its hardware revision
+)
+
+type rolloutStage struct {
+	Name           string   `json:"name"`
+	CoordinatorIDs []string `json:"coordinator_ids"`
+}
+
+// A rollout updates coordinators to a firmware in stages. Firmware is
+// offered to coordinators of the current and earlier stages. The next
+// stage starts when all coordinators of the current stage run the
+// firmware, or when the admin advances the rollout.
+type rollout struct {
+	ID               string          `json:"id"`
+	HardwareRevision string          `json:"hardware_revision"`
+	Version          string          `json:"version"`
+	Stages           []*rolloutStage `json:"stages"`
+	CurrentStage     int             `json:"current_stage"`
+	State            string          `json:"state"`
+	CreatedAt        time.Time       `json:"created_at"`
+}
+
+type firmwareDownload struct {
+	HardwareRevision string    `json:"hardware_revision"`
+	Version          string    `json:"version"`
+	Chunk            int       `json:"chunk"`
+	Chunks           int       `json:"chunks"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+type rolloutCoordinatorStatus struct {
+	CoordinatorID    string            `json:"coordinator_id"`
+	Stage            int               `json:"stage"`
+	FirmwareVersion  string            `json:"firmware_version,omitempty"`
+	HardwareRevision string            `json:"hardware_revision,omitempty"`
+	Status           string            `json:"status"`
+	Download         *firmwareDownload `json:"download,omitempty"`
+}
+
+type rolloutStatus struct {
+	*rollout
+	Counts       map[string]int              `json:"counts"` // coordinators by update status
+	Coordinators []*rolloutCoordinatorStatus `json:"coordinators"`
+}
+
+type rolloutError string
+
+func (e rolloutError) Error() string {
+	return string(e)
+}
+
+type unknownRolloutError string
+
+func (e unknownRolloutError) Error() string {
+	return fmt.Sprintf("Unknown rollout %s", string(e))
+}
+
+func (ro *rollout) validate() error {
+	if len(ro.ID) == 0 {
+		return errors.New("Missing rollout ID")
+	}
+	if _, err := loadFirmware(ro.HardwareRevision, ro.Version); err != nil {
+		return err
+	}
+	if len(ro.Stages) == 0 {
+		return rolloutError("Rollout needs at least one stage")
+	}
+	seen := make(map[string]bool)
+	for i, stage := range ro.Stages {
+		if len(stage.Name) == 0 {
+			stage.Name = fmt.Sprintf("Stage %d", i+1)
+		}
+		if len(stage.CoordinatorIDs) == 0 {
+			return rolloutError(stage.Name + " has no coordinators")
+		}
+		for _, coordinatorID := range stage.CoordinatorIDs {
+			if seen[coordinatorID] {
+				return rolloutError(fmt.Sprintf("Coordinator %s is in more than one stage", coordinatorID))
+			}
+			seen[coordinatorID] = true
+		}
+	}
+	return nil
+}
+
+func (ro *rollout) finished() bool {
+	return ro.State == rolloutCompleted || ro.State == rolloutCancelled
+}
+
+// stageOf returns the stage of the coordinator, or -1 when it's not in the
+// rollout.
+func (ro *rollout) stageOf(coordinatorID string) int {
+	for i, stage := range ro.Stages {
+		for _, id := range stage.CoordinatorIDs {
+			if id == coordinatorID {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func loadRollout(rolloutID string) (*rollout, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	return readRollout(redisClient, rolloutID)
+}
+
+func readRollout(redisClient redis.Conn, rolloutID string) (*rollout, error) {
+	b, err := redis.Bytes(redisClient.Do("HGET", keyRollouts, rolloutID))
+	if err == redis.ErrNil {
+		return nil, unknownRolloutError(rolloutID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ro rollout
+	if err := json.Unmarshal(b, &ro); err != nil {
+		return nil, err
+	}
+	return &ro, nil
+}
+
+// save stores the rollout. A new rollout starts from its first stage, an
+// existing one keeps its state.
+func (ro *rollout) save() error {
+	if err := ro.validate(); err != nil {
+		return err
+	}
+	_, err := updateRollout(ro.ID, func(old *rollout) (*rollout, error) {
+		if old == nil {
+			old = &rollout{State: rolloutActive, CreatedAt: time.Now()}
+		}
+		ro.State = old.State
+		ro.CreatedAt = old.CreatedAt
+		ro.CurrentStage = old.CurrentStage
+		if ro.CurrentStage >= len(ro.Stages) {
+			ro.CurrentStage = len(ro.Stages) - 1
+		}
+		return ro, nil
+	})
+	return err
+}
+
+// updateRollout stores the rollout returned by change, which gets the
+// stored rollout or nil. The rollout is watched against concurrent changes,
+// and changed again when it was changed meanwhile. When change returns nil,
+// nothing is stored.
+func updateRollout(rolloutID string, change func(old *rollout) (*rollout, error)) (*rollout, error) {
+	for i := 0; i < maxTransactionRetries; i++ {
+		ro, done, err := tryUpdateRollout(rolloutID, change)
+		if err != nil || done {
+			return ro, err
+		}
+	}
+	return nil, fmt.Errorf("Rollout %s was changed concurrently, try again", rolloutID)
+}
+
+// tryUpdateRollout tells false when the rollout was changed concurrently
+// and nothing was stored.
+func tryUpdateRollout(rolloutID string, change func(old *rollout) (*rollout, error)) (*rollout, bool, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	if _, err := redisClient.Do("WATCH", keyRollouts); err != nil {
+		return nil, false, err
+	}
+	old, err := readRollout(redisClient, rolloutID)
+	if _, ok := err.(unknownRolloutError); ok {
+		old, err = nil, nil
+	}
+	var ro *rollout
+	if err == nil {
+		ro, err = change(old)
+	}
+	if err != nil || ro == nil {
+		redisClient.Do("UNWATCH")
+		return old, err == nil, err
+	}
+
+	tx := multi(redisClient)
+	b, err := json.Marshal(ro)
+	if err != nil {
+		tx.fail(err)
+	}
+	tx.send("HSET", keyRollouts, ro.ID, b)
+	if old != nil {
+		for _, stage := range old.Stages {
+			for _, coordinatorID := range stage.CoordinatorIDs {
+				tx.send("SREM", keyOfCoordinatorRollouts(coordinatorID), ro.ID)
+			}
+		}
+	}
+	if !ro.finished() {
+		for _, stage := range ro.Stages {
+			for _, coordinatorID := range stage.CoordinatorIDs {
+				tx.send("SADD", keyOfCoordinatorRollouts(coordinatorID), ro.ID)
+			}
+		}
+	}
+	reply, err := tx.exec()
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	return ro, true, nil
+}
+
+func rollouts() ([]*rollout, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("HVALS", keyRollouts))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*rollout, 0)
+	for _, value := range bb {
+		var ro rollout
+		if err := json.Unmarshal(value.([]byte), &ro); err != nil {
+			return nil, err
+		}
+		result = append(result, &ro)
+	}
+	sort.Sort(byRolloutID(result))
+	return result, nil
+}
+
+type byRolloutID []*rollout
+
+func (a byRolloutID) Len() int           { return len(a) }
+func (a byRolloutID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRolloutID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// apply changes the state of the rollout by an admin action, one of
+// advance, pause, resume and cancel.
+func (ro *rollout) apply(action string) error {
+	updated, err := updateRollout(ro.ID, func(old *rollout) (*rollout, error) {
+		if old == nil {
+			return nil, unknownRolloutError(ro.ID)
+		}
+		if old.finished() {
+			return nil, rolloutError("Rollout is " + old.State)
+		}
+		switch action {
+		case "advance":
+			old.advance()
+		case "pause":
+			old.State = rolloutPaused
+		case "resume":
+			old.State = rolloutActive
+		case "cancel":
+			old.State = rolloutCancelled
+		default:
+			return nil, rolloutError("Unknown rollout action " + action)
+		}
+		return old, nil
+	})
+	if err != nil {
+		return err
+	}
+	*ro = *updated
+	return nil
+}
+
+func (ro *rollout) advance() {
+	if ro.CurrentStage+1 < len(ro.Stages) {
+		ro.CurrentStage++
+		return
+	}
+	ro.State = rolloutCompleted
+}
+
+// coordinatorFirmware returns the firmware version and hardware revision
+// the coordinator last reported.
+func coordinatorFirmware(coordinatorID string) (string, string, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	values, err := redis.Strings(redisClient.Do("HMGET", keyOfCoordinator(coordinatorID), "firmware_version", "hardware_revision"))
+	if err != nil {
+		return "", "", err
+	}
+	return values[0], values[1], nil
+}
+
+func recordCoordinatorFirmware(cr *coordinatorReading) error {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	key := keyOfCoordinator(fmt.Sprintf("%d", cr.CoordinatorID))
+	if len(cr.FirmwareVersion) > 0 {
+		if _, err := redisClient.Do("HSET", key, "firmware_version", cr.FirmwareVersion); err != nil {
+			return err
+		}
+	}
+	if len(cr.HardwareRevision) > 0 {
+		if _, err := redisClient.Do("HSET", key, "hardware_revision", cr.HardwareRevision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordFirmwareDownload(coordinatorID string, f *firmware, chunk int) error {
+	b, err := json.Marshal(&firmwareDownload{
+		HardwareRevision: f.HardwareRevision,
+		Version:          f.Version,
+		Chunk:            chunk,
+		Chunks:           f.Chunks,
+		UpdatedAt:        time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	_, err = redisClient.Do("HSET", keyFirmwareDownloads, coordinatorID, b)
+	return err
+}
+
+func loadFirmwareDownload(coordinatorID string) (*firmwareDownload, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	b, err := redis.Bytes(redisClient.Do("HGET", keyFirmwareDownloads, coordinatorID))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d firmwareDownload
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (ro *rollout) coordinatorStatus(coordinatorID string, stage int) (*rolloutCoordinatorStatus, error) {
+	s := &rolloutCoordinatorStatus{CoordinatorID: coordinatorID, Stage: stage}
+	var err error
+	s.FirmwareVersion, s.HardwareRevision, err = coordinatorFirmware(coordinatorID)
+	if err != nil {
+		return nil, err
+	}
+	download, err := loadFirmwareDownload(coordinatorID)
+	if err != nil {
+		return nil, err
+	}
+	if download != nil && download.HardwareRevision == ro.HardwareRevision && download.Version == ro.Version {
+		s.Download = download
+	}
+
+	switch {
+	case len(s.HardwareRevision) == 0:
+		s.Status = updateUnknown
+	case s.HardwareRevision != ro.HardwareRevision:
+		s.Status = updateIncompatible
+	case s.FirmwareVersion == ro.Version:
+		s.Status = updateDone
+	case stage > ro.CurrentStage && ro.State != rolloutCompleted:
+		s.Status = updateWaiting
+	case s.Download == nil:
+		s.Status = updatePending
+	case s.Download.Chunk == s.Download.Chunks-1:
+		s.Status = updateDownloaded
+	default:
+		s.Status = updateDownloading
+	}
+	return s, nil
+}
+
+func (ro *rollout) status() (*rolloutStatus, error) {
+	result := &rolloutStatus{rollout: ro, Counts: make(map[string]int)}
+	for i, stage := range ro.Stages {
+		for _, coordinatorID := range stage.CoordinatorIDs {
+			s, err := ro.coordinatorStatus(coordinatorID, i)
+			if err != nil {
+				return nil, err
+			}
+			result.Coordinators = append(result.Coordinators, s)
+			result.Counts[s.Status]++
+		}
+	}
+	return result, nil
+}
+
+// stageUpdated tells whether all coordinators of the current stage, that
+// can run the firmware, have been updated.
+func (ro *rollout) stageUpdated() (bool, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	coordinatorIDs := ro.Stages[ro.CurrentStage].CoordinatorIDs
+	for _, coordinatorID := range coordinatorIDs {
+		redisClient.Send("HMGET", keyOfCoordinator(coordinatorID), "firmware_version", "hardware_revision")
+	}
+	if err := redisClient.Flush(); err != nil {
+		return false, err
+	}
+	updated := true
+	for range coordinatorIDs {
+		values, err := redis.Strings(redisClient.Receive())
+		if err != nil {
+			return false, err
+		}
+		version, revision := values[0], values[1]
+		if len(revision) == 0 || (revision == ro.HardwareRevision && version != ro.Version) {
+			updated = false
+		}
+	}
+	return updated, nil
+}
+
+// checkStage advances an active rollout when all coordinators of its
+// current stage, that can run the firmware, have been updated. Only the
+// stage checked is advanced, when the rollout was changed meanwhile.
+func (ro *rollout) checkStage() error {
+	if ro.State != rolloutActive {
+		return nil
+	}
+	updated, err := ro.stageUpdated()
+	if err != nil || !updated {
+		return err
+	}
+	checked := ro.CurrentStage
+	latest, err := updateRollout(ro.ID, func(old *rollout) (*rollout, error) {
+		if old == nil || old.State != rolloutActive || old.CurrentStage != checked {
+			return nil, nil
+		}
+		old.advance()
+		return old, nil
+	})
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		*ro = *latest
+	}
+	return nil
+}
+
+// firmwareOfferOf records the firmware the coordinator reported in its
+// upload, and returns the firmware it should update to, if any.
+func firmwareOfferOf(cr *coordinatorReading) (*firmware, error) {
+	if err := recordCoordinatorFirmware(cr); err != nil {
+		return nil, err
+	}
+	coordinatorID := fmt.Sprintf("%d", cr.CoordinatorID)
+
+	redisClient := redisPool.Get()
+	rolloutIDs, err := redis.Strings(redisClient.Do("SMEMBERS", keyOfCoordinatorRollouts(coordinatorID)))
+	redisClient.Close()
+	if err != nil {
+		return nil, err
+	}
+	var offered *rollout
+	for _, rolloutID := range rolloutIDs {
+		ro, err := loadRollout(rolloutID)
+		if _, ok := err.(unknownRolloutError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stage := ro.stageOf(coordinatorID)
+		if stage < 0 || ro.finished() {
+			continue
+		}
+		// the stage can only be finished by its own coordinators
+		if stage == ro.CurrentStage {
+			if err := ro.checkStage(); err != nil {
+				return nil, err
+			}
+		}
+		if ro.State != rolloutActive || stage > ro.CurrentStage {
+			continue
+		}
+		if offered == nil || ro.CreatedAt.After(offered.CreatedAt) {
+			offered = ro
+		}
+	}
+	if offered == nil {
+		return nil, nil
+	}
+
+	s, err := offered.coordinatorStatus(coordinatorID, offered.stageOf(coordinatorID))
+	if err != nil {
+		return nil, err
+	}
+	switch s.Status {
+	case updatePending, updateDownloading, updateDownloaded:
+		return loadFirmware(offered.HardwareRevision, offered.Version)
+	}
+	return nil, nil
+}
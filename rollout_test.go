@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestRollout(c *C) {
+	_, err := saveFirmware("R1", "2.0", "", bytes.Repeat([]byte{1}, 3000))
+	c.Assert(err, IsNil)
+	for _, id := range []string{"451", "452", "453"} {
+		_, err := claimCoordinator(id, "")
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert((&rollout{ID: "r", HardwareRevision: "R1", Version: "3.0",
+		Stages: []*rolloutStage{{CoordinatorIDs: []string{"451"}}}}).save(), FitsTypeOf, unknownFirmwareError(""))
+	c.Assert((&rollout{ID: "r", HardwareRevision: "R1", Version: "2.0",
+		Stages: []*rolloutStage{{CoordinatorIDs: []string{"451"}}, {CoordinatorIDs: []string{"451"}}}}).save(), FitsTypeOf, rolloutError(""))
+
+	ro := &rollout{ID: "r", HardwareRevision: "R1", Version: "2.0", Stages: []*rolloutStage{
+		{Name: "pilot", CoordinatorIDs: []string{"451", "452"}},
+		{CoordinatorIDs: []string{"453"}},
+	}}
+	c.Assert(ro.save(), IsNil)
+	c.Assert(ro.State, Equals, rolloutActive)
+	c.Assert(ro.Stages[1].Name, Equals, "Stage 2")
+
+	upload := func(coordinatorID int64, version, revision string) *firmware {
+		b, err := json.Marshal(&payload{Coordinator: coordinatorReading{
+			CoordinatorID: coordinatorID, FirmwareVersion: version, HardwareRevision: revision,
+		}})
+		c.Assert(err, IsNil)
+		u, err := handleJSONUpload(bytes.NewBuffer(b), nil)
+		c.Assert(err, IsNil)
+		return u.response.Firmware
+	}
+
+	// later stage waits, other hardware gets nothing
+	c.Assert(upload(453, "1.0", "R1"), IsNil)
+	c.Assert(upload(452, "1.0", "R0"), IsNil)
+
+	offer := upload(451, "1.0", "R1")
+	c.Assert(offer, NotNil)
+	c.Assert(offer.Version, Equals, "2.0")
+	c.Assert(offer.Chunks, Equals, 3)
+
+	_, err = handleFirmwareChunkRequest(&firmwareChunkRequest{CoordinatorID: 451, HardwareRevision: "R1", Version: "2.0", Chunk: 2})
+	c.Assert(err, IsNil)
+
+	status, err := ro.status()
+	c.Assert(err, IsNil)
+	c.Assert(status.Counts, DeepEquals, map[string]int{updateDownloaded: 1, updateIncompatible: 1, updateWaiting: 1})
+
+	// pilot done, incompatible coordinator doesn't hold the rollout back
+	c.Assert(upload(451, "2.0", "R1"), IsNil)
+	ro, err = loadRollout("r")
+	c.Assert(err, IsNil)
+	c.Assert(ro.CurrentStage, Equals, 1)
+
+	stale := *ro
+	c.Assert(ro.apply("pause"), IsNil)
+	c.Assert(upload(453, "1.0", "R1"), IsNil)
+	c.Assert(upload(453, "2.0", "R1"), IsNil)
+	// a stage checked on an outdated copy doesn't undo the pause
+	c.Assert(stale.checkStage(), IsNil)
+	ro, err = loadRollout("r")
+	c.Assert(err, IsNil)
+	c.Assert(ro.State, Equals, rolloutPaused)
+	c.Assert(ro.CurrentStage, Equals, 1)
+	upload(453, "1.0", "R1")
+	c.Assert(ro.apply("resume"), IsNil)
+	c.Assert(upload(453, "1.0", "R1"), NotNil)
+
+	c.Assert(upload(453, "2.0", "R1"), IsNil)
+	ro, err = loadRollout("r")
+	c.Assert(err, IsNil)
+	c.Assert(ro.State, Equals, rolloutCompleted)
+	c.Assert(ro.apply("advance"), FitsTypeOf, rolloutError(""))
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+	rolloutIDs, err := redis.Strings(redisClient.Do("SMEMBERS", keyOfCoordinatorRollouts("453")))
+	c.Assert(err, IsNil)
+	c.Assert(rolloutIDs, HasLen, 0)
+	c.Assert(deleteFirmware("R1", "2.0"), IsNil)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Number of sessions kept of each coordinator, and of connections that
+// could not be attributed to any coordinator.
+const sessionHistoryLength = 1000
+
+// Sessions whose upload did not tell a coordinator ID.
+const keyUnidentifiedSessions = "osp:sessions:unidentified"
+
+func keyOfCoordinatorSessions(coordinatorID string) string {
+	return "osp:controller:" + coordinatorID + ":sessions"
+}
+
+// Outcomes of an upload session.
+const (
+	sessionOK           = "ok"
+	sessionTimeout      = "timeout"
+	sessionReadError    = "read_error"
+	sessionParseError   = "parse_error"
+	sessionInvalid      = "invalid"
+	sessionRefused      = "refused" // server was busy
+	sessionStorageError = "storage_error"
+	sessionWriteError   = "write_error"
+)
+
+// A session is a connection of a coordinator to the upload listener.
+// Duration is from accepting the connection to sending the response.
+type session struct {
+	RemoteAddr    string    `json:"remote_addr"`
+	Port          int       `json:"port"`
+	CoordinatorID string    `json:"coordinator_id,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	Duration      float64   `json:"duration"` // sec
+	BytesReceived int64     `json:"bytes_received"`
+	BytesSent     int64     `json:"bytes_sent"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+
+	bytesReceived int64 // updated while reading, use atomically
+}
+
+func newSession(conn net.Conn, port int) *session {
+	return &session{
+		RemoteAddr: conn.RemoteAddr().String(),
+		Port:       port,
+		StartedAt:  time.Now(),
+		Outcome:    sessionOK,
+	}
+}
+
+func (s *session) received(n int) {
+	atomic.AddInt64(&s.bytesReceived, int64(n))
+}
+
+func (s *session) fail(outcome string, err error) {
+	s.Outcome = outcome
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// finish stores the session under its coordinator, or with unidentified
+// sessions when the coordinator is not known.
+func (s *session) finish() error {
+	s.Duration = time.Since(s.StartedAt).Seconds()
+	s.BytesReceived = atomic.LoadInt64(&s.bytesReceived)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	key := keyUnidentifiedSessions
+	if len(s.CoordinatorID) > 0 {
+		key = keyOfCoordinatorSessions(s.CoordinatorID)
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	if _, err := redisClient.Do("LPUSH", key, b); err != nil {
+		return err
+	}
+	_, err = redisClient.Do("LTRIM", key, 0, sessionHistoryLength-1)
+	return err
+}
+
+// Matches the coordinator ID also in truncated or otherwise broken uploads.
+var coordinatorIDPattern = regexp.MustCompile(`"coordinator_id"\s*:\s*"?(\d+)`)
+
+func coordinatorIDOfUpload(b []byte) string {
+	m := coordinatorIDPattern.FindSubmatch(b)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+// sessionOutcomeOf tells if upload processing failed because the upload
+// could not be parsed, was invalid, or could not be stored.
+func sessionOutcomeOf(err error) string {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return sessionParseError
+	}
+	if isValidationError(err) {
+		return sessionInvalid
+	}
+	return sessionStorageError
+}
+
+func sessionsOfKey(key string, offset, count int) ([]*session, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("LRANGE", key, offset, offset+count-1))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*session, 0)
+	for _, value := range bb {
+		var s session
+		if err := json.Unmarshal(value.([]byte), &s); err != nil {
+			return nil, err
+		}
+		result = append(result, &s)
+	}
+	return result, nil
+}
+
+// coordinatorSessions returns sessions of the coordinator, latest first.
+func coordinatorSessions(coordinatorID string, offset, count int) ([]*session, error) {
+	return sessionsOfKey(keyOfCoordinatorSessions(coordinatorID), offset, count)
+}
+
+// unidentifiedSessions returns sessions that could not be attributed to a
+// coordinator, latest first.
+func unidentifiedSessions(offset, count int) ([]*session, error) {
+	return sessionsOfKey(keyUnidentifiedSessions, offset, count)
+}
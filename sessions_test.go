@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestCoordinatorIDOfUpload(c *C) {
+	c.Assert(coordinatorIDOfUpload([]byte(`{"coordinator": {"coordinator_id": 46, "gsm_cov`)), Equals, "46")
+	c.Assert(coordinatorIDOfUpload([]byte(`{"firmware_chunk":{"coordinator_id":"12"}}`)), Equals, "12")
+	c.Assert(coordinatorIDOfUpload([]byte(`garbage`)), Equals, "")
+}
+
+func uploadOverConnection(c *C, input string) string {
+	server, client := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		handleConnection(server, 0, handleJSONUpload)
+		done <- true
+	}()
+	_, err := client.Write([]byte(input))
+	c.Assert(err, IsNil)
+	_, err = client.Write([]byte("\r\n"))
+	c.Assert(err, IsNil)
+	response, _ := bufio.NewReader(client).ReadString('\n')
+	client.Close()
+	<-done
+	return response
+}
+
+func (s *TestSuite) TestSessions(c *C) {
+	_, err := claimCoordinator("46", "")
+	c.Assert(err, IsNil)
+
+	input := `{"coordinator": {"coordinator_id": 46, "gsm_coverage": 10}}`
+	response := uploadOverConnection(c, input)
+	var ur uploadResponse
+	c.Assert(json.Unmarshal([]byte(response), &ur), IsNil)
+
+	uploadOverConnection(c, `{"coordinator": {"coordinator_id": 46, "gsm_cov`)
+
+	list, err := coordinatorSessions("46", 0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(len(list) >= 2, Equals, true)
+	c.Assert(list[0].Outcome, Equals, sessionParseError)
+	c.Assert(list[0].Error, Not(Equals), "")
+	c.Assert(list[1].Outcome, Equals, sessionOK)
+	c.Assert(list[1].CoordinatorID, Equals, "46")
+	c.Assert(list[1].BytesReceived, Equals, int64(len(input)+2))
+	c.Assert(list[1].BytesSent, Equals, int64(len(response)))
+
+	list, err = coordinatorSessions("46", 1, 1)
+	c.Assert(err, IsNil)
+	c.Assert(len(list), Equals, 1)
+	c.Assert(list[0].Outcome, Equals, sessionOK)
+
+	uploadOverConnection(c, `hello`)
+	list, err = unidentifiedSessions(0, 1)
+	c.Assert(err, IsNil)
+	c.Assert(len(list), Equals, 1)
+	c.Assert(list[0].Outcome, Equals, sessionParseError)
+}
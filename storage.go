@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -18,7 +15,6 @@ var redisPool *redis.Pool
 const keyCoordinators = "osp:controllers"
 const keySensorToController = "osp:sensor_to_controller"
 const loggingKeyCSV = "osp:logs"
-const loggingKeyJSON = "osp:logs:v2"
 
 func keyOfSensor(sensorID string) string {
 	return fmt.Sprintf("osp:sensor:%s:fields", sensorID)
@@ -36,21 +32,16 @@ func keyOfSensorTicks(sensorID string) string {
 	return fmt.Sprintf("osp:sensor:%s:ticks", sensorID)
 }
 
-func keyOfCoordinatorReadings(coordinatorID int64) string {
-	return fmt.Sprintf("osp:coordinator:%v:readings", coordinatorID)
+func keyOfSensorChannels(sensorID string) string {
+	return fmt.Sprintf("osp:sensor:%s:channels", sensorID)
 }
 
-func saveLog(buf *bytes.Buffer, loggingKey string) error {
-	redisClient := redisPool.Get()
-	defer redisClient.Close()
+func keyOfSensorCalibrationPoints(sensorID string) string {
+	return fmt.Sprintf("osp:sensor:%s:calibration_points", sensorID)
+}
 
-	if _, err := redisClient.Do("LPUSH", loggingKey, time.Now().String()+" "+buf.String()); err != nil {
-		return err
-	}
-	if _, err := redisClient.Do("LTRIM", loggingKey, 0, 1000); err != nil {
-		return err
-	}
-	return nil
+func keyOfCoordinatorReadings(coordinatorID int64) string {
+	return fmt.Sprintf("osp:coordinator:%v:readings", coordinatorID)
 }
 
 func getRedisPool(host string) *redis.Pool {
@@ -67,6 +58,41 @@ func getRedisPool(host string) *redis.Pool {
 	}
 }
 
+// A transaction queues commands between MULTI and EXEC. After the first
+// error nothing more is queued and the transaction is discarded, so that
+// the connection does not go back to the pool in MULTI state.
+type transaction struct {
+	conn redis.Conn
+	err  error
+}
+
+func multi(conn redis.Conn) *transaction {
+	return &transaction{conn: conn, err: conn.Send("MULTI")}
+}
+
+func (tx *transaction) send(commandName string, args ...interface{}) {
+	if tx.err == nil {
+		tx.err = tx.conn.Send(commandName, args...)
+	}
+}
+
+// fail aborts the transaction, exec returns the error.
+func (tx *transaction) fail(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+// exec runs the queued commands, or discards them if anything failed. When
+// a watched key was changed, the reply is nil.
+func (tx *transaction) exec() (interface{}, error) {
+	if tx.err != nil {
+		tx.conn.Do("DISCARD")
+		return nil, tx.err
+	}
+	return tx.conn.Do("EXEC")
+}
+
 func findCoordinatorIDBySensorID(sensorID string) (string, error) {
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
@@ -77,6 +103,32 @@ func findCoordinatorIDBySensorID(sensorID string) (string, error) {
 	return id, nil
 }
 
+// findCoordinatorIDsBySensorIDs returns the coordinators the sensors are
+// assigned to, each once, in order.
+func findCoordinatorIDsBySensorIDs(sensorIDs []string) ([]string, error) {
+	if len(sensorIDs) == 0 {
+		return nil, nil
+	}
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	args := []interface{}{keySensorToController}
+	for _, id := range sensorIDs {
+		args = append(args, id)
+	}
+	ids, err := redis.Strings(redisClient.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, id := range uniqueSorted(ids) {
+		if len(id) > 0 {
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
 func findTicksByScore(sensorID string, start, end int) ([]*tick, error) {
 	return findTicksUsingCommand("ZRANGEBYSCORE", sensorID, start, end)
 }
@@ -85,11 +137,18 @@ func findTicksByRange(sensorID string, startIndex, stopIndex int) ([]*tick, erro
 	return findTicksUsingCommand("ZREVRANGE", sensorID, startIndex, stopIndex)
 }
 
-func findTicksUsingCommand(command, sensorID string, start, end int) ([]*tick, error) {
+// findTicksByScorePage returns at most count ticks in score range,
+// skipping first offset ticks.
+func findTicksByScorePage(sensorID string, start, end, offset, count int) ([]*tick, error) {
+	return findTicksUsingCommand("ZRANGEBYSCORE", sensorID, start, end, "LIMIT", offset, count)
+}
+
+func findTicksUsingCommand(command, sensorID string, start, end int, extraArgs ...interface{}) ([]*tick, error) {
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
 
-	bb, err := redisClient.Do(command, keyOfSensorTicks(sensorID), start, end)
+	args := append([]interface{}{keyOfSensorTicks(sensorID), start, end}, extraArgs...)
+	bb, err := redisClient.Do(command, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -107,10 +166,18 @@ func findTicksUsingCommand(command, sensorID string, start, end int) ([]*tick, e
 }
 
 func coordinatorReadings(coordinatorID int64, startIndex, stopIndex int) ([]*coordinatorReading, error) {
+	return coordinatorReadingsUsingCommand("ZREVRANGE", coordinatorID, startIndex, stopIndex)
+}
+
+func coordinatorReadingsByScore(coordinatorID int64, start, end int) ([]*coordinatorReading, error) {
+	return coordinatorReadingsUsingCommand("ZRANGEBYSCORE", coordinatorID, start, end)
+}
+
+func coordinatorReadingsUsingCommand(command string, coordinatorID int64, start, end int) ([]*coordinatorReading, error) {
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
 
-	bb, err := redisClient.Do("ZREVRANGE", keyOfCoordinatorReadings(coordinatorID), startIndex, stopIndex)
+	bb, err := redisClient.Do(command, keyOfCoordinatorReadings(coordinatorID), start, end)
 	if err != nil {
 		return nil, err
 	}
@@ -197,10 +264,20 @@ func loadCoordinator(coordinatorID string) (*coordinator, error) {
 			c.Token = field
 		case "label":
 			c.Label = field
+		case "profile":
+			c.Profile = field
+		case "firmware_version":
+			c.FirmwareVersion = field
+		case "hardware_revision":
+			c.HardwareRevision = field
 		}
 	}
 
 	c.ID = coordinatorID
+	if len(c.Token) > 0 {
+		// stored token is stale when the token secret has been changed
+		c.Token = tokenForCoordinator(coordinatorID)
+	}
 	c.URL = fmt.Sprintf("http://ardusensor.com/index.html#/%s/%s", coordinatorID, c.Token)
 	c.LogURL = fmt.Sprintf("http://ardusensor.com/api/coordinators/%s/log", coordinatorID)
 
@@ -211,9 +288,6 @@ func setCoordinatorLabel(coordinatorID, label string) error {
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
 
-	if _, err := redisClient.Do("SADD", keyCoordinators, coordinatorID); err != nil {
-		return err
-	}
 	_, err := redisClient.Do("HSET", keyOfCoordinator(coordinatorID), "label", label)
 	if err != nil {
 		return err
@@ -222,73 +296,61 @@ func setCoordinatorLabel(coordinatorID, label string) error {
 	return nil
 }
 
-func addSensorToCoordinator(sensorID, coordinatorID string) error {
+func setCoordinatorProfile(coordinatorID, profileName string) error {
+	profile, err := loadSensorProfile(profileName)
+	if err != nil {
+		return err
+	}
+
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
 
-	if _, err := redisClient.Do("HSET", keySensorToController, sensorID, coordinatorID); err != nil {
-		return err
-	}
-	if _, err := redisClient.Do("SADD", keyOfCoordinatorSensors(coordinatorID), sensorID); err != nil {
-		return err
-	}
-	return nil
+	_, err = redisClient.Do("HSET", keyOfCoordinator(coordinatorID), "profile", profile.Name)
+	return err
 }
 
 func (s *sensor) save() error {
 	if len(s.ID) == 0 {
 		return errors.New("missing sensor ID")
 	}
+	if err := validateLocation(s.Lat, s.Lng); err != nil {
+		return err
+	}
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
 
-	if err := s.calculateCalibrationConstant(); err != nil {
-		return err
+	if len(s.Profile) > 0 {
+		profile, err := loadSensorProfile(s.Profile)
+		if err != nil {
+			return err
+		}
+		if _, err := redisClient.Do("HSET", keyOfSensor(s.ID), "profile", profile.Name); err != nil {
+			return err
+		}
 	}
 
-	_, err := redisClient.Do("HMSET", keyOfSensor(s.ID),
-		"lat", s.Lat,
-		"lng", s.Lng,
-		"label", s.Label)
-	if err != nil {
-		return err
+	if len(s.Material) > 0 {
+		if _, err := loadMoistureCurve(s.Material); err != nil {
+			return err
+		}
+		if _, err := redisClient.Do("HSET", keyOfSensor(s.ID), "material", s.Material); err != nil {
+			return err
+		}
 	}
-	return err
-}
 
-func (s *sensor) calculateCalibrationConstant() error {
-	if s.CurrentTemperature == nil {
-		return nil
-	}
-	log.Println("[CALIBRATION] Calculating")
-	lastTick, err := lastTickOfSensor(s.ID)
-	if err != nil {
+	if err := s.calibrate(); err != nil {
 		return err
 	}
-	log.Println("[CALIBRATION] Last tick is", lastTick)
-	if lastTick != nil {
-		log.Println("[CALIBRATION] current temperature is", *s.CurrentTemperature)
-		log.Println("[CALIBRATION] uncalibrated temperature of last tick is", lastTick.calculateTemperatureFromRaw())
-		newValue := *s.CurrentTemperature - lastTick.calculateTemperatureFromRaw()
-		log.Println("[CALIBRATION] new value is", newValue)
-		s.CalibrationConstant = &newValue
-		if s.CalibrationConstant != nil {
-			log.Println("[CALIBRATION] saving new value", *s.CalibrationConstant)
-			redisClient := redisPool.Get()
-			defer redisClient.Close()
-
-			if _, err := redisClient.Do("HSET", keyOfSensor(s.ID), "calibration_constant", *s.CalibrationConstant); err != nil {
-				return err
-			}
-		}
+
+	if err := setSensorLocation(redisClient, s.ID, s.Lat, s.Lng); err != nil {
+		return err
 	}
 
-	log.Println("[CALIBRATION] setting current temp to nil again")
-	s.CurrentTemperature = nil
-	return nil
+	_, err := redisClient.Do("HSET", keyOfSensor(s.ID), "label", s.Label)
+	return err
 }
 
-func sensorsOfCoordinator(coordinatorID string) ([]*sensor, error) {
+func sensorIDsOfCoordinator(coordinatorID string) ([]string, error) {
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
 
@@ -299,6 +361,14 @@ func sensorsOfCoordinator(coordinatorID string) ([]*sensor, error) {
 		}
 		return nil, err
 	}
+	return ids, nil
+}
+
+func sensorsOfCoordinator(coordinatorID string) ([]*sensor, error) {
+	ids, err := sensorIDsOfCoordinator(coordinatorID)
+	if err != nil {
+		return nil, err
+	}
 
 	sensors := make([]*sensor, 0)
 	for _, sensorID := range ids {
@@ -319,6 +389,14 @@ func sensorsOfCoordinator(coordinatorID string) ([]*sensor, error) {
 			s.LastTick = &lastTick.Datetime
 		}
 
+		hardwareID, err := currentHardwareID(sensorID)
+		if err != nil {
+			return nil, err
+		}
+		if hardwareID != sensorID {
+			s.HardwareID = hardwareID
+		}
+
 		sensors = append(sensors, s)
 	}
 	return sensors, nil
@@ -328,57 +406,60 @@ func loadSensor(coordinatorID, sensorID string) (*sensor, error) {
 	redisClient := redisPool.Get()
 	defer redisClient.Close()
 
-	list, err := redis.Strings(redisClient.Do("HMGET", keyOfSensor(sensorID), "lat", "lng", "label", "calibration_constant"))
+	list, err := redis.Strings(redisClient.Do("HMGET", keyOfSensor(sensorID), "lat", "lng", "label", "calibration_constant", "calibration_gain", "profile", "material"))
 	if err != nil {
 		return nil, err
 	}
-	var cc *float64
-	if len(list[3]) > 0 && list[3] != "<nil>" {
-		value, err := strconv.ParseFloat(list[3], 64)
-		if err != nil {
-			return nil, err
-		}
-		cc = &value
+	cc, err := parseOptionalFloat(list[3])
+	if err != nil {
+		return nil, err
+	}
+	gain, err := parseOptionalFloat(list[4])
+	if err != nil {
+		return nil, err
+	}
+	profile, err := loadSensorProfile(list[5])
+	if err != nil {
+		return nil, err
+	}
+	lat, lng, err := parseLocation(list[0], list[1])
+	if err != nil {
+		// free text of old clients, logged when locations are indexed
+		lat, lng = nil, nil
 	}
 
 	return &sensor{
 		ID:                  sensorID,
 		ControllerID:        coordinatorID,
-		Lat:                 list[0],
-		Lng:                 list[1],
+		Lat:                 lat,
+		Lng:                 lng,
 		Label:               list[2],
 		CalibrationConstant: cc,
+		CalibrationGain:     gain,
+		Profile:             profile.Name,
+		profile:             profile,
+		Material:            list[6],
 	}, nil
 }
 
-func lastTickOfSensor(sensorID string) (*tick, error) {
-	ticks, err := findTicksByRange(sensorID, 0, 0)
+func parseOptionalFloat(s string) (*float64, error) {
+	if len(s) == 0 || s == "<nil>" {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
 	if err != nil {
 		return nil, err
 	}
-	if len(ticks) > 0 {
-		return ticks[0], nil
-	}
-	return nil, nil
+	return &value, nil
 }
 
-func getLogs(key string, coordinatorID int) ([]byte, error) {
-	redisClient := redisPool.Get()
-	defer redisClient.Close()
-
-	bb, err := redisClient.Do("LRANGE", key, 0, 1000)
+func lastTickOfSensor(sensorID string) (*tick, error) {
+	ticks, err := findTicksByRange(sensorID, 0, 0)
 	if err != nil {
 		return nil, err
 	}
-
-	buf := bytes.NewBuffer(nil)
-	for _, item := range bb.([]interface{}) {
-		s := string(item.([]byte))
-		if coordinatorID == 0 || strings.Contains(s, fmt.Sprintf("coordinator_id\":%d", coordinatorID)) {
-			s = strconv.Quote(s)
-			buf.WriteString(s)
-			buf.WriteString("\n\r")
-		}
+	if len(ticks) > 0 {
+		return ticks[0], nil
 	}
-	return buf.Bytes(), nil
+	return nil, nil
 }
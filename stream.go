@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/toggl/bugsnag"
+)
+
+const keyEventsChannel = "osp:events"
+const keyEventsHistory = "osp:events:history"
+const keyEventsID = "osp:events:id"
+
+const eventsHistoryLength = 5000
+const streamKeepaliveSeconds = 15
+
+const (
+	eventTypeReading     = "reading"
+	eventTypeCoordinator = "coordinator"
+	eventTypeAlert       = "alert"
+)
+
+// An event is pushed to live streams when a reading is ingested.
+type event struct {
+	ID             int64           `json:"id"`
+	Type           string          `json:"type"`
+	CoordinatorID  string          `json:"coordinator_id"`
+	SensorID       string          `json:"sensor_id,omitempty"`
+	SensorIDs      []string        `json:"sensor_ids,omitempty"`      // members, for group alerts
+	CoordinatorIDs []string        `json:"coordinator_ids,omitempty"` // coordinators of the members, for group alerts
+	CreatedAt      time.Time       `json:"created_at"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// An alert tells about a problem noticed while ingesting a reading, or
+// about a broken rule of a sensor group.
+type alert struct {
+	GroupID string `json:"group_id,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Message string `json:"message"`
+
+	sensorIDs []string // members of the group
+}
+
+func (t *tick) addAlert(channel string, err error) {
+	t.alerts = append(t.alerts, &alert{Channel: channel, Message: err.Error()})
+}
+
+// A subscription selects the events of a coordinator, or of a set of
+// sensors, for one streaming client.
+type subscription struct {
+	coordinatorID string
+	sensorIDs     map[string]bool
+	events        chan *event
+}
+
+func newSubscription(coordinatorID string, sensorIDs []string) *subscription {
+	sub := &subscription{
+		coordinatorID: coordinatorID,
+		events:        make(chan *event, 100),
+	}
+	if len(sensorIDs) > 0 {
+		sub.sensorIDs = make(map[string]bool)
+		for _, id := range sensorIDs {
+			sub.sensorIDs[id] = true
+		}
+	}
+	return sub
+}
+
+func (sub *subscription) matches(e *event) bool {
+	if len(sub.coordinatorID) > 0 && !e.ofCoordinator(sub.coordinatorID) {
+		return false
+	}
+	if sub.sensorIDs != nil {
+		if len(e.SensorID) > 0 {
+			return sub.sensorIDs[e.SensorID]
+		}
+		for _, sensorID := range e.SensorIDs {
+			if sub.sensorIDs[sensorID] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ofCoordinator tells if the event is of the coordinator. A group alert is
+// of the coordinators of its members, whichever upload raised it.
+func (e *event) ofCoordinator(coordinatorID string) bool {
+	if len(e.SensorIDs) == 0 {
+		return e.CoordinatorID == coordinatorID
+	}
+	for _, id := range e.CoordinatorIDs {
+		if id == coordinatorID {
+			return true
+		}
+	}
+	return false
+}
+
+// eventHub distributes events received from Redis to the streaming
+// clients connected to this backend instance.
+type eventHub struct {
+	sync.Mutex
+	subscriptions map[*subscription]bool
+}
+
+var hub = &eventHub{subscriptions: make(map[*subscription]bool)}
+
+func (h *eventHub) subscribe(sub *subscription) {
+	h.Lock()
+	defer h.Unlock()
+	h.subscriptions[sub] = true
+}
+
+func (h *eventHub) unsubscribe(sub *subscription) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subscriptions, sub)
+}
+
+func (h *eventHub) broadcast(e *event) {
+	h.Lock()
+	defer h.Unlock()
+	for sub := range h.subscriptions {
+		if !sub.matches(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			log.Println("[STREAM] subscriber is too slow, dropping event", e.ID)
+		}
+	}
+}
+
+// listenForEvents receives events published by all backend instances
+// and hands them to the hub. It reconnects when Redis connection is lost.
+func listenForEvents() {
+	for {
+		if err := receiveEvents(); err != nil {
+			log.Println("[STREAM] receiving events failed", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func receiveEvents() error {
+	psc := redis.PubSubConn{Conn: redisPool.Get()}
+	defer psc.Close()
+
+	if err := psc.Subscribe(keyEventsChannel); err != nil {
+		return err
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var e event
+			if err := json.Unmarshal(v.Data, &e); err != nil {
+				bugsnag.Notify(err)
+				continue
+			}
+			hub.broadcast(&e)
+		case error:
+			return v
+		}
+	}
+}
+
+func newEvent(eventType, coordinatorID, sensorID string, data interface{}) (*event, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &event{
+		Type:          eventType,
+		CoordinatorID: coordinatorID,
+		SensorID:      sensorID,
+		CreatedAt:     time.Now(),
+		Data:          b,
+	}, nil
+}
+
+// publishEvents numbers the events, adds them to history and publishes
+// them, pipelined on one connection so that an upload with many readings
+// does not cost a round trip per event.
+func publishEvents(events []*event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	last, err := redis.Int64(redisClient.Do("INCRBY", keyEventsID, len(events)))
+	if err != nil {
+		return err
+	}
+
+	encoded := make([][]byte, len(events))
+	for i, e := range events {
+		e.ID = last - int64(len(events)-1-i)
+		if encoded[i], err = json.Marshal(e); err != nil {
+			return err
+		}
+	}
+
+	for i, e := range events {
+		redisClient.Send("ZADD", keyEventsHistory, e.ID, encoded[i])
+	}
+	redisClient.Send("ZREMRANGEBYRANK", keyEventsHistory, 0, -eventsHistoryLength-1)
+	for _, b := range encoded {
+		redisClient.Send("PUBLISH", keyEventsChannel, b)
+	}
+	if err := redisClient.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < 2*len(events)+1; i++ {
+		if _, err := redisClient.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishUpload publishes coordinator status, readings and alerts of an
+// ingested upload to live streams.
+func publishUpload(cr coordinatorReading, ticks []*tick) error {
+	coordinatorID := fmt.Sprintf("%d", cr.CoordinatorID)
+	cr.SensorReadings = nil
+
+	var events []*event
+	add := func(eventType, sensorID string, data interface{}) error {
+		e, err := newEvent(eventType, coordinatorID, sensorID, data)
+		if err != nil {
+			return err
+		}
+		events = append(events, e)
+		return nil
+	}
+
+	if err := add(eventTypeCoordinator, "", cr); err != nil {
+		return err
+	}
+	for _, t := range ticks {
+		if err := add(eventTypeReading, t.SensorID, t); err != nil {
+			return err
+		}
+		for _, alert := range t.alerts {
+			if err := add(eventTypeAlert, t.SensorID, alert); err != nil {
+				return err
+			}
+		}
+	}
+	alerts, err := checkGroupRules(ticks)
+	if err != nil {
+		return err
+	}
+	for _, alert := range alerts {
+		if err := add(eventTypeAlert, "", alert); err != nil {
+			return err
+		}
+		e := events[len(events)-1]
+		e.SensorIDs = alert.sensorIDs
+		if e.CoordinatorIDs, err = findCoordinatorIDsBySensorIDs(alert.sensorIDs); err != nil {
+			return err
+		}
+	}
+	return publishEvents(events)
+}
+
+// eventsSince returns events from history that are newer than given ID.
+func eventsSince(lastEventID int64) ([]*event, error) {
+	redisClient := redisPool.Get()
+	defer redisClient.Close()
+
+	bb, err := redis.Values(redisClient.Do("ZRANGEBYSCORE", keyEventsHistory, fmt.Sprintf("(%d", lastEventID), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*event
+	for _, value := range bb {
+		var e event
+		if err := json.Unmarshal(value.([]byte), &e); err != nil {
+			return nil, err
+		}
+		result = append(result, &e)
+	}
+	return result, nil
+}
+
+func lastEventIDOfRequest(r *http.Request) (int64, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if len(s) == 0 {
+		s = r.FormValue("last_event_id")
+	}
+	if len(s) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// streamEvents streams matching events to the client until it
+// disconnects, over WebSocket if client asks for it, otherwise as
+// Server-Sent Events. Events missed since the last event ID given by the
+// client are sent first. Events of concurrent uploads can be published out
+// of ID order, so live events are only checked against the missed events
+// sent, which can also arrive live.
+func streamEvents(w http.ResponseWriter, r *http.Request, sub *subscription) {
+	lastEventID, err := lastEventIDOfRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid last event ID", http.StatusBadRequest)
+		return
+	}
+
+	var stream eventWriter
+	if isWebSocketRequest(r) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stream = ws
+	} else {
+		sse, err := newSSEWriter(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stream = sse
+	}
+	defer stream.Close()
+
+	hub.subscribe(sub)
+	defer hub.unsubscribe(sub)
+
+	replayed := make(map[int64]bool)
+	if lastEventID > 0 {
+		missed, err := eventsSince(lastEventID)
+		if err != nil {
+			bugsnag.Notify(err)
+			return
+		}
+		for _, e := range missed {
+			if !sub.matches(e) {
+				continue
+			}
+			if err := stream.WriteEvent(e); err != nil {
+				return
+			}
+			replayed[e.ID] = true
+		}
+	}
+
+	keepalive := time.NewTicker(streamKeepaliveSeconds * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e := <-sub.events:
+			if replayed[e.ID] {
+				delete(replayed, e.ID)
+				continue
+			}
+			if err := stream.WriteEvent(e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := stream.Ping(); err != nil {
+				return
+			}
+		case <-stream.Done():
+			return
+		}
+	}
+}
+
+type eventWriter interface {
+	WriteEvent(e *event) error
+	Ping() error
+	Done() <-chan struct{}
+	Close() error
+}
+
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	done    <-chan struct{}
+}
+
+func newSSEWriter(w http.ResponseWriter, r *http.Request) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("Streaming is not supported")
+	}
+	sse := &sseWriter{w: w, flusher: flusher, done: r.Context().Done()}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return sse, nil
+}
+
+func (sse *sseWriter) WriteEvent(e *event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(sse.w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b); err != nil {
+		return err
+	}
+	sse.flusher.Flush()
+	return nil
+}
+
+func (sse *sseWriter) Ping() error {
+	if _, err := fmt.Fprint(sse.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	sse.flusher.Flush()
+	return nil
+}
+
+func (sse *sseWriter) Done() <-chan struct{} {
+	return sse.done
+}
+
+func (sse *sseWriter) Close() error {
+	return nil
+}
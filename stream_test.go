@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestSubscriptionMatches(c *C) {
+	reading := &event{Type: eventTypeReading, CoordinatorID: "20", SensorID: "13A20040B421AC"}
+	status := &event{Type: eventTypeCoordinator, CoordinatorID: "20"}
+
+	sub := newSubscription("20", nil)
+	c.Assert(sub.matches(reading), Equals, true)
+	c.Assert(sub.matches(status), Equals, true)
+
+	sub = newSubscription("21", nil)
+	c.Assert(sub.matches(reading), Equals, false)
+
+	sub = newSubscription("", []string{"13A20040B421AC"})
+	c.Assert(sub.matches(reading), Equals, true)
+	c.Assert(sub.matches(status), Equals, false)
+
+	groupAlert := &event{Type: eventTypeAlert, CoordinatorID: "20", SensorIDs: []string{"13A20040B421AB", "13A20040B421AC"},
+		CoordinatorIDs: []string{"20", "21"}}
+	c.Assert(sub.matches(groupAlert), Equals, true)
+	groupAlert.SensorIDs = []string{"13A20040B421AB"}
+	c.Assert(sub.matches(groupAlert), Equals, false)
+
+	// a group alert raised by an upload of another coordinator
+	sub = newSubscription("21", nil)
+	c.Assert(sub.matches(groupAlert), Equals, true)
+	sub = newSubscription("22", nil)
+	c.Assert(sub.matches(groupAlert), Equals, false)
+}
+
+func (s *TestSuite) TestHubBroadcast(c *C) {
+	sub := newSubscription("20", nil)
+	other := newSubscription("21", nil)
+	hub.subscribe(sub)
+	hub.subscribe(other)
+	defer hub.unsubscribe(sub)
+	defer hub.unsubscribe(other)
+
+	hub.broadcast(&event{ID: 1, CoordinatorID: "20"})
+	c.Assert(len(sub.events), Equals, 1)
+	c.Assert(len(other.events), Equals, 0)
+}
+
+func (s *TestSuite) TestPublishEvents(c *C) {
+	first, err := newEvent(eventTypeCoordinator, "20", "", map[string]int{"gsm_coverage": 20})
+	c.Assert(err, IsNil)
+	second, err := newEvent(eventTypeReading, "20", "13A20040B421AC", map[string]int{"sensor2": 100})
+	c.Assert(err, IsNil)
+	c.Assert(publishEvents([]*event{first, second}), IsNil)
+	c.Assert(second.ID, Equals, first.ID+1)
+
+	events, err := eventsSince(first.ID - 1)
+	c.Assert(err, IsNil)
+	c.Assert(len(events) >= 2, Equals, true)
+	c.Assert(events[0].ID, Equals, first.ID)
+	c.Assert(events[0].Type, Equals, eventTypeCoordinator)
+	c.Assert(events[1].ID, Equals, second.ID)
+	c.Assert(events[1].SensorID, Equals, "13A20040B421AC")
+}
+
+func (s *TestSuite) TestWebSocketAccept(c *C) {
+	// example from RFC 6455
+	c.Assert(webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func (s *TestSuite) TestWebSocketFrame(c *C) {
+	for _, size := range []int{5, 300, 70000} {
+		payload := bytes.Repeat([]byte("a"), size)
+		b := appendWebSocketFrame(nil, wsOpText, payload)
+		if size > 1<<16 {
+			_, _, err := readWebSocketFrame(bytes.NewReader(b))
+			c.Assert(err, Not(IsNil))
+			continue
+		}
+		opcode, read, err := readWebSocketFrame(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		c.Assert(opcode, Equals, byte(wsOpText))
+		c.Assert(read, DeepEquals, payload)
+	}
+}
+
+func (s *TestSuite) TestWebSocketMaskedFrame(c *C) {
+	// masked "Hello" from RFC 6455
+	b := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	opcode, payload, err := readWebSocketFrame(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(opcode, Equals, byte(wsOpText))
+	c.Assert(string(payload), Equals, "Hello")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Minimal server side of the WebSocket protocol (RFC 6455), enough to push
+// events to browsers. Messages from client are read only to notice when it
+// goes away.
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+webSocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+type webSocket struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocket, error) {
+	if r.Method != "GET" {
+		return nil, errors.New("WebSocket handshake must use GET")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if len(key) == 0 {
+		return nil, errors.New("Missing Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("WebSocket is not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &webSocket{conn: conn, rw: rw, done: make(chan struct{})}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// readLoop consumes frames sent by client, answering pings, until client
+// closes the connection.
+func (ws *webSocket) readLoop() {
+	defer close(ws.done)
+	for {
+		opcode, payload, err := readWebSocketFrame(ws.rw.Reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpClose:
+			ws.writeFrame(wsOpClose, nil)
+			return
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readWebSocketFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+	if length > 1<<16 {
+		return 0, nil, errors.New("WebSocket frame too large")
+	}
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		if masked {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+func appendWebSocketFrame(b []byte, opcode byte, payload []byte) []byte {
+	b = append(b, 0x80|opcode)
+	length := len(payload)
+	switch {
+	case length < 126:
+		b = append(b, byte(length))
+	case length <= 0xFFFF:
+		b = append(b, 126, byte(length>>8), byte(length))
+	default:
+		b = append(b, 127)
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(length))
+		b = append(b, ext...)
+	}
+	return append(b, payload...)
+}
+
+func (ws *webSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, err := ws.rw.Write(appendWebSocketFrame(nil, opcode, payload)); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+func (ws *webSocket) WriteEvent(e *event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(wsOpText, b)
+}
+
+func (ws *webSocket) Ping() error {
+	return ws.writeFrame(wsOpPing, nil)
+}
+
+func (ws *webSocket) Done() <-chan struct{} {
+	return ws.done
+}
+
+func (ws *webSocket) Close() error {
+	return ws.conn.Close()
+}